@@ -0,0 +1,22 @@
+package dohdns
+
+import (
+	"net"
+	"net/http"
+)
+
+// ACL wraps handler so that only requests from clients with an address in
+// allowed are passed on, other clients get a 403 Forbidden response. For
+// requests from a proxy in trusted the client address is taken from the
+// X-Forwarded-For header.
+func ACL(handler http.Handler, allowed []*net.IPNet, trusted ...*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trusted)
+		if ip == nil || !inNetworks(ip, allowed) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
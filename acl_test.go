@@ -0,0 +1,81 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var aclTests = []struct {
+	desc         string
+	remoteAddr   string
+	forwardedFor string
+	status       int
+}{
+	{
+		desc:       "Allowed network",
+		remoteAddr: "192.0.2.10:1234",
+		status:     http.StatusOK,
+	},
+	{
+		desc:       "Disallowed IP",
+		remoteAddr: "198.51.100.10:1234",
+		status:     http.StatusForbidden,
+	},
+	{
+		desc:         "Allowed client behind trusted proxy",
+		remoteAddr:   "203.0.113.1:1234",
+		forwardedFor: "198.51.100.10, 192.0.2.10",
+		status:       http.StatusOK,
+	},
+	{
+		desc:         "Disallowed client behind trusted proxy",
+		remoteAddr:   "203.0.113.1:1234",
+		forwardedFor: "192.0.2.10, 198.51.100.10",
+		status:       http.StatusForbidden,
+	},
+	{
+		desc:         "Forwarded address from untrusted client",
+		remoteAddr:   "198.51.100.10:1234",
+		forwardedFor: "192.0.2.10",
+		status:       http.StatusForbidden,
+	},
+}
+
+func TestACL(t *testing.T) {
+	_, allowed, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("TestACL: unable to parse allowed network: %s", err)
+	}
+
+	_, trusted, err := net.ParseCIDR("203.0.113.0/24")
+	if err != nil {
+		t.Fatalf("TestACL: unable to parse trusted network: %s", err)
+	}
+
+	handler := dohdns.ACL(dohdns.HandleRequest(answerDatabase{}, nil), []*net.IPNet{allowed}, trusted)
+
+	for _, test := range aclTests {
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
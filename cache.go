@@ -0,0 +1,395 @@
+package dohdns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheKey identifies the cached response to a question. Responses to
+// queries with and without EDNS0 or the DO bit differ, e.g. in the
+// presence of DNSSEC records, so they are cached separately.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	edns   bool
+	do     bool
+}
+
+// questionKey returns the key identifying the question of the query m.
+func questionKey(m *dns.Msg) cacheKey {
+	q := m.Question[0]
+	key := cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		key.edns = true
+		key.do = opt.Do()
+	}
+
+	return key
+}
+
+// cacheEntry is a cached response and its lifetime.
+type cacheEntry struct {
+	msg         *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	prefetching bool
+}
+
+// CacheBackend wraps another Database and caches its responses for the
+// lifetime given by the record TTLs.
+type CacheBackend struct {
+	Database Database
+
+	// ServeStale enables serving expired responses when the wrapped
+	// database fails, as described in RFC 8767.
+	ServeStale bool
+
+	// StaleTTL is the TTL set on records in stale responses. The default
+	// is 30 seconds as recommended by RFC 8767.
+	StaleTTL time.Duration
+
+	// MaxStale is how long expired responses are kept for serving stale.
+	// The default is one day.
+	MaxStale time.Duration
+
+	// Metrics, if set, collects the cache hits and misses.
+	Metrics *Metrics
+
+	// PrefetchThreshold enables refreshing entries in the background when
+	// they are requested while the remaining fraction of their lifetime
+	// is below it, e.g. 0.1 for the last 10%, keeping popular entries
+	// from expiring. Zero disables prefetching.
+	PrefetchThreshold float64
+
+	// MaxEntries is the maximum number of cached responses. When the
+	// cache is full a random entry is evicted to make room. The default
+	// is 100000.
+	MaxEntries int
+
+	// SweepInterval is how often the whole cache is checked for entries
+	// that are no longer served, so entries are removed even when their
+	// question is not asked again. The default is one minute.
+	SweepInterval time.Duration
+
+	mu        sync.Mutex
+	entries   map[cacheKey]*cacheEntry
+	lastSweep time.Time
+}
+
+// NewCache returns a new CacheBackend wrapping database.
+func NewCache(database Database) *CacheBackend {
+	return &CacheBackend{Database: database}
+}
+
+// Query answers qdata from the cache if possible, otherwise it is passed
+// to the wrapped database and the response is cached.
+func (cb *CacheBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := cb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details about the query.
+func (cb *CacheBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil || len(m.Question) != 1 {
+		// Let the wrapped database deal with anything we can not cache.
+		return queryResult(ctx, cb.Database, qdata)
+	}
+
+	key := questionKey(m)
+
+	now := time.Now()
+	entry := cb.get(key)
+
+	if entry != nil && now.Before(entry.expires) {
+		if cb.Metrics != nil {
+			cb.Metrics.ObserveCacheHit()
+		}
+		if cb.prefetchDue(entry, now) {
+			go cb.prefetch(key, entry, append([]byte(nil), qdata...))
+		}
+		age := uint32(now.Sub(entry.stored) / time.Second)
+		return cachedResult(m, entry.msg, func(ttl uint32) uint32 {
+			if ttl < age {
+				return 0
+			}
+			return ttl - age
+		})
+	}
+
+	if cb.Metrics != nil {
+		cb.Metrics.ObserveCacheMiss()
+	}
+
+	result, err := queryResult(ctx, cb.Database, qdata)
+
+	r := responseMsg(result, err)
+	if r == nil {
+		if cb.ServeStale && entry != nil && now.Before(entry.expires.Add(cb.maxStale())) {
+			staleTTL := uint32(cb.staleTTL() / time.Second)
+			return cachedResult(m, entry.msg, func(uint32) uint32 {
+				return staleTTL
+			})
+		}
+		return result, err
+	}
+
+	if ttl, ok := cacheTTL(r); ok {
+		cb.set(key, &cacheEntry{
+			msg:     r,
+			stored:  now,
+			expires: now.Add(time.Duration(ttl) * time.Second),
+		})
+	}
+
+	return result, err
+}
+
+// Qclasses returns the query classes answered by the wrapped database.
+func (cb *CacheBackend) Qclasses() []uint16 {
+	return databaseQclasses(cb.Database)
+}
+
+// responseMsg returns the response in result, or nil if the query failed
+// or was answered with SERVFAIL.
+func responseMsg(result *Result, err error) *dns.Msg {
+	if err != nil || result.Status != http.StatusOK {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	if r.Unpack(result.Data) != nil || r.Rcode == dns.RcodeServerFailure {
+		return nil
+	}
+
+	return r
+}
+
+// prefetchDue reports whether entry should be refreshed at now, marking
+// it as being refreshed if so.
+func (cb *CacheBackend) prefetchDue(entry *cacheEntry, now time.Time) bool {
+	if cb.PrefetchThreshold <= 0 {
+		return false
+	}
+
+	remaining := entry.expires.Sub(now).Seconds() / entry.expires.Sub(entry.stored).Seconds()
+	if remaining >= cb.PrefetchThreshold {
+		return false
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if entry.prefetching {
+		return false
+	}
+	entry.prefetching = true
+
+	return true
+}
+
+// prefetch refreshes the entry for key by passing qdata to the wrapped
+// database. If that fails the entry is kept and may be refreshed again.
+func (cb *CacheBackend) prefetch(key cacheKey, entry *cacheEntry, qdata []byte) {
+	now := time.Now()
+	result, err := queryResult(context.Background(), cb.Database, qdata)
+
+	if r := responseMsg(result, err); r != nil {
+		if ttl, ok := cacheTTL(r); ok {
+			cb.set(key, &cacheEntry{
+				msg:     r,
+				stored:  now,
+				expires: now.Add(time.Duration(ttl) * time.Second),
+			})
+			return
+		}
+	}
+
+	cb.mu.Lock()
+	entry.prefetching = false
+	cb.mu.Unlock()
+}
+
+// get returns the cache entry for key, or nil.
+func (cb *CacheBackend) get(key cacheKey) *cacheEntry {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	entry, ok := cb.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if cb.removeExpired(key, entry, time.Now()) {
+		return nil
+	}
+
+	return entry
+}
+
+// removeExpired removes entry, stored for key, if it is no longer served
+// at now, and reports whether it was removed. cb.mu must be held.
+func (cb *CacheBackend) removeExpired(key cacheKey, entry *cacheEntry, now time.Time) bool {
+	if cb.ServeStale {
+		if !now.After(entry.expires.Add(cb.maxStale())) {
+			return false
+		}
+	} else if now.Before(entry.expires) {
+		return false
+	}
+
+	delete(cb.entries, key)
+	if cb.Metrics != nil {
+		cb.Metrics.ObserveCacheExpiration()
+	}
+
+	return true
+}
+
+// set stores entry in the cache, making room for it if the cache is full.
+func (cb *CacheBackend) set(key cacheKey, entry *cacheEntry) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.entries == nil {
+		cb.entries = map[cacheKey]*cacheEntry{}
+	}
+
+	now := time.Now()
+	if now.Sub(cb.lastSweep) >= cb.sweepInterval() {
+		for k, e := range cb.entries {
+			cb.removeExpired(k, e, now)
+		}
+		cb.lastSweep = now
+	}
+
+	if _, ok := cb.entries[key]; !ok {
+		// Map iteration order is random, so this evicts random
+		// entries.
+		for k := range cb.entries {
+			if len(cb.entries) < cb.maxEntries() {
+				break
+			}
+			delete(cb.entries, k)
+			if cb.Metrics != nil {
+				cb.Metrics.ObserveCacheEviction()
+			}
+		}
+	}
+
+	cb.entries[key] = entry
+}
+
+// Len returns the number of cached responses, including expired ones not
+// removed yet.
+func (cb *CacheBackend) Len() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return len(cb.entries)
+}
+
+// maxEntries returns the maximum number of cached responses.
+func (cb *CacheBackend) maxEntries() int {
+	if cb.MaxEntries > 0 {
+		return cb.MaxEntries
+	}
+	return 100000
+}
+
+// sweepInterval returns how often the cache is swept.
+func (cb *CacheBackend) sweepInterval() time.Duration {
+	if cb.SweepInterval > 0 {
+		return cb.SweepInterval
+	}
+	return time.Minute
+}
+
+// staleTTL returns the TTL used in stale responses.
+func (cb *CacheBackend) staleTTL() time.Duration {
+	if cb.StaleTTL > 0 {
+		return cb.StaleTTL
+	}
+	return 30 * time.Second
+}
+
+// maxStale returns how long expired entries are kept.
+func (cb *CacheBackend) maxStale() time.Duration {
+	if cb.MaxStale > 0 {
+		return cb.MaxStale
+	}
+	return 24 * time.Hour
+}
+
+// cachedResult builds the response to the query m from the cached message
+// cached, with record TTLs adjusted by ttl.
+func cachedResult(m *dns.Msg, cached *dns.Msg, ttl func(uint32) uint32) (*Result, error) {
+	q := m.Question[0]
+	result := &Result{Question: &q}
+
+	r := cached.Copy()
+	r.Id = m.Id
+	r.Question = m.Question
+
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl(rr.Header().Ttl)
+			}
+		}
+	}
+
+	rdata, err := r.Pack()
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		return result, err
+	}
+
+	result.Data = rdata
+	result.Status = http.StatusOK
+
+	return result, nil
+}
+
+// cacheTTL returns how long r may be cached: the lowest TTL of its records,
+// or for negative responses the SOA minimum (RFC 2308). The returned bool
+// is false if r must not be cached.
+func cacheTTL(r *dns.Msg) (uint32, bool) {
+	if r.Truncated || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	if len(r.Answer) == 0 {
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				return ttl, ttl > 0
+			}
+		}
+		return 0, false
+	}
+
+	ttl := r.Answer[0].Header().Ttl
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+
+	return ttl, ttl > 0
+}
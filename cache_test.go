@@ -0,0 +1,397 @@
+package dohdns_test
+
+import (
+	"errors"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// answerShortTTL answers A queries with 127.0.0.1 and a TTL of 1 second.
+func answerShortTTL(m *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+		A:   net.ParseIP("127.0.0.1"),
+	})
+	return r
+}
+
+func TestCache(t *testing.T) {
+	exchanger := dohdns.NewMockExchanger(answerLocalhost)
+	proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestCache: unable to instantiate NewProxy: %s", err)
+	}
+
+	database := dohdns.NewCache(proxy)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+
+	for i := 0; i < 3; i++ {
+		m.Id = uint16(i + 1)
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("TestCache: unable to pack query: %s", err)
+		}
+
+		rdata, _, err := database.Query(qdata)
+		if err != nil {
+			t.Fatalf("TestCache: unexpected error: %s", err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("TestCache: unable to parse response: %s", err)
+		}
+
+		if r.Id != m.Id {
+			t.Errorf(
+				"TestCache: unexpected response ID (got %d, want %d)",
+				r.Id,
+				m.Id,
+			)
+		}
+
+		if len(r.Answer) != 1 {
+			t.Errorf(
+				"TestCache: unexpected number of answers (got %d, want %d)",
+				len(r.Answer),
+				1,
+			)
+		}
+	}
+
+	if exchanger.Calls() != 1 {
+		t.Errorf(
+			"TestCache: unexpected number of upstream exchanges (got %d, want %d)",
+			exchanger.Calls(),
+			1,
+		)
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	exchanger := dohdns.NewMockExchanger(answerShortTTL)
+	proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestCacheMetrics: unable to instantiate NewProxy: %s", err)
+	}
+
+	database := dohdns.NewCache(proxy)
+	database.Metrics = dohdns.NewMetrics()
+
+	// The first query is a miss, the second a hit. After the TTL of 1
+	// second the entry has expired and the third query is a miss again.
+	for i, wait := range []time.Duration{0, 0, 1100 * time.Millisecond} {
+		time.Sleep(wait)
+		if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+			t.Fatalf("TestCacheMetrics: query %d failed: %s", i, err)
+		}
+	}
+
+	want := dohdns.CacheStats{Hits: 1, Misses: 2, Expirations: 1}
+	if stats := database.Metrics.Cache(); stats != want {
+		t.Errorf(
+			"TestCacheMetrics: unexpected cache stats (got %+v, want %+v)",
+			stats,
+			want,
+		)
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	exchanger := dohdns.NewMockExchanger(answerLocalhost)
+	proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestCacheMaxEntries: unable to instantiate NewProxy: %s", err)
+	}
+
+	database := dohdns.NewCache(proxy)
+	database.MaxEntries = 2
+	database.Metrics = dohdns.NewMetrics()
+
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com.", "c.example.com."} {
+		if _, _, err := database.Query(packQuery(t, name, dns.TypeA)); err != nil {
+			t.Fatalf("TestCacheMaxEntries: query for %s failed: %s", name, err)
+		}
+	}
+
+	if database.Len() != 2 {
+		t.Errorf(
+			"TestCacheMaxEntries: unexpected number of entries (got %d, want %d)",
+			database.Len(),
+			2,
+		)
+	}
+
+	want := dohdns.CacheStats{Hits: 1, Misses: 3, Evictions: 1}
+	if stats := database.Metrics.Cache(); stats != want {
+		t.Errorf(
+			"TestCacheMaxEntries: unexpected cache stats (got %+v, want %+v)",
+			stats,
+			want,
+		)
+	}
+
+	// The newest entry is never the one evicted.
+	if exchanger.Calls() != 3 {
+		t.Errorf(
+			"TestCacheMaxEntries: unexpected number of upstream exchanges (got %d, want %d)",
+			exchanger.Calls(),
+			3,
+		)
+	}
+}
+
+func TestCacheSweep(t *testing.T) {
+	exchanger := dohdns.NewMockExchanger(answerShortTTL)
+	proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestCacheSweep: unable to instantiate NewProxy: %s", err)
+	}
+
+	database := dohdns.NewCache(proxy)
+	database.SweepInterval = time.Second
+
+	if _, _, err := database.Query(packQuery(t, "a.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestCacheSweep: query failed: %s", err)
+	}
+
+	// The expired entry for a.example.com is removed when the next
+	// response is stored, although it is not queried again.
+	time.Sleep(1100 * time.Millisecond)
+
+	if _, _, err := database.Query(packQuery(t, "b.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestCacheSweep: query failed: %s", err)
+	}
+
+	if database.Len() != 1 {
+		t.Errorf(
+			"TestCacheSweep: unexpected number of entries (got %d, want %d)",
+			database.Len(),
+			1,
+		)
+	}
+}
+
+// answerTwoSecondTTL answers A queries with 127.0.0.1 and a TTL of 2
+// seconds.
+func answerTwoSecondTTL(m *dns.Msg) *dns.Msg {
+	r := answerShortTTL(m)
+	r.Answer[0].Header().Ttl = 2
+	return r
+}
+
+func TestCachePrefetch(t *testing.T) {
+	exchanger := dohdns.NewMockExchanger(answerTwoSecondTTL)
+	proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestCachePrefetch: unable to instantiate NewProxy: %s", err)
+	}
+
+	database := dohdns.NewCache(proxy)
+	database.PrefetchThreshold = 0.5
+
+	// The first query fills the cache, the second is answered from it
+	// with more than half of the TTL remaining.
+	for i := 0; i < 2; i++ {
+		if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+			t.Fatalf("TestCachePrefetch: query %d failed: %s", i, err)
+		}
+	}
+
+	if exchanger.Calls() != 1 {
+		t.Errorf(
+			"TestCachePrefetch: unexpected number of upstream exchanges before prefetch (got %d, want %d)",
+			exchanger.Calls(),
+			1,
+		)
+	}
+
+	// Near expiry the entry is still served but refreshed in the
+	// background.
+	time.Sleep(1200 * time.Millisecond)
+
+	if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestCachePrefetch: query near expiry failed: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for exchanger.Calls() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if exchanger.Calls() != 2 {
+		t.Fatalf(
+			"TestCachePrefetch: unexpected number of upstream exchanges after prefetch (got %d, want %d)",
+			exchanger.Calls(),
+			2,
+		)
+	}
+
+	// After the original TTL the refreshed entry is used.
+	time.Sleep(900 * time.Millisecond)
+
+	if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestCachePrefetch: query after expiry failed: %s", err)
+	}
+
+	if exchanger.Calls() != 2 {
+		t.Errorf(
+			"TestCachePrefetch: unexpected number of upstream exchanges after expiry (got %d, want %d)",
+			exchanger.Calls(),
+			2,
+		)
+	}
+}
+
+var serveStaleTests = []struct {
+	desc       string
+	serveStale bool
+	status     int
+	ttl        uint32
+}{
+	{
+		desc:       "Upstream failure with serve-stale",
+		serveStale: true,
+		status:     http.StatusOK,
+		ttl:        5,
+	},
+	{
+		desc:       "Upstream failure without serve-stale",
+		serveStale: false,
+		status:     http.StatusInternalServerError,
+	},
+}
+
+func TestServeStale(t *testing.T) {
+	for _, test := range serveStaleTests {
+		exchanger := dohdns.NewMockExchanger(answerShortTTL)
+		proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+
+		database := dohdns.NewCache(proxy)
+		database.ServeStale = test.serveStale
+		database.StaleTTL = 5 * time.Second
+
+		qdata := packQuery(t, "www.example.com.", dns.TypeA)
+
+		if _, _, err := database.Query(qdata); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		// Let the cached entry expire and break the upstream.
+		time.Sleep(1100 * time.Millisecond)
+		exchanger.Err = errors.New("test error")
+
+		rdata, status, _ := database.Query(qdata)
+
+		if exchanger.Calls() != 2 {
+			t.Errorf(
+				"%s: expired entry did not cause an upstream exchange (got %d exchanges, want %d)",
+				test.desc,
+				exchanger.Calls(),
+				2,
+			)
+		}
+
+		if status != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				test.status,
+			)
+		}
+
+		if status != http.StatusOK {
+			continue
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if len(r.Answer) != 1 || r.Answer[0].Header().Ttl != test.ttl {
+			t.Errorf(
+				"%s: unexpected stale answer (got %v, want a single record with TTL %d)",
+				test.desc,
+				r.Answer,
+				test.ttl,
+			)
+		}
+	}
+}
+
+var cacheDNSSECTests = []struct {
+	desc string
+	edns bool
+	do   bool
+}{
+	{
+		desc: "Query without EDNS0",
+	},
+	{
+		desc: "Query with EDNS0",
+		edns: true,
+	},
+	{
+		desc: "Query with DO bit",
+		edns: true,
+		do:   true,
+	},
+}
+
+func TestCacheDNSSEC(t *testing.T) {
+	exchanger := dohdns.NewMockExchanger(answerLocalhost)
+	proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestCacheDNSSEC: unable to instantiate NewProxy: %s", err)
+	}
+
+	database := dohdns.NewCache(proxy)
+
+	// Each query must be cached independently, the second round is
+	// answered from the cache.
+	for round := 0; round < 2; round++ {
+		for i, test := range cacheDNSSECTests {
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.com.", dns.TypeA)
+			if test.edns {
+				m.SetEdns0(4096, test.do)
+			}
+
+			qdata, err := m.Pack()
+			if err != nil {
+				t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+			}
+
+			if _, _, err := database.Query(qdata); err != nil {
+				t.Fatalf("%s: unexpected error: %s", test.desc, err)
+			}
+
+			want := i + 1
+			if round > 0 {
+				want = len(cacheDNSSECTests)
+			}
+
+			if exchanger.Calls() != want {
+				t.Errorf(
+					"%s: unexpected number of upstream exchanges (got %d, want %d)",
+					test.desc,
+					exchanger.Calls(),
+					want,
+				)
+			}
+		}
+	}
+}
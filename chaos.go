@@ -0,0 +1,89 @@
+package dohdns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net/http"
+)
+
+// ChaosBackend wraps another Database and answers the CHAOS class TXT
+// queries used for diagnostics itself: version.bind. and version.server.
+// with Version, id.server. and hostname.bind. with ID. Other CHAOS class
+// queries are REFUSED, everything else is passed on.
+type ChaosBackend struct {
+	Database Database
+
+	// Version and ID are the strings returned. An empty string makes
+	// the corresponding queries REFUSED.
+	Version string
+	ID      string
+}
+
+// NewChaos returns a new ChaosBackend wrapping database.
+func NewChaos(database Database, version string, id string) *ChaosBackend {
+	return &ChaosBackend{Database: database, Version: version, ID: id}
+}
+
+// Query answers CHAOS queries and passes everything else on to the
+// wrapped database.
+func (cb *ChaosBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := cb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details about the query.
+func (cb *ChaosBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil || len(m.Question) != 1 || m.Question[0].Qclass != dns.ClassCHAOS {
+		return queryResult(ctx, cb.Database, qdata)
+	}
+
+	q := m.Question[0]
+	result := &Result{Question: &q}
+
+	var r *dns.Msg
+	if value := cb.value(q); value != "" {
+		r = NewReply(m, dns.RcodeSuccess, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{value},
+		})
+		r.Authoritative = true
+	} else {
+		r = NewReply(m, dns.RcodeRefused)
+	}
+
+	rdata, err := r.Pack()
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		return result, err
+	}
+
+	result.Data = rdata
+	result.Status = http.StatusOK
+
+	return result, nil
+}
+
+// Qclasses returns the query classes answered by the wrapped database and
+// CH.
+func (cb *ChaosBackend) Qclasses() []uint16 {
+	return append(databaseQclasses(cb.Database), dns.ClassCHAOS)
+}
+
+// value returns the string answering q, or an empty string.
+func (cb *ChaosBackend) value(q dns.Question) string {
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		return ""
+	}
+
+	switch dns.CanonicalName(q.Name) {
+	case "version.bind.", "version.server.":
+		return cb.Version
+	case "id.server.", "hostname.bind.":
+		return cb.ID
+	}
+
+	return ""
+}
@@ -0,0 +1,113 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+var chaosTests = []struct {
+	desc   string
+	qname  string
+	qtype  uint16
+	qclass uint16
+	rcode  int
+	txt    string
+	passed bool
+}{
+	{
+		desc:   "version.bind",
+		qname:  "version.bind.",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassCHAOS,
+		rcode:  dns.RcodeSuccess,
+		txt:    "dohdns 0.1.0",
+	},
+	{
+		desc:   "version.server",
+		qname:  "VERSION.server.",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassCHAOS,
+		rcode:  dns.RcodeSuccess,
+		txt:    "dohdns 0.1.0",
+	},
+	{
+		desc:   "id.server",
+		qname:  "id.server.",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassCHAOS,
+		rcode:  dns.RcodeSuccess,
+		txt:    "doh1",
+	},
+	{
+		desc:   "Unknown CHAOS name",
+		qname:  "authors.bind.",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassCHAOS,
+		rcode:  dns.RcodeRefused,
+	},
+	{
+		desc:   "IN class query is passed on",
+		qname:  "version.bind.",
+		qtype:  dns.TypeTXT,
+		qclass: dns.ClassINET,
+		rcode:  dns.RcodeSuccess,
+		passed: true,
+	},
+}
+
+func TestChaos(t *testing.T) {
+	for _, test := range chaosTests {
+		backend := &namedDatabase{}
+		database := dohdns.NewChaos(backend, "dohdns 0.1.0", "doh1")
+
+		m := new(dns.Msg)
+		m.SetQuestion(test.qname, test.qtype)
+		m.Question[0].Qclass = test.qclass
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		rdata, _, err := database.Query(qdata)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		if (len(backend.names) == 1) != test.passed {
+			t.Errorf("%s: unexpected queries to wrapped database (got %v)", test.desc, backend.names)
+		}
+
+		if test.txt == "" {
+			continue
+		}
+
+		if len(r.Answer) != 1 {
+			t.Fatalf("%s: unexpected number of answers (got %d, want 1)", test.desc, len(r.Answer))
+		}
+
+		txt, ok := r.Answer[0].(*dns.TXT)
+		if !ok || len(txt.Txt) != 1 || txt.Txt[0] != test.txt || txt.Hdr.Class != dns.ClassCHAOS {
+			t.Errorf(
+				"%s: unexpected answer (got %s, want CH TXT \"%s\")",
+				test.desc,
+				r.Answer[0],
+				test.txt,
+			)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package dohdns
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ConcurrencyLimiter limits the number of requests handled at the same
+// time per client address, so a single client can not use up all upstream
+// capacity. Requests exceeding the limit get a 429 Too Many Requests
+// response. It is safe for concurrent use.
+type ConcurrencyLimiter struct {
+	PerClient int
+
+	// TrustedProxies lists the networks of proxies whose X-Forwarded-For
+	// header is used to find the client address.
+	TrustedProxies []*net.IPNet
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// NewConcurrencyLimiter returns a new ConcurrencyLimiter allowing
+// perClient requests in flight per client.
+func NewConcurrencyLimiter(perClient int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{PerClient: perClient}
+}
+
+// Handler wraps handler so that requests are only passed on while the
+// client is within its limit.
+func (cl *ConcurrencyLimiter) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var client string
+		if ip := clientIP(r, cl.TrustedProxies); ip != nil {
+			client = ip.String()
+		}
+
+		if !cl.acquire(client) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		defer cl.release(client)
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// acquire reports whether client may start another request, counting it
+// if so.
+func (cl *ConcurrencyLimiter) acquire(client string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.inFlight[client] >= cl.PerClient {
+		return false
+	}
+
+	if cl.inFlight == nil {
+		cl.inFlight = map[string]int{}
+	}
+	cl.inFlight[client]++
+
+	return true
+}
+
+// release counts a request of client as done.
+func (cl *ConcurrencyLimiter) release(client string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	// Forget idle clients so the map does not grow without bounds.
+	if cl.inFlight[client]--; cl.inFlight[client] <= 0 {
+		delete(cl.inFlight, client)
+	}
+}
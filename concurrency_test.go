@@ -0,0 +1,86 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// blockingHandler counts the requests it receives and blocks them until
+// release is closed.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.started <- struct{}{}
+	<-h.release
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	inner := blockingHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+	handler := dohdns.NewConcurrencyLimiter(2).Handler(inner)
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "https://example.com", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	// Fill the allotment of the first client.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status := serve("192.0.2.1:1234"); status != http.StatusOK {
+				t.Errorf(
+					"TestConcurrencyLimiter: unexpected status code within limit (got %d, want %d)",
+					status,
+					http.StatusOK,
+				)
+			}
+		}()
+	}
+	<-inner.started
+	<-inner.started
+
+	if status := serve("192.0.2.1:5678"); status != http.StatusTooManyRequests {
+		t.Errorf(
+			"TestConcurrencyLimiter: unexpected status code over limit (got %d, want %d)",
+			status,
+			http.StatusTooManyRequests,
+		)
+	}
+
+	// Other clients are not affected.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if status := serve("192.0.2.2:1234"); status != http.StatusOK {
+			t.Errorf(
+				"TestConcurrencyLimiter: unexpected status code for other client (got %d, want %d)",
+				status,
+				http.StatusOK,
+			)
+		}
+	}()
+	<-inner.started
+
+	close(inner.release)
+	wg.Wait()
+
+	// Once the requests are done the client may send more.
+	if status := serve("192.0.2.1:1234"); status != http.StatusOK {
+		t.Errorf(
+			"TestConcurrencyLimiter: unexpected status code after release (got %d, want %d)",
+			status,
+			http.StatusOK,
+		)
+	}
+}
@@ -0,0 +1,126 @@
+package dohdns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// upstreamCookie holds the DNS cookies (RFC 7873) used with an upstream
+// server, hex encoded.
+type upstreamCookie struct {
+	client string
+	server string
+}
+
+// exchangeServer sends m to server, handling DNS cookies if enabled. The
+// cookie is carried in the OPT record, so queries without EDNS0, e.g. the
+// retries of RetryBadVers, are sent without one.
+func (pb *ProxyBackend) exchangeServer(m *dns.Msg, server string) (*dns.Msg, error) {
+	if !pb.Cookies || m.IsEdns0() == nil {
+		r, _, err := pb.Exchanger.Exchange(m, pb.address(server))
+		return r, err
+	}
+
+	r, err := pb.exchangeCookie(m, server)
+	if err == nil && r.Rcode == dns.RcodeBadCookie {
+		// The response carries a fresh server cookie, retry once with
+		// it (RFC 7873, section 5.3).
+		r, err = pb.exchangeCookie(m, server)
+	}
+
+	return r, err
+}
+
+// exchangeCookie sends m, which must have an OPT record, to server with
+// the cookie of the server attached, and stores the server cookie of the
+// response. The cookie is removed from the response as it is only meant
+// for the proxy.
+func (pb *ProxyBackend) exchangeCookie(m *dns.Msg, server string) (*dns.Msg, error) {
+	cookie, err := pb.cookie(server)
+	if err != nil {
+		return nil, err
+	}
+
+	q := m.Copy()
+	opt := q.IsEdns0()
+	opt.Option = append(withoutCookie(opt.Option), &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: cookie.client + cookie.server,
+	})
+
+	r, _, err := pb.Exchanger.Exchange(q, pb.address(server))
+	if err != nil {
+		return nil, err
+	}
+
+	ropt := r.IsEdns0()
+	if ropt == nil {
+		return r, nil
+	}
+
+	for _, o := range ropt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+
+		// A response echoing another client cookie is not an answer to
+		// our query, it is likely spoofed.
+		if len(c.Cookie) < len(cookie.client) || !strings.EqualFold(c.Cookie[:len(cookie.client)], cookie.client) {
+			return nil, fmt.Errorf("ProxyBackend: response from %s with mismatched client cookie", server)
+		}
+		pb.setServerCookie(server, c.Cookie[len(cookie.client):])
+	}
+	ropt.Option = withoutCookie(ropt.Option)
+
+	return r, nil
+}
+
+// cookie returns the cookies of server, creating a client cookie on first
+// use.
+func (pb *ProxyBackend) cookie(server string) (upstreamCookie, error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if c, ok := pb.cookies[server]; ok {
+		return *c, nil
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return upstreamCookie{}, fmt.Errorf("ProxyBackend: unable to create client cookie: %s", err)
+	}
+
+	if pb.cookies == nil {
+		pb.cookies = map[string]*upstreamCookie{}
+	}
+	c := &upstreamCookie{client: hex.EncodeToString(b)}
+	pb.cookies[server] = c
+
+	return *c, nil
+}
+
+// setServerCookie stores the server cookie returned by server.
+func (pb *ProxyBackend) setServerCookie(server string, cookie string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if c, ok := pb.cookies[server]; ok {
+		c.server = cookie
+	}
+}
+
+// withoutCookie returns options without any COOKIE option.
+func withoutCookie(options []dns.EDNS0) []dns.EDNS0 {
+	var kept []dns.EDNS0
+	for _, o := range options {
+		if o.Option() != dns.EDNS0COOKIE {
+			kept = append(kept, o)
+		}
+	}
+
+	return kept
+}
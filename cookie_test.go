@@ -0,0 +1,255 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http"
+	"testing"
+)
+
+// queryCookie returns the COOKIE option of m, or "" if there is none.
+func queryCookie(m *dns.Msg) string {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				return c.Cookie
+			}
+		}
+	}
+
+	return ""
+}
+
+// cookieHandler answers queries like answerLocalhost, echoing the client
+// cookie along with serverCookie, and records the cookies received.
+func cookieHandler(cookies *[]string, serverCookie string) func(*dns.Msg) *dns.Msg {
+	return func(m *dns.Msg) *dns.Msg {
+		cookie := queryCookie(m)
+		*cookies = append(*cookies, cookie)
+
+		r := answerLocalhost(m)
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		if len(cookie) >= 16 {
+			opt := r.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie[:16] + serverCookie})
+		}
+		return r
+	}
+}
+
+// packEdnsQuery returns a wire format query for name and qtype with an OPT
+// record.
+func packEdnsQuery(t *testing.T, name string, qtype uint16) []byte {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	qdata, err := m.Pack()
+	if err != nil {
+		t.Fatalf("unable to pack query for %s: %s", name, err)
+	}
+	return qdata
+}
+
+func TestCookies(t *testing.T) {
+	const serverCookie = "0102030405060708"
+
+	var cookies []string
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(cookieHandler(&cookies, serverCookie)))
+	if err != nil {
+		t.Fatalf("TestCookies: unable to instantiate NewProxy: %s", err)
+	}
+	database.Cookies = true
+
+	for i := 0; i < 2; i++ {
+		rdata, _, err := database.Query(packEdnsQuery(t, "www.example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("TestCookies: unexpected error: %s", err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("TestCookies: unable to parse response: %s", err)
+		}
+
+		if cookie := queryCookie(r); cookie != "" {
+			t.Errorf("TestCookies: unexpected cookie in response: \"%s\"", cookie)
+		}
+	}
+
+	if len(cookies) != 2 {
+		t.Fatalf("TestCookies: unexpected number of exchanges (got %d, want %d)", len(cookies), 2)
+	}
+
+	// The first query only carries the client cookie, the second one also
+	// the server cookie returned by the first response.
+	if len(cookies[0]) != 16 {
+		t.Errorf("TestCookies: unexpected client cookie (got \"%s\", want 8 bytes)", cookies[0])
+	}
+
+	if cookies[1] != cookies[0]+serverCookie {
+		t.Errorf(
+			"TestCookies: unexpected cookie in second query (got \"%s\", want \"%s\")",
+			cookies[1],
+			cookies[0]+serverCookie,
+		)
+	}
+}
+
+func TestCookiesDisabled(t *testing.T) {
+	var cookies []string
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(cookieHandler(&cookies, "0102030405060708")))
+	if err != nil {
+		t.Fatalf("TestCookiesDisabled: unable to instantiate NewProxy: %s", err)
+	}
+
+	if _, _, err := database.Query(packEdnsQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestCookiesDisabled: unexpected error: %s", err)
+	}
+
+	if len(cookies) != 1 || cookies[0] != "" {
+		t.Errorf("TestCookiesDisabled: unexpected cookies sent: %q", cookies)
+	}
+}
+
+func TestCookiesMismatch(t *testing.T) {
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(func(m *dns.Msg) *dns.Msg {
+		r := answerLocalhost(m)
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "ffffffffffffffff0102030405060708"})
+		return r
+	}))
+	if err != nil {
+		t.Fatalf("TestCookiesMismatch: unable to instantiate NewProxy: %s", err)
+	}
+	database.Cookies = true
+
+	_, status, err := database.Query(packEdnsQuery(t, "www.example.com.", dns.TypeA))
+
+	if err == nil || status != http.StatusInternalServerError {
+		t.Errorf(
+			"TestCookiesMismatch: unexpected result (got %d with error %v, want %d with error)",
+			status,
+			err,
+			http.StatusInternalServerError,
+		)
+	}
+}
+
+// badCookieHandler answers the first failures queries with BADCOOKIE and
+// a fresh server cookie, and the remaining ones like answerLocalhost.
+func badCookieHandler(failures int) func(*dns.Msg) *dns.Msg {
+	return func(m *dns.Msg) *dns.Msg {
+		r := answerLocalhost(m)
+		if failures > 0 {
+			failures--
+			r = new(dns.Msg)
+			r.SetRcode(m, dns.RcodeBadCookie)
+		}
+
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: queryCookie(m)[:16] + "0102030405060708"})
+		return r
+	}
+}
+
+var badCookieTests = []struct {
+	desc     string
+	failures int
+	rcode    int
+}{
+	{
+		desc:     "BADCOOKIE answered by retry",
+		failures: 1,
+		rcode:    dns.RcodeSuccess,
+	},
+	{
+		desc:     "BADCOOKIE after retry",
+		failures: 2,
+		rcode:    dns.RcodeBadCookie,
+	},
+}
+
+func TestCookiesBadCookie(t *testing.T) {
+	for _, test := range badCookieTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(badCookieHandler(test.failures)))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.Cookies = true
+
+		rdata, _, err := database.Query(packEdnsQuery(t, "www.example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+	}
+}
+
+func TestCookiesWithoutEdns0(t *testing.T) {
+	var cookies []string
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(cookieHandler(&cookies, "0102030405060708")))
+	if err != nil {
+		t.Fatalf("TestCookiesWithoutEdns0: unable to instantiate NewProxy: %s", err)
+	}
+	database.Cookies = true
+
+	if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestCookiesWithoutEdns0: unexpected error: %s", err)
+	}
+
+	if len(cookies) != 1 || cookies[0] != "" {
+		t.Errorf("TestCookiesWithoutEdns0: unexpected cookies sent: %q", cookies)
+	}
+}
+
+func TestCookiesRetryBadVers(t *testing.T) {
+	var cookies []string
+	exchanger := dohdns.NewMockExchanger(func(m *dns.Msg) *dns.Msg {
+		cookies = append(cookies, queryCookie(m))
+		return answerBadVers(m)
+	})
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestCookiesRetryBadVers: unable to instantiate NewProxy: %s", err)
+	}
+	database.Cookies = true
+	database.RetryBadVers = true
+
+	rdata, _, err := database.Query(packEdnsQuery(t, "www.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("TestCookiesRetryBadVers: unexpected error: %s", err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestCookiesRetryBadVers: unable to parse response: %s", err)
+	}
+
+	if r.Rcode != dns.RcodeSuccess {
+		t.Errorf(
+			"TestCookiesRetryBadVers: unexpected rcode (got %s, want %s)",
+			dns.RcodeToString[r.Rcode],
+			dns.RcodeToString[dns.RcodeSuccess],
+		)
+	}
+
+	// The retry without EDNS0 can not carry a cookie.
+	if len(cookies) != 2 || len(cookies[0]) != 16 || cookies[1] != "" {
+		t.Errorf("TestCookiesRetryBadVers: unexpected cookies sent: %q", cookies)
+	}
+}
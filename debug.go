@@ -0,0 +1,128 @@
+package dohdns
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DebugSample describes a request handled by HandleRequest.
+type DebugSample struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+
+	// Qname and Qtype are the question of the query, empty if it is not
+	// known.
+	Qname string `json:"qname"`
+	Qtype string `json:"qtype"`
+
+	// Rcode is the RCODE of the DNS response, empty if there is none.
+	Rcode string `json:"rcode"`
+
+	// Latency is the time taken to handle the request, in nanoseconds
+	// when encoded as JSON.
+	Latency time.Duration `json:"latency_ns"`
+}
+
+// DebugRecorder keeps the most recent requests in memory for
+// troubleshooting, see WithDebugRecorder and DebugHandler. It holds a
+// fixed number of samples, older ones are overwritten. It is safe for
+// concurrent use. The zero value keeps the last 100 samples.
+type DebugRecorder struct {
+	mu      sync.Mutex
+	samples []DebugSample
+	next    int
+	full    bool
+}
+
+// defaultDebugSamples is the number of samples kept by a zero DebugRecorder.
+const defaultDebugSamples = 100
+
+// NewDebugRecorder returns a new DebugRecorder keeping the last size
+// samples.
+func NewDebugRecorder(size int) *DebugRecorder {
+	if size < 1 {
+		size = 1
+	}
+
+	return &DebugRecorder{samples: make([]DebugSample, size)}
+}
+
+// WithDebugRecorder makes the handler record each request in recorder.
+func WithDebugRecorder(recorder *DebugRecorder) Option {
+	return func(o *Options) {
+		o.DebugRecorder = recorder
+	}
+}
+
+// Record adds sample, replacing the oldest one if the recorder is full.
+func (dr *DebugRecorder) Record(sample DebugSample) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if len(dr.samples) == 0 {
+		dr.samples = make([]DebugSample, defaultDebugSamples)
+	}
+
+	dr.samples[dr.next] = sample
+	dr.next = (dr.next + 1) % len(dr.samples)
+	if dr.next == 0 {
+		dr.full = true
+	}
+}
+
+// Samples returns a copy of the recorded samples, oldest first.
+func (dr *DebugRecorder) Samples() []DebugSample {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if !dr.full {
+		return append([]DebugSample(nil), dr.samples[:dr.next]...)
+	}
+
+	samples := append([]DebugSample(nil), dr.samples[dr.next:]...)
+	return append(samples, dr.samples[:dr.next]...)
+}
+
+// record adds the request r, started at start, with result.
+func (dr *DebugRecorder) record(r *http.Request, start time.Time, result *Result) {
+	sample := DebugSample{
+		Time:    start,
+		Client:  r.RemoteAddr,
+		Latency: time.Since(start),
+	}
+
+	if result != nil {
+		// Backends not implementing ResultDatabase do not report the
+		// question, take it from the response then.
+		question := result.Question
+		if question == nil && len(result.Data) > 0 {
+			m := new(dns.Msg)
+			if m.Unpack(result.Data) == nil && len(m.Question) > 0 {
+				question = &m.Question[0]
+			}
+		}
+		if question != nil {
+			sample.Qname = question.Name
+			sample.Qtype = dns.TypeToString[question.Qtype]
+		}
+
+		if rcode := responseRcode(result.Data); rcode >= 0 {
+			sample.Rcode = dns.RcodeToString[rcode]
+		}
+	}
+
+	dr.Record(sample)
+}
+
+// DebugHandler returns a handler responding with the samples in recorder
+// as a JSON array, oldest first. It exposes client addresses and queries,
+// so it should not be reachable by the public.
+func DebugHandler(recorder *DebugRecorder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recorder.Samples())
+	})
+}
@@ -0,0 +1,90 @@
+package dohdns_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugRecorder(t *testing.T) {
+	database, err := dohdns.NewStatic(staticRecords)
+	if err != nil {
+		t.Fatalf("TestDebugRecorder: unable to instantiate NewStatic: %s", err)
+	}
+
+	// Only the last two of the three queries are kept.
+	recorder := dohdns.NewDebugRecorder(2)
+	handler := dohdns.HandleRequest(database, nil, dohdns.WithDebugRecorder(recorder))
+
+	queries := []struct {
+		qname string
+		qtype uint16
+	}{
+		{qname: "www.example.com.", qtype: dns.TypeA},
+		{qname: "www.example.net.", qtype: dns.TypeA},
+		{qname: "www.example.com.", qtype: dns.TypeAAAA},
+	}
+
+	for _, query := range queries {
+		param := base64.RawURLEncoding.EncodeToString(packQuery(t, query.qname, query.qtype))
+		req := httptest.NewRequest("GET", "https://example.com?dns="+param, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	w := httptest.NewRecorder()
+	dohdns.DebugHandler(recorder).ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/debug", nil))
+
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf(
+			"TestDebugRecorder: unexpected response (got %d with \"%s\", want %d with \"%s\")",
+			resp.StatusCode,
+			resp.Header.Get("Content-Type"),
+			http.StatusOK,
+			"application/json",
+		)
+	}
+
+	var samples []dohdns.DebugSample
+	if err := json.NewDecoder(resp.Body).Decode(&samples); err != nil {
+		t.Fatalf("TestDebugRecorder: unable to decode samples: %s", err)
+	}
+
+	want := []dohdns.DebugSample{
+		{Client: "192.0.2.1:1234", Qname: "www.example.net.", Qtype: "A", Rcode: "NXDOMAIN"},
+		{Client: "192.0.2.1:1234", Qname: "www.example.com.", Qtype: "AAAA", Rcode: "NOERROR"},
+	}
+
+	if len(samples) != len(want) {
+		t.Fatalf("TestDebugRecorder: unexpected number of samples (got %d, want %d)", len(samples), len(want))
+	}
+
+	for i, sample := range samples {
+		if sample.Time.IsZero() || sample.Latency <= 0 {
+			t.Errorf("TestDebugRecorder: sample %d lacks time or latency: %+v", i, sample)
+		}
+
+		sample.Time = want[i].Time
+		sample.Latency = want[i].Latency
+		if sample != want[i] {
+			t.Errorf("TestDebugRecorder: unexpected sample %d (got %+v, want %+v)", i, sample, want[i])
+		}
+	}
+}
+
+func TestDebugRecorderZeroValue(t *testing.T) {
+	var recorder dohdns.DebugRecorder
+
+	for i := 0; i < 101; i++ {
+		recorder.Record(dohdns.DebugSample{Qname: "www.example.com."})
+	}
+
+	if samples := recorder.Samples(); len(samples) != 100 {
+		t.Errorf("TestDebugRecorderZeroValue: unexpected number of samples (got %d, want %d)", len(samples), 100)
+	}
+}
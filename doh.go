@@ -0,0 +1,177 @@
+package dohdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dohMediaType is the media type of DNS messages in RFC 8484.
+const dohMediaType string = "application/dns-message"
+
+// maxDoHResponseSize limits the size of responses read from the upstream.
+const maxDoHResponseSize = dns.MaxMsgSize
+
+// DoHBackend forwards queries to another DNS API server using HTTP POST,
+// e.g. to put a cache or filter in front of a public DoH provider.
+type DoHBackend struct {
+	// URL is the address of the upstream DNS API endpoint, e.g.
+	// "https://dns.example.com/dns-query".
+	URL string
+
+	// Client is the HTTP client used for upstream requests.
+	Client *http.Client
+
+	// UserAgent is the User-Agent header of upstream requests. The
+	// default is "dohdns/<Version>".
+	UserAgent string
+}
+
+// NewDoH returns a new DoHBackend forwarding to url. The HTTP client has a
+// 10 second timeout, it can be replaced by setting Client.
+func NewDoH(url string) *DoHBackend {
+	return &DoHBackend{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Query forwards qdata to the upstream server.
+func (db *DoHBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := db.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details about the query.
+// The upstream request is cancelled together with ctx.
+func (db *DoHBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	result := &Result{}
+
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		return result, classify(ErrInvalidMessage, err)
+	}
+
+	if len(m.Question) != 1 {
+		result.Status = http.StatusBadRequest
+		return result, fmt.Errorf("DoHBackend: expected 1 question, got %d", len(m.Question))
+	}
+	result.Question = &m.Question[0]
+
+	// RFC 8484 recommends an ID of 0 to make responses cache friendly, the
+	// ID of the client is restored in the response.
+	id := m.Id
+	m.Id = 0
+
+	body, err := m.Pack()
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		return result, err
+	}
+
+	r, err := db.exchange(ctx, body)
+	if err != nil {
+		result.Status = http.StatusBadGateway
+		return result, classify(ErrUpstreamFailed, err)
+	}
+
+	r.Id = id
+	result.ExtendedErrors = extendedErrors(r)
+
+	rdata, err := r.Pack()
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		return result, err
+	}
+
+	result.Data = rdata
+	result.Status = http.StatusOK
+
+	return result, nil
+}
+
+// exchange sends the packed query in body to the upstream server and
+// returns the parsed response.
+func (db *DoHBackend) exchange(ctx context.Context, body []byte) (*dns.Msg, error) {
+	req, err := http.NewRequest(http.MethodPost, db.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	userAgent := db.UserAgent
+	if userAgent == "" {
+		userAgent = "dohdns/" + Version
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	client := db.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoHBackend: unexpected status code from upstream: %d", resp.StatusCode)
+	}
+
+	rdata, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		return nil, fmt.Errorf("DoHBackend: unable to parse upstream response: %s", err)
+	}
+
+	return r, nil
+}
+
+// EncodeGetURL returns the URL of a GET request for the query m to the DNS
+// API endpoint base, e.g. "https://dns.example.com/dns-query". The packed
+// query is base64url encoded without padding into the 'dns' parameter,
+// other parameters of base are kept.
+func EncodeGetURL(base string, m *dns.Msg) (string, error) {
+	if m == nil {
+		return "", errors.New("EncodeGetURL: no message")
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("EncodeGetURL: invalid URL: %s", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("EncodeGetURL: URL must be absolute with scheme http or https: %q", base)
+	}
+
+	qdata, err := m.Pack()
+	if err != nil {
+		return "", fmt.Errorf("EncodeGetURL: unable to pack message: %s", err)
+	}
+
+	params := u.Query()
+	params.Set("dns", base64.RawURLEncoding.EncodeToString(qdata))
+	u.RawQuery = params.Encode()
+
+	return u.String(), nil
+}
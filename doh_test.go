@@ -0,0 +1,261 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var dohTests = []struct {
+	desc    string
+	status  int
+	answers int
+}{
+	{
+		desc:    "Answer from upstream",
+		status:  http.StatusOK,
+		answers: 1,
+	},
+	{
+		desc:   "Upstream error",
+		status: http.StatusBadGateway,
+	},
+}
+
+func TestDoH(t *testing.T) {
+	for _, test := range dohTests {
+		var contentType string
+		var ids []uint16
+
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			if test.status != http.StatusOK {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			dohdns.HandleRequest(
+				recordIDDatabase{ids: &ids},
+				nil,
+				dohdns.WithContentTypes("application/dns-message"),
+			).ServeHTTP(w, r)
+		}))
+
+		database := dohdns.NewDoH(upstream.URL)
+		database.Client = upstream.Client()
+
+		qdata := packQuery(t, "www.example.com.", dns.TypeA)
+		rdata, status, err := database.Query(qdata)
+		upstream.Close()
+
+		if status != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				test.status,
+			)
+		}
+
+		if contentType != "application/dns-message" {
+			t.Errorf(
+				"%s: unexpected upstream Content-Type (got \"%s\", want \"%s\")",
+				test.desc,
+				contentType,
+				"application/dns-message",
+			)
+		}
+
+		if test.status != http.StatusOK {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.desc)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		m := new(dns.Msg)
+		m.Unpack(qdata)
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if len(ids) != 1 || ids[0] != 0 {
+			t.Errorf("%s: upstream query did not use ID 0 (got %v)", test.desc, ids)
+		}
+
+		if r.Id != m.Id {
+			t.Errorf(
+				"%s: unexpected response ID (got %d, want %d)",
+				test.desc,
+				r.Id,
+				m.Id,
+			)
+		}
+
+		if len(r.Answer) != test.answers {
+			t.Errorf(
+				"%s: unexpected number of answers (got %d, want %d)",
+				test.desc,
+				len(r.Answer),
+				test.answers,
+			)
+		}
+	}
+}
+
+// recordIDDatabase answers like answerDatabase and records the IDs of the
+// queries it has seen.
+type recordIDDatabase struct {
+	ids *[]uint16
+}
+
+func (d recordIDDatabase) Query(qdata []byte) ([]byte, int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(qdata); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	*d.ids = append(*d.ids, m.Id)
+
+	return answerDatabase{}.Query(qdata)
+}
+
+var dohUserAgentTests = []struct {
+	desc      string
+	userAgent string
+	want      string
+}{
+	{
+		desc:      "Default User-Agent",
+		userAgent: "",
+		want:      "dohdns/" + dohdns.Version,
+	},
+	{
+		desc:      "Custom User-Agent",
+		userAgent: "example/1.0",
+		want:      "example/1.0",
+	},
+}
+
+func TestDoHUserAgent(t *testing.T) {
+	for _, test := range dohUserAgentTests {
+		var userAgent string
+
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userAgent = r.Header.Get("User-Agent")
+			dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithContentTypes("application/dns-message")).ServeHTTP(w, r)
+		}))
+
+		database := dohdns.NewDoH(upstream.URL)
+		database.Client = upstream.Client()
+		database.UserAgent = test.userAgent
+
+		_, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+		upstream.Close()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		if userAgent != test.want {
+			t.Errorf(
+				"%s: unexpected User-Agent (got \"%s\", want \"%s\")",
+				test.desc,
+				userAgent,
+				test.want,
+			)
+		}
+	}
+}
+
+func TestEncodeGetURL(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.Id = 0
+
+	getURL, err := dohdns.EncodeGetURL("https://example.com/dns-query?ct=application/dns-message", m)
+	if err != nil {
+		t.Fatalf("TestEncodeGetURL: unexpected error: %s", err)
+	}
+
+	// The query from RFC 8484 for www.example.com (A), with the ID 0.
+	want := "https://example.com/dns-query?ct=application%2Fdns-message&dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"
+	if getURL != want {
+		t.Errorf(
+			"TestEncodeGetURL: unexpected URL (got \"%s\", want \"%s\")",
+			getURL,
+			want,
+		)
+	}
+
+	// The handler must accept the URL and answer the same question.
+	req := httptest.NewRequest("GET", getURL, nil)
+	w := httptest.NewRecorder()
+
+	handler := dohdns.HandleRequest(answerDatabase{}, nil)
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(
+			"TestEncodeGetURL: unexpected status code (got %d, want %d)",
+			resp.StatusCode,
+			http.StatusOK,
+		)
+	}
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	r := new(dns.Msg)
+	if err := r.Unpack(respBody); err != nil {
+		t.Fatalf("TestEncodeGetURL: unable to parse response: %s", err)
+	}
+
+	if len(r.Question) != 1 || r.Question[0] != m.Question[0] {
+		t.Errorf(
+			"TestEncodeGetURL: unexpected question (got %v, want %v)",
+			r.Question,
+			m.Question,
+		)
+	}
+}
+
+var encodeGetURLErrorTests = []struct {
+	desc string
+	base string
+	msg  *dns.Msg
+}{
+	{
+		desc: "No message",
+		base: "https://example.com/dns-query",
+		msg:  nil,
+	},
+	{
+		desc: "Relative URL",
+		base: "/dns-query",
+		msg:  new(dns.Msg),
+	},
+	{
+		desc: "Unsupported scheme",
+		base: "ftp://example.com/dns-query",
+		msg:  new(dns.Msg),
+	},
+	{
+		desc: "Invalid URL",
+		base: "https://example.com/%zz",
+		msg:  new(dns.Msg),
+	},
+}
+
+func TestEncodeGetURLErrors(t *testing.T) {
+	for _, test := range encodeGetURLErrorTests {
+		if _, err := dohdns.EncodeGetURL(test.base, test.msg); err == nil {
+			t.Errorf("%s: expected an error", test.desc)
+		}
+	}
+}
@@ -2,21 +2,51 @@
 package dohdns
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/miekg/dns"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const mime string = "application/dns-udpwireformat"
+const mimeType string = "application/dns-udpwireformat"
+
+// maxBodySize is the limit of the size of POST bodies.
+// The value 8192 is basically chosen by fair dice roll (common EDNS0 4096 * 2)
+const maxBodySize = 8192
+
+// errBodyTooLarge is returned when a decompressed body exceeds maxBodySize.
+var errBodyTooLarge = fmt.Errorf("%s: decompressed body too large", http.MethodPost)
+
+// Version is the version of the dohdns library, used in the default Server
+// response header.
+const Version string = "0.1.0"
 
 // Request is passed from the generic request handler to the a more specific
 // handler.
 type Request struct {
-	W  http.ResponseWriter
-	R  *http.Request
-	DB Database
+	W    http.ResponseWriter
+	R    *http.Request
+	DB   Database
+	Opts Options
+
+	result *Result
 }
 
 // Database is the interface used by the query handlers to look up
@@ -25,6 +55,40 @@ type Database interface {
 	Query(data []byte) ([]byte, int, error)
 }
 
+// Result holds the outcome of a query along with details about it.
+type Result struct {
+	// Data is the wire format response. It may be nil on error.
+	Data []byte
+
+	// Status is the HTTP status code to respond with.
+	Status int
+
+	// Question is the question of the query, nil if the query could not
+	// be parsed.
+	Question *dns.Question
+
+	// ExtendedErrors holds any Extended DNS Errors (RFC 8914) present in
+	// the response.
+	ExtendedErrors []*dns.EDNS0_EDE
+
+	// RetryAfter, if set, tells the client how long to wait before trying
+	// again. It is sent in the Retry-After header of error responses.
+	RetryAfter time.Duration
+
+	// Upstream is the upstream server that answered the query, empty if
+	// no upstream was involved.
+	Upstream string
+}
+
+// ResultDatabase is an optional interface implemented by a Database that
+// can report details about a query, e.g. for logging. ctx is the context
+// of the HTTP request. The returned Result must never be nil, even when an
+// error is returned.
+type ResultDatabase interface {
+	Database
+	QueryResult(ctx context.Context, data []byte) (*Result, error)
+}
+
 // GetRequest handles GET requests.
 type GetRequest struct {
 	Request
@@ -35,53 +99,779 @@ type PostRequest struct {
 	Request
 }
 
+// Options controls the behaviour of HandleRequest and the request
+// handlers.
+type Options struct {
+	// ServerHeader is the value of the Server response header. An empty
+	// value disables the header.
+	ServerHeader string
+
+	// ErrorFormat selects how error responses are written.
+	ErrorFormat ErrorFormat
+
+	// LenientBase64 makes the GET handler accept padded base64url, and
+	// base64 with the standard alphabet, in addition to the unpadded
+	// base64url mandated by the standard.
+	LenientBase64 bool
+
+	// LenientDuplicateParams makes the GET handler accept a 'dns'
+	// parameter given several times if all values are identical.
+	LenientDuplicateParams bool
+
+	// ContentTypes lists media types accepted for POST bodies in addition
+	// to the DNS wire format type, e.g. "application/octet-stream".
+	ContentTypes []string
+
+	// Metrics, if set, collects statistics about handled requests.
+	Metrics *Metrics
+
+	// RequestIDHeader, if set, is the name of the header carrying the
+	// request ID, e.g. "X-Request-ID". The ID is taken from the request or
+	// generated, then echoed in the response and included in log lines.
+	RequestIDHeader string
+
+	// StrictContentLength makes the POST handler verify that the body
+	// matches the declared Content-Length.
+	StrictContentLength bool
+
+	// StrictGetBody makes the GET handler reject requests carrying a
+	// body.
+	StrictGetBody bool
+
+	// LogFilter selects which requests are logged.
+	LogFilter LogFilter
+
+	// StatusMapper, if set, chooses the HTTP status of error responses.
+	StatusMapper StatusMapper
+
+	// MaxTTL, if set, caps the TTL of all records in responses.
+	MaxTTL uint32
+
+	// CacheControl adds a Cache-Control header to successful responses
+	// with a max-age equal to the lowest TTL of the returned records.
+	CacheControl bool
+
+	// Tracer, if set, is notified at the start and end of each request.
+	Tracer Tracer
+
+	// UpstreamHeader, if set, is the name of a header selecting the
+	// upstream server for the request. It is only accepted from clients
+	// in TrustedProxies.
+	UpstreamHeader string
+	TrustedProxies []*net.IPNet
+
+	// ETag adds an ETag header computed from the response to successful
+	// responses and answers matching If-None-Match requests with 304 Not
+	// Modified.
+	ETag bool
+
+	// UpstreamServerHeader adds an X-Upstream-Server header naming the
+	// upstream server that answered the query.
+	UpstreamServerHeader bool
+
+	// Qclasses lists the query classes accepted. The default is IN, or
+	// the classes reported by the database if it implements
+	// QclassDatabase, e.g. IN and CH for a ChaosBackend. Other classes
+	// are answered with REFUSED, or 403 Forbidden if QclassForbidden is
+	// set.
+	Qclasses        []uint16
+	QclassForbidden bool
+
+	// DisabledMethods lists HTTP methods HandleRequest responds to with
+	// 405 Method Not Allowed, e.g. http.MethodGet to keep DNS queries out
+	// of logged URLs.
+	DisabledMethods []string
+
+	// Headers are static headers set on all responses, e.g. security
+	// headers like Strict-Transport-Security.
+	Headers map[string]string
+
+	// MultipartForm makes the POST handler accept multipart/form-data
+	// bodies, reading the query from the 'dns' field.
+	MultipartForm bool
+
+	// StructuredLogger, if set, is used to log requests with attributes,
+	// in addition to the *log.Logger passed to the handler.
+	StructuredLogger StructuredLogger
+
+	// ResponseStatusMapper, if set, chooses the HTTP status of successful
+	// responses, see WithResponseStatusMapper.
+	ResponseStatusMapper StatusMapper
+
+	// DebugRecorder, if set, records recent requests for
+	// troubleshooting.
+	DebugRecorder *DebugRecorder
+}
+
+// StatusMapper returns the HTTP status to respond with for a failed
+// request. status is the status chosen by the handler, err the error
+// causing the failure and rcode the RCODE of the DNS response passed on to
+// the client, or -1 if there is none. Returning status keeps the default.
+type StatusMapper func(status int, err error, rcode int) int
+
+// LogFilter selects which requests are logged by HandleRequest.
+type LogFilter int
+
+const (
+	// LogAll logs both failed and successful requests, this is the
+	// default.
+	LogAll LogFilter = iota
+
+	// LogErrors only logs failed requests.
+	LogErrors
+
+	// LogSuccesses only logs successful requests.
+	LogSuccesses
+)
+
+// ErrorFormat selects the format of error response bodies.
+type ErrorFormat int
+
+const (
+	// ErrorFormatText writes the status text as plain text, this is the
+	// default.
+	ErrorFormatText ErrorFormat = iota
+
+	// ErrorFormatJSON writes a JSON object like
+	// {"error":"Bad Request","status":400}.
+	ErrorFormatJSON
+)
+
+// Option modifies the Options used by HandleRequest.
+type Option func(*Options)
+
+// WithServerHeader sets the value of the Server response header. An empty
+// value disables the header. The default is "dohdns/<Version>".
+func WithServerHeader(value string) Option {
+	return func(o *Options) {
+		o.ServerHeader = value
+	}
+}
+
+// WithErrorFormat sets the format of error response bodies.
+func WithErrorFormat(format ErrorFormat) Option {
+	return func(o *Options) {
+		o.ErrorFormat = format
+	}
+}
+
+// WithLenientBase64 makes the GET handler fall back to padded base64url,
+// then unpadded and padded base64 with the standard alphabet, when the
+// 'dns' parameter is not valid unpadded base64url. This helps
+// non-conformant clients and intermediaries re-encoding the parameter,
+// the default is to be strict.
+func WithLenientBase64(lenient bool) Option {
+	return func(o *Options) {
+		o.LenientBase64 = lenient
+	}
+}
+
+// WithLenientDuplicateParams makes the GET handler accept requests
+// repeating the 'dns' parameter with identical values, as sent by some
+// buggy clients, instead of rejecting them with 422. Conflicting values
+// are always rejected.
+func WithLenientDuplicateParams(lenient bool) Option {
+	return func(o *Options) {
+		o.LenientDuplicateParams = lenient
+	}
+}
+
+// WithContentTypes makes the POST handler accept the media types in types
+// in addition to the DNS wire format type. This allows interoperability
+// with older clients, by default only the standard type is accepted.
+func WithContentTypes(types ...string) Option {
+	return func(o *Options) {
+		o.ContentTypes = append(o.ContentTypes, types...)
+	}
+}
+
+// WithMetrics makes the handlers record statistics in metrics.
+func WithMetrics(metrics *Metrics) Option {
+	return func(o *Options) {
+		o.Metrics = metrics
+	}
+}
+
+// WithRequestID makes the handler read a request ID from the header named
+// header, generating one if the request has none. The ID is set as a
+// response header, included in log lines and available to backends
+// through RequestID.
+func WithRequestID(header string) Option {
+	return func(o *Options) {
+		o.RequestIDHeader = header
+	}
+}
+
+// WithStrictContentLength makes the POST handler respond with 400 Bad
+// Request when the number of bytes read does not match the Content-Length
+// header. This helps diagnose broken clients or proxies truncating
+// uploads.
+func WithStrictContentLength(strict bool) Option {
+	return func(o *Options) {
+		o.StrictContentLength = strict
+	}
+}
+
+// WithStrictGetBody makes the GET handler respond with 400 Bad Request to
+// requests carrying a body, which is otherwise ignored. A body of unknown
+// length, e.g. with chunked transfer encoding, counts as a body.
+func WithStrictGetBody(strict bool) Option {
+	return func(o *Options) {
+		o.StrictGetBody = strict
+	}
+}
+
+// WithLogFilter selects which requests are logged, e.g. LogErrors to
+// reduce noise from successful requests.
+func WithLogFilter(filter LogFilter) Option {
+	return func(o *Options) {
+		o.LogFilter = filter
+	}
+}
+
+// WithStatusMapper makes the handlers use mapper to choose the HTTP status
+// of error responses, e.g. to respond with 502 instead of 504 when the
+// upstream times out.
+func WithStatusMapper(mapper StatusMapper) Option {
+	return func(o *Options) {
+		o.StatusMapper = mapper
+	}
+}
+
+// WithResponseStatusMapper makes the handlers use mapper to choose the HTTP
+// status of successful responses, which is 200 OK by default. The mapper
+// is called with status 200, a nil error and the RCODE of the response.
+// The DNS response is still included in the body, unless the status does
+// not allow one. RFC 8484 requires DNS responses to be sent with a 2xx
+// status whatever their RCODE, so this is only meant for working around
+// broken clients and its use is strongly discouraged.
+func WithResponseStatusMapper(mapper StatusMapper) Option {
+	return func(o *Options) {
+		o.ResponseStatusMapper = mapper
+	}
+}
+
+// NXDomainStatus returns a StatusMapper for WithResponseStatusMapper which
+// responds with status to queries answered with NXDOMAIN, keeping the
+// status of other responses.
+func NXDomainStatus(status int) StatusMapper {
+	return func(s int, err error, rcode int) int {
+		if rcode == dns.RcodeNameError {
+			return status
+		}
+		return s
+	}
+}
+
+// WithMaxTTL caps the TTL of all records in responses at ttl seconds.
+func WithMaxTTL(ttl uint32) Option {
+	return func(o *Options) {
+		o.MaxTTL = ttl
+	}
+}
+
+// WithCacheControl adds a Cache-Control header with a max-age matching the
+// lowest TTL in the response, as suggested by RFC 8484 section 5.1. The
+// max-age is computed after any TTL clamping by WithMaxTTL.
+func WithCacheControl() Option {
+	return func(o *Options) {
+		o.CacheControl = true
+	}
+}
+
+// WithETag adds an ETag header to successful responses and honors
+// If-None-Match, responding with 304 Not Modified when the response is
+// unchanged.
+func WithETag() Option {
+	return func(o *Options) {
+		o.ETag = true
+	}
+}
+
+// WithUpstreamServerHeader adds an X-Upstream-Server header naming the
+// upstream server that answered the query, when the database reports it.
+func WithUpstreamServerHeader() Option {
+	return func(o *Options) {
+		o.UpstreamServerHeader = true
+	}
+}
+
+// WithQclasses sets the query classes accepted, e.g. dns.ClassINET and
+// dns.ClassCHAOS. Queries of other classes are answered with REFUSED.
+func WithQclasses(classes ...uint16) Option {
+	return func(o *Options) {
+		o.Qclasses = append(o.Qclasses, classes...)
+	}
+}
+
+// WithQclassForbidden makes the handlers respond with 403 Forbidden
+// instead of REFUSED to queries of classes not accepted.
+func WithQclassForbidden() Option {
+	return func(o *Options) {
+		o.QclassForbidden = true
+	}
+}
+
+// WithDisabledMethods disables the HTTP methods, e.g. http.MethodGet, in
+// HandleRequest.
+func WithDisabledMethods(methods ...string) Option {
+	return func(o *Options) {
+		o.DisabledMethods = append(o.DisabledMethods, methods...)
+	}
+}
+
+// WithHeaders sets static headers on all responses, in addition to any
+// set by earlier calls.
+func WithHeaders(headers map[string]string) Option {
+	return func(o *Options) {
+		if o.Headers == nil {
+			o.Headers = map[string]string{}
+		}
+		for name, value := range headers {
+			o.Headers[name] = value
+		}
+	}
+}
+
+// WithMultipartForm makes the POST handler accept queries sent in the
+// 'dns' field of a multipart/form-data body, as some clients do.
+func WithMultipartForm() Option {
+	return func(o *Options) {
+		o.MultipartForm = true
+	}
+}
+
+// allowedMethods returns the methods of methods not disabled.
+func (o Options) allowedMethods(methods ...string) []string {
+	var allowed []string
+
+	for _, method := range methods {
+		if !contains(o.DisabledMethods, method) {
+			allowed = append(allowed, method)
+		}
+	}
+
+	return allowed
+}
+
+// contains reports whether s is one of list.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// maxRequestIDLength limits the size of request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+// RequestID returns the request ID stored in ctx by the handler, or an
+// empty string if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID returns the request ID sent by the client in header, or a
+// newly generated one if it is missing or not printable ASCII.
+func requestID(r *http.Request, header string) string {
+	id := r.Header.Get(header)
+	if id != "" && len(id) <= maxRequestIDLength {
+		valid := true
+		for i := 0; i < len(id); i++ {
+			if id[i] < 0x21 || id[i] > 0x7e {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
+		}
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
 // HandleRequest is a simple help wrapper around the GET and POST handlers.
-func HandleRequest(database Database, log *log.Logger) http.HandlerFunc {
+func HandleRequest(database Database, log *log.Logger, opts ...Option) http.HandlerFunc {
+	return newHandler(database, log, opts, func(req Request) (*Result, error) {
+		allowed := req.Opts.allowedMethods(http.MethodGet, http.MethodPost, http.MethodOptions)
+		if !contains(allowed, req.R.Method) {
+			req.W.Header().Set("Allow", strings.Join(allowed, ", "))
+			return nil, req.error(http.StatusMethodNotAllowed, fmt.Errorf("HandleRequest: method %s is not allowed, use %s", req.R.Method, strings.Join(allowed, " or ")))
+		}
+
+		if req.R.Method == http.MethodOptions {
+			req.writeCapabilities(allowed)
+			return nil, nil
+		}
+
+		if req.R.Method == http.MethodGet {
+			get := &GetRequest{Request: req}
+			err := get.Handle()
+			return get.result, err
+		}
+
+		post := &PostRequest{Request: req}
+		err := post.Handle()
+		return post.result, err
+	})
+}
+
+// writeCapabilities answers an OPTIONS request with the allowed methods
+// and the media types accepted for POST bodies, which lets clients
+// discover what is supported.
+func (req *Request) writeCapabilities(allowed []string) {
+	req.W.Header().Set("Allow", strings.Join(allowed, ", "))
+	if contains(allowed, http.MethodPost) {
+		types := append([]string{mimeType}, req.Opts.ContentTypes...)
+		req.W.Header().Set("Accept-Post", strings.Join(types, ", "))
+	}
+	req.W.WriteHeader(http.StatusNoContent)
+}
+
+// newHandler returns a handler doing the work shared by all request
+// types, like setting headers, tracing and logging, and passing the
+// request on to handle.
+func newHandler(database Database, log *log.Logger, opts []Option, handle func(req Request) (*Result, error)) http.HandlerFunc {
+
+	options := Options{
+		ServerHeader: "dohdns/" + Version,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		var err error
+		var result *Result
 
-		switch r.Method {
-		case http.MethodGet:
-			req := &GetRequest{
-				Request: Request{
-					W:  w,
-					R:  r,
-					DB: database,
-				},
-			}
-			err = req.Handle()
-		case http.MethodPost:
-			req := &PostRequest{
-				Request: Request{
-					W:  w,
-					R:  r,
-					DB: database,
-				},
+		start := time.Now()
+
+		if options.ServerHeader != "" {
+			w.Header().Set("Server", options.ServerHeader)
+		}
+
+		for name, value := range options.Headers {
+			w.Header().Set(name, value)
+		}
+
+		// The prefix of log lines identifies the client and, if enabled,
+		// the request.
+		prefix := r.RemoteAddr
+		if options.RequestIDHeader != "" {
+			id := requestID(r, options.RequestIDHeader)
+			w.Header().Set(options.RequestIDHeader, id)
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+			prefix += " | " + id
+		}
+
+		if options.UpstreamHeader != "" {
+			if upstream, httpStatus, uerr := upstreamOverride(r, options); uerr != nil {
+				err = uerr
+				writeError(w, options.ErrorFormat, options.status(httpStatus, err, -1))
+			} else if upstream != "" {
+				r = r.WithContext(context.WithValue(r.Context(), upstreamKey{}, upstream))
 			}
-			err = req.Handle()
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			err = fmt.Errorf("HandleRequest: only %s and %s methods are supported", http.MethodGet, http.MethodPost)
+		}
+
+		var sw *statusWriter
+		if options.Tracer != nil {
+			ctx := options.Tracer.Start(r.Context())
+			r = r.WithContext(ctx)
+			sw = &statusWriter{ResponseWriter: w}
+			w = sw
+			defer func() {
+				options.Tracer.End(ctx, traceInfo(start, sw.status, result, err))
+			}()
+		}
+
+		if err == nil {
+			result, err = handle(Request{
+				W:    w,
+				R:    r,
+				DB:   database,
+				Opts: options,
+			})
+		}
+
+		if options.StructuredLogger != nil {
+			options.logStructured(r, result, err)
+		}
+
+		if options.DebugRecorder != nil {
+			options.DebugRecorder.record(r, start, result)
 		}
 
 		if log != nil {
+			// Include the question and upstream server when the backend
+			// reports them.
+			var details string
+			if result != nil && result.Question != nil {
+				details = fmt.Sprintf(" | %s %s", result.Question.Name, dns.TypeToString[result.Question.Qtype])
+			}
+			if result != nil && result.Upstream != "" {
+				details += " | upstream " + result.Upstream
+			}
+
 			if err != nil {
-				log.Printf("%s | %s", r.RemoteAddr, err)
-			} else {
-				log.Printf("%s | successful %s request", r.RemoteAddr, r.Method)
+				if options.LogFilter != LogSuccesses {
+					log.Printf("%s | %s%s", prefix, err, details)
+				}
+			} else if options.LogFilter != LogErrors {
+				log.Printf("%s | successful %s request%s", prefix, r.Method, details)
+			}
+		}
+	}
+
+}
+
+// AllowPaths wraps handler so that only requests for one of paths, e.g.
+// "/dns-query", are passed on. Requests for any other path get a 404 Not
+// Found response.
+func AllowPaths(handler http.Handler, paths ...string) http.Handler {
+	allowed := map[string]bool{}
+	for _, path := range paths {
+		allowed[path] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[r.URL.Path] {
+			http.NotFound(w, r)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// writeError writes an error response for httpStatus in the given format.
+func writeError(w http.ResponseWriter, format ErrorFormat, httpStatus int) {
+	switch format {
+	case ErrorFormatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(httpStatus)
+		json.NewEncoder(w).Encode(struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}{
+			Error:  http.StatusText(httpStatus),
+			Status: httpStatus,
+		})
+	default:
+		http.Error(w, http.StatusText(httpStatus), httpStatus)
+	}
+}
+
+// error writes an error response for httpStatus, or the status chosen by
+// the StatusMapper, and returns err.
+func (req *Request) error(httpStatus int, err error) error {
+	writeError(req.W, req.Opts.ErrorFormat, req.Opts.status(httpStatus, err, -1))
+	return err
+}
+
+// status returns the HTTP status to use in place of httpStatus, as chosen
+// by the StatusMapper if there is one.
+func (o Options) status(httpStatus int, err error, rcode int) int {
+	if o.StatusMapper == nil {
+		return httpStatus
+	}
+
+	return o.StatusMapper(httpStatus, err, rcode)
+}
+
+// responseRcode returns the RCODE in the header of the DNS message rdata,
+// or -1 if rdata is too short. Extended RCODEs in EDNS0 are not included.
+func responseRcode(rdata []byte) int {
+	if len(rdata) < 4 {
+		return -1
+	}
+
+	return int(rdata[3] & 0x0f)
+}
+
+// queryResult hands qdata to database, using QueryResult if the database
+// implements ResultDatabase.
+func queryResult(ctx context.Context, database Database, qdata []byte) (*Result, error) {
+	if rdb, ok := database.(ResultDatabase); ok {
+		return rdb.QueryResult(ctx, qdata)
+	}
+
+	rdata, httpStatus, err := database.Query(qdata)
+	return &Result{Data: rdata, Status: httpStatus}, err
+}
+
+// query hands qdata to the database and keeps the result for logging.
+func (req *Request) query(qdata []byte) ([]byte, int, error) {
+	result, err := req.classResult(qdata)
+	if result == nil {
+		result, err = queryResult(req.R.Context(), req.DB, qdata)
+	}
+	req.result = result
+
+	if req.Opts.UpstreamServerHeader && result.Upstream != "" {
+		req.W.Header().Set("X-Upstream-Server", result.Upstream)
+	}
+
+	if req.Opts.Metrics != nil {
+		req.Opts.Metrics.ObserveRequestSize(len(qdata))
+		if err == nil {
+			req.Opts.Metrics.ObserveResponseSize(len(result.Data))
+		}
+	}
+
+	return result.Data, result.Status, err
+}
+
+// queryError writes the response for a failed database query. A backend
+// may describe the failure with DNS data, e.g. a FORMERR message, which is
+// then passed on instead of a plain text error.
+func (req *Request) queryError(rdata []byte, httpStatus int, err error) error {
+	if req.result != nil && req.result.RetryAfter > 0 {
+		// Retry-After is given in whole seconds, round up so clients do
+		// not come back too early.
+		seconds := int64((req.result.RetryAfter + time.Second - 1) / time.Second)
+		req.W.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+
+	if rdata != nil {
+		req.W.WriteHeader(req.Opts.status(httpStatus, err, responseRcode(rdata)))
+		req.W.Write(rdata)
+		return err
+	}
+
+	return req.error(httpStatus, err)
+}
+
+// respond writes rdata as the successful response, clamping TTLs and
+// setting Cache-Control and ETag if configured.
+func (req *Request) respond(rdata []byte) {
+	if req.Opts.MaxTTL > 0 || req.Opts.CacheControl {
+		rdata = req.adjustTTL(rdata)
+	}
+
+	if req.Opts.ETag {
+		etag := etag(rdata)
+		req.W.Header().Set("ETag", etag)
+
+		if etagMatch(req.R.Header.Get("If-None-Match"), etag) {
+			req.W.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if req.Opts.ResponseStatusMapper != nil {
+		status := req.Opts.ResponseStatusMapper(http.StatusOK, nil, responseRcode(rdata))
+		if status != http.StatusOK {
+			req.W.WriteHeader(status)
+			if !bodyAllowed(status) {
+				return
 			}
 		}
 	}
 
+	req.W.Write(rdata)
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// etag returns a strong entity tag for rdata.
+func etag(rdata []byte) string {
+	sum := sha256.Sum256(rdata)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatch reports whether etag matches the If-None-Match header value
+// ifNoneMatch, using the weak comparison of RFC 9110 section 13.1.2.
+func etagMatch(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// adjustTTL clamps the TTLs in rdata to MaxTTL and sets the Cache-Control
+// header from the resulting TTLs. rdata is returned unchanged if it can
+// not be parsed.
+func (req *Request) adjustTTL(rdata []byte) []byte {
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		return rdata
+	}
+
+	if req.Opts.MaxTTL > 0 {
+		clamped := false
+		for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > req.Opts.MaxTTL {
+					rr.Header().Ttl = req.Opts.MaxTTL
+					clamped = true
+				}
+			}
+		}
+
+		// The SOA minimum limits the TTL of negative answers.
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl > req.Opts.MaxTTL {
+				soa.Minttl = req.Opts.MaxTTL
+				clamped = true
+			}
+		}
+
+		if clamped {
+			if data, err := r.Pack(); err == nil {
+				rdata = data
+			}
+		}
+	}
+
+	if req.Opts.CacheControl {
+		if ttl, ok := cacheTTL(r); ok {
+			req.W.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+		}
+	}
+
+	return rdata
+}
+
+// identical reports whether all values are the same.
+func identical(values []string) bool {
+	for _, v := range values[1:] {
+		if v != values[0] {
+			return false
+		}
+	}
+
+	return true
 }
 
 // Handle does the necessary validation of a GET request and hands of
 // the query to a backend.
 func (req *GetRequest) Handle() error {
 
-	req.W.Header().Set("Content-Type", mime)
+	req.W.Header().Set("Content-Type", mimeType)
+
+	if req.Opts.StrictGetBody && req.R.ContentLength != 0 {
+		return req.error(http.StatusBadRequest, fmt.Errorf("%s: request must not have a body", http.MethodGet))
+	}
 
 	// 4.1.  DNS Wire Format:
 	//
@@ -95,47 +885,124 @@ func (req *GetRequest) Handle() error {
 		//
 		// A DNS API client encodes a single DNS query into an HTTP
 		// request [...]
-		if len(dns) != 1 {
-			http.Error(req.W, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
-			return fmt.Errorf("%s: only 1 'dns' parameter is allowed", http.MethodGet)
+		if len(dns) != 1 && !(req.Opts.LenientDuplicateParams && identical(dns)) {
+			return req.error(http.StatusUnprocessableEntity, fmt.Errorf("%s: only 1 'dns' parameter is allowed", http.MethodGet))
 		}
 
 		// Stop processing if the parameter has no content.
 		if len(dns[0]) == 0 {
-			http.Error(req.W, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return fmt.Errorf("%s: 'dns' parameter is empty", http.MethodGet)
+			return req.error(http.StatusBadRequest, fmt.Errorf("%s: 'dns' parameter is empty", http.MethodGet))
 		}
 
 		// Padding characters for base64url MUST NOT be included.
 		// Unpadded base64url equals base64.RAWURLEncoding:
-		qdata, err := base64.RawURLEncoding.DecodeString(dns[0])
+		qdata, err := decodeBase64(dns[0], req.Opts.LenientBase64)
 		if err != nil {
-			http.Error(req.W, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return err
+			return req.error(http.StatusBadRequest, classify(ErrInvalidBase64, err))
 		}
 
-		rdata, httpStatus, err := req.DB.Query(qdata)
+		rdata, httpStatus, err := req.query(qdata)
 
 		if err != nil {
-			http.Error(req.W, http.StatusText(httpStatus), httpStatus)
-			return err
+			return req.queryError(rdata, httpStatus, err)
 		}
 
-		req.W.Write(rdata)
+		req.respond(rdata)
 
 	} else {
-		http.Error(req.W, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return fmt.Errorf("%s: no 'dns' parameter in request", http.MethodGet)
+		return req.error(http.StatusBadRequest, fmt.Errorf("%s: no 'dns' parameter in request", http.MethodGet))
 	}
 
 	return nil
 }
 
+// lenientEncodings are the encodings tried in order by decodeBase64 in
+// lenient mode when the parameter is not unpadded base64url.
+var lenientEncodings = []*base64.Encoding{
+	base64.URLEncoding,
+	base64.RawStdEncoding,
+	base64.StdEncoding,
+}
+
+// decodeBase64 decodes the 'dns' parameter s. Unpadded base64url is always
+// tried first, if lenient is true the lenientEncodings are tried next. The
+// error is that of unpadded base64url.
+func decodeBase64(s string, lenient bool) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil || !lenient {
+		return data, err
+	}
+
+	for _, encoding := range lenientEncodings {
+		if ldata, lerr := encoding.DecodeString(s); lerr == nil {
+			return ldata, nil
+		}
+	}
+
+	return data, err
+}
+
+// gunzip decompresses the gzip data in body, returning errBodyTooLarge if
+// the result is larger than limit.
+func gunzip(body []byte, limit int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+
+	return data, nil
+}
+
+// multipartQuery returns the contents of the 'dns' field in the
+// multipart/form-data body.
+func multipartQuery(body []byte, boundary string) ([]byte, error) {
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s: no 'dns' field in multipart form", http.MethodPost)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid multipart form: %s", http.MethodPost, err)
+		}
+
+		if part.FormName() == "dns" {
+			return ioutil.ReadAll(part)
+		}
+	}
+}
+
+// acceptedMediaType reports whether mediaType is accepted for POST bodies.
+func (req *PostRequest) acceptedMediaType(mediaType string) bool {
+	if mediaType == mimeType {
+		return true
+	}
+
+	for _, t := range req.Opts.ContentTypes {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Handle does the necessary validation of a POST request and hands of
 // the query to a backend.
 func (req *PostRequest) Handle() error {
 
-	req.W.Header().Set("Content-Type", mime)
+	req.W.Header().Set("Content-Type", mimeType)
 
 	// 4.1.  DNS Wire Format:
 	//
@@ -144,45 +1011,75 @@ func (req *PostRequest) Handle() error {
 
 	// Make sure the 'dns' query parameter is not present.
 	if _, ok := req.R.URL.Query()["dns"]; ok {
-		http.Error(req.W, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return fmt.Errorf("%s: 'dns' parameter not allowed", http.MethodPost)
+		return req.error(http.StatusBadRequest, fmt.Errorf("%s: 'dns' parameter not allowed", http.MethodPost))
 	}
 
 	// When using the POST method the DNS query is included as the message
 	// body of the HTTP request and the Content-Type request header
-	// indicates the media type of the message.
-	if req.R.Header.Get("Content-Type") != mime {
-		http.Error(req.W, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
-		return fmt.Errorf("%s: Content-Type must be %s", http.MethodPost, mime)
+	// indicates the media type of the message. Only the media type itself
+	// is compared, parameters like charset are ignored.
+	mediaType, params, err := mime.ParseMediaType(req.R.Header.Get("Content-Type"))
+	multipartForm := req.Opts.MultipartForm && mediaType == "multipart/form-data"
+	if (err != nil && err != mime.ErrInvalidMediaParameter) || !(multipartForm || req.acceptedMediaType(mediaType)) {
+		return req.error(http.StatusUnsupportedMediaType, fmt.Errorf("%s: Content-Type must be %s", http.MethodPost, mimeType))
 	}
 
 	// Set a limit on body size to protect against DoS.
-	// The value 8192 is basically chosen by fair dice roll (common EDNS0 4096 * 2)
-	req.R.Body = http.MaxBytesReader(req.W, req.R.Body, 8192)
+	req.R.Body = http.MaxBytesReader(req.W, req.R.Body, maxBodySize)
 	body, err := ioutil.ReadAll(req.R.Body)
 	if err != nil {
-		if err.Error() == "http: request body too large" {
-			http.Error(req.W, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
-			return err
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return req.error(http.StatusRequestEntityTooLarge, err)
+		}
+		// The connection ended before Content-Length bytes were read.
+		if req.Opts.StrictContentLength && errors.Is(err, io.ErrUnexpectedEOF) {
+			return req.error(http.StatusBadRequest, fmt.Errorf("%s: body shorter than Content-Length %d: %s", http.MethodPost, req.R.ContentLength, err))
+		}
+		return req.error(http.StatusInternalServerError, err)
+	}
+
+	// A negative ContentLength means the length is unknown, e.g. with
+	// chunked transfer encoding.
+	if req.Opts.StrictContentLength && req.R.ContentLength >= 0 && int64(len(body)) != req.R.ContentLength {
+		return req.error(http.StatusBadRequest, fmt.Errorf("%s: body size %d does not match Content-Length %d", http.MethodPost, len(body), req.R.ContentLength))
+	}
+
+	// Some clients compress the body. The size limit also applies to the
+	// decompressed data to protect against zip bombs.
+	switch encoding := strings.ToLower(strings.TrimSpace(req.R.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		body, err = gunzip(body, maxBodySize)
+		if err != nil {
+			if err == errBodyTooLarge {
+				return req.error(http.StatusRequestEntityTooLarge, err)
+			}
+			return req.error(http.StatusBadRequest, err)
+		}
+	default:
+		return req.error(http.StatusUnsupportedMediaType, fmt.Errorf("%s: unsupported Content-Encoding %s", http.MethodPost, encoding))
+	}
+
+	if multipartForm {
+		body, err = multipartQuery(body, params["boundary"])
+		if err != nil {
+			return req.error(http.StatusBadRequest, err)
 		}
-		http.Error(req.W, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return err
 	}
 
 	// An empty body does not make sense.
 	if len(body) == 0 {
-		http.Error(req.W, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return fmt.Errorf("%s: empty body in request", http.MethodPost)
+		return req.error(http.StatusBadRequest, fmt.Errorf("%s: empty body in request", http.MethodPost))
 	}
 
-	rdata, httpStatus, err := req.DB.Query(body)
+	rdata, httpStatus, err := req.query(body)
 
 	if err != nil {
-		http.Error(req.W, http.StatusText(httpStatus), httpStatus)
-		return err
+		return req.queryError(rdata, httpStatus, err)
 	}
 
-	req.W.Write(rdata)
+	req.respond(rdata)
 
 	return nil
 }
@@ -1,18 +1,25 @@
 package dohdns_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/eest/dohdns"
 	"github.com/miekg/dns"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -20,7 +27,7 @@ import (
 
 var requestTests = []struct {
 	desc            string
-	handler         func(dohdns.Database, *log.Logger) http.HandlerFunc
+	handler         func(dohdns.Database, *log.Logger, ...dohdns.Option) http.HandlerFunc
 	url             string
 	method          string
 	status          int
@@ -140,6 +147,37 @@ var requestTests = []struct {
 		reqContentType:  "application/dns-udpwireformat",
 		respContentType: "application/dns-udpwireformat",
 	},
+	{
+		desc:            "POST with valid www.example.com (A) query and charset parameter in Content-Type",
+		handler:         dohdns.HandleRequest,
+		method:          "POST",
+		url:             "https://example.com",
+		status:          http.StatusOK,
+		reqBody:         []byte{0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x77, 0x77, 0x77, 0x7, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x3, 0x63, 0x6f, 0x6d, 0x0, 0x0, 0x1, 0x0, 0x1},
+		reqContentType:  "application/dns-udpwireformat; charset=utf-8",
+		respContentType: "application/dns-udpwireformat",
+	},
+	{
+		desc:            "POST with valid www.example.com (A) query and surrounding whitespace in Content-Type",
+		handler:         dohdns.HandleRequest,
+		method:          "POST",
+		url:             "https://example.com",
+		status:          http.StatusOK,
+		reqBody:         []byte{0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x77, 0x77, 0x77, 0x7, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x3, 0x63, 0x6f, 0x6d, 0x0, 0x0, 0x1, 0x0, 0x1},
+		reqContentType:  "  application/dns-udpwireformat  ",
+		respContentType: "application/dns-udpwireformat",
+	},
+	{
+		desc:            "POST with other Content-Type and parameter",
+		handler:         dohdns.HandleRequest,
+		method:          "POST",
+		url:             "https://example.com",
+		status:          http.StatusUnsupportedMediaType,
+		reqBody:         []byte{0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x77, 0x77, 0x77, 0x7, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x3, 0x63, 0x6f, 0x6d, 0x0, 0x0, 0x1, 0x0, 0x1},
+		reqContentType:  "text/plain; charset=utf-8",
+		respContentType: "text/plain; charset=utf-8",
+		respBody:        []byte("Unsupported Media Type\n"),
+	},
 	{
 		desc:            "POST with valid noresponse.example.com (A) query that should time out",
 		handler:         dohdns.HandleRequest,
@@ -452,3 +490,1352 @@ func TestNewProxy(t *testing.T) {
 		}
 	}
 }
+
+var serverHeaderTests = []struct {
+	desc   string
+	opts   []dohdns.Option
+	header string
+}{
+	{
+		desc:   "Default Server header",
+		opts:   nil,
+		header: "dohdns/" + dohdns.Version,
+	},
+	{
+		desc:   "Custom Server header",
+		opts:   []dohdns.Option{dohdns.WithServerHeader("example")},
+		header: "example",
+	},
+	{
+		desc:   "Disabled Server header",
+		opts:   []dohdns.Option{dohdns.WithServerHeader("")},
+		header: "",
+	},
+}
+
+func TestServerHeader(t *testing.T) {
+	for _, test := range serverHeaderTests {
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.Header.Get("Server") != test.header {
+			t.Errorf(
+				"%s: unexpected Server header (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Server"),
+				test.header,
+			)
+		}
+
+		if _, ok := resp.Header["Server"]; !ok && test.header != "" {
+			t.Errorf("%s: missing Server header", test.desc)
+		}
+	}
+}
+
+func TestLogQuestion(t *testing.T) {
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(nil))
+	if err != nil {
+		t.Fatalf("TestLogQuestion: unable to instantiate NewProxy: %s", err)
+	}
+
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+	w := httptest.NewRecorder()
+
+	handler := dohdns.HandleRequest(database, logger)
+	handler.ServeHTTP(w, req)
+
+	if !strings.Contains(buf.String(), "www.example.com. A") {
+		t.Errorf(
+			"TestLogQuestion: log line does not contain the question (got \"%s\")",
+			strings.TrimSpace(buf.String()),
+		)
+	}
+}
+
+var requestIDTests = []struct {
+	desc   string
+	header string
+	echoed bool
+}{
+	{
+		desc:   "Echo request ID from client",
+		header: "abc-123",
+		echoed: true,
+	},
+	{
+		desc:   "Generate missing request ID",
+		header: "",
+		echoed: false,
+	},
+	{
+		desc:   "Replace request ID with control characters",
+		header: "abc\x01",
+		echoed: false,
+	},
+}
+
+func TestRequestID(t *testing.T) {
+	for _, test := range requestIDTests {
+		var buf bytes.Buffer
+		logger := log.New(&buf, "", 0)
+
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+		if test.header != "" {
+			req.Header.Set("X-Request-ID", test.header)
+		}
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, logger, dohdns.WithRequestID("X-Request-ID"))
+		handler.ServeHTTP(w, req)
+
+		id := w.Result().Header.Get("X-Request-ID")
+
+		if id == "" {
+			t.Fatalf("%s: missing X-Request-ID response header", test.desc)
+		}
+
+		if (id == test.header) != test.echoed {
+			t.Errorf(
+				"%s: unexpected X-Request-ID response header (got \"%s\", echoed %t)",
+				test.desc,
+				id,
+				test.echoed,
+			)
+		}
+
+		if !strings.Contains(buf.String(), " | "+id+" | ") {
+			t.Errorf(
+				"%s: log line does not contain the request ID (got \"%s\")",
+				test.desc,
+				strings.TrimSpace(buf.String()),
+			)
+		}
+	}
+}
+
+var allowPathsTests = []struct {
+	desc   string
+	url    string
+	status int
+}{
+	{
+		desc:   "Allowed path",
+		url:    "https://example.com/dns-query?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		status: http.StatusOK,
+	},
+	{
+		desc:   "Root path",
+		url:    "https://example.com/?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		status: http.StatusNotFound,
+	},
+	{
+		desc:   "Path below allowed path",
+		url:    "https://example.com/dns-query/other?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		status: http.StatusNotFound,
+	},
+}
+
+func TestAllowPaths(t *testing.T) {
+	handler := dohdns.AllowPaths(dohdns.HandleRequest(answerDatabase{}, nil), "/dns-query")
+
+	for _, test := range allowPathsTests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
+
+var errorFormatTests = []struct {
+	desc            string
+	method          string
+	url             string
+	status          int
+	respContentType string
+	respBody        []byte
+}{
+	{
+		desc:            "GET with no 'dns' parameter",
+		method:          "GET",
+		url:             "https://example.com",
+		status:          http.StatusBadRequest,
+		respContentType: "application/json",
+		respBody:        []byte("{\"error\":\"Bad Request\",\"status\":400}\n"),
+	},
+	{
+		desc:            "GET with multiple 'dns' parameters",
+		method:          "GET",
+		url:             "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB&dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		status:          http.StatusUnprocessableEntity,
+		respContentType: "application/json",
+		respBody:        []byte("{\"error\":\"Unprocessable Entity\",\"status\":422}\n"),
+	},
+	{
+		desc:            "GET with parseable base64url that is not a valid DNS query",
+		method:          "GET",
+		url:             "https://example.com?dns=invalid",
+		status:          http.StatusBadRequest,
+		respContentType: "application/json",
+		respBody:        []byte("{\"error\":\"Bad Request\",\"status\":400}\n"),
+	},
+	{
+		desc:            "POST with wrong Content-Type",
+		method:          "POST",
+		url:             "https://example.com",
+		status:          http.StatusUnsupportedMediaType,
+		respContentType: "application/json",
+		respBody:        []byte("{\"error\":\"Unsupported Media Type\",\"status\":415}\n"),
+	},
+	{
+		desc:            "Unsupported PUT method",
+		method:          "PUT",
+		url:             "https://example.com",
+		status:          http.StatusMethodNotAllowed,
+		respContentType: "application/json",
+		respBody:        []byte("{\"error\":\"Method Not Allowed\",\"status\":405}\n"),
+	},
+}
+
+func TestErrorFormat(t *testing.T) {
+	for _, test := range errorFormatTests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithErrorFormat(dohdns.ErrorFormatJSON))
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if resp.Header.Get("Content-Type") != test.respContentType {
+			t.Errorf(
+				"%s: unexpected Content-Type (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Content-Type"),
+				test.respContentType,
+			)
+		}
+
+		if !bytes.Equal(respBody, test.respBody) {
+			t.Errorf(
+				"%s: unexpected respBody (got \"%s\", want \"%s\")",
+				test.desc,
+				respBody,
+				test.respBody,
+			)
+		}
+	}
+}
+
+var lenientBase64Tests = []struct {
+	desc     string
+	lenient  bool
+	encoding *base64.Encoding
+	status   int
+}{
+	{
+		desc:     "Padded parameter in strict mode",
+		lenient:  false,
+		encoding: base64.URLEncoding,
+		status:   http.StatusBadRequest,
+	},
+	{
+		desc:     "Padded parameter in lenient mode",
+		lenient:  true,
+		encoding: base64.URLEncoding,
+		status:   http.StatusOK,
+	},
+	{
+		desc:     "Unpadded parameter in lenient mode",
+		lenient:  true,
+		encoding: base64.RawURLEncoding,
+		status:   http.StatusOK,
+	},
+	{
+		desc:     "Standard alphabet in strict mode",
+		lenient:  false,
+		encoding: base64.RawStdEncoding,
+		status:   http.StatusBadRequest,
+	},
+	{
+		desc:     "Unpadded standard alphabet in lenient mode",
+		lenient:  true,
+		encoding: base64.RawStdEncoding,
+		status:   http.StatusOK,
+	},
+	{
+		desc:     "Padded standard alphabet in lenient mode",
+		lenient:  true,
+		encoding: base64.StdEncoding,
+		status:   http.StatusOK,
+	},
+}
+
+func TestLenientBase64(t *testing.T) {
+	// A query for example.com is 29 bytes long, which requires padding.
+	// The ID makes the encodings differ in alphabet: 0xfbff is "+/" in
+	// the standard alphabet and "-_" in the URL alphabet.
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Id = 0xfbff
+	qdata, err := m.Pack()
+	if err != nil {
+		t.Fatalf("TestLenientBase64: unable to pack query: %s", err)
+	}
+
+	for _, test := range lenientBase64Tests {
+		param := test.encoding.EncodeToString(qdata)
+
+		req := httptest.NewRequest("GET", "https://example.com?dns="+url.QueryEscape(param), nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithLenientBase64(test.lenient))
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
+
+var lenientDuplicateParamsTests = []struct {
+	desc    string
+	lenient bool
+	params  []string
+	status  int
+}{
+	{
+		desc:    "Identical duplicates in strict mode",
+		lenient: false,
+		params:  []string{"AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", "AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"},
+		status:  http.StatusUnprocessableEntity,
+	},
+	{
+		desc:    "Identical duplicates in lenient mode",
+		lenient: true,
+		params:  []string{"AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", "AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"},
+		status:  http.StatusOK,
+	},
+	{
+		desc:    "Differing duplicates in lenient mode",
+		lenient: true,
+		params:  []string{"AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", "AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAHAAB"},
+		status:  http.StatusUnprocessableEntity,
+	},
+	{
+		desc:    "Single parameter in lenient mode",
+		lenient: true,
+		params:  []string{"AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB"},
+		status:  http.StatusOK,
+	},
+}
+
+func TestLenientDuplicateParams(t *testing.T) {
+	for _, test := range lenientDuplicateParamsTests {
+		query := url.Values{"dns": test.params}
+
+		req := httptest.NewRequest("GET", "https://example.com?"+query.Encode(), nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithLenientDuplicateParams(test.lenient))
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
+
+var strictGetBodyTests = []struct {
+	desc   string
+	strict bool
+	body   string
+	status int
+}{
+	{
+		desc:   "Body ignored by default",
+		strict: false,
+		body:   "test body",
+		status: http.StatusOK,
+	},
+	{
+		desc:   "Body rejected in strict mode",
+		strict: true,
+		body:   "test body",
+		status: http.StatusBadRequest,
+	},
+	{
+		desc:   "No body in strict mode",
+		strict: true,
+		body:   "",
+		status: http.StatusOK,
+	},
+}
+
+func TestStrictGetBody(t *testing.T) {
+	for _, test := range strictGetBodyTests {
+		var body io.Reader
+		if test.body != "" {
+			body = strings.NewReader(test.body)
+		}
+
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", body)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithStrictGetBody(test.strict))
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
+
+var contentTypesTests = []struct {
+	desc   string
+	opts   []dohdns.Option
+	status int
+}{
+	{
+		desc:   "POST with application/octet-stream by default",
+		opts:   nil,
+		status: http.StatusUnsupportedMediaType,
+	},
+	{
+		desc:   "POST with application/octet-stream when configured",
+		opts:   []dohdns.Option{dohdns.WithContentTypes("application/octet-stream")},
+		status: http.StatusOK,
+	},
+}
+
+func TestContentTypes(t *testing.T) {
+	for _, test := range contentTypesTests {
+		req := httptest.NewRequest("POST", "https://example.com", bytes.NewReader(packQuery(t, "www.example.com.", dns.TypeA)))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
+
+// gzipData returns data compressed with gzip.
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("unable to compress data: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unable to compress data: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipBody(t *testing.T) {
+	gzipTests := []struct {
+		desc     string
+		body     []byte
+		encoding string
+		status   int
+	}{
+		{
+			desc:     "POST with gzipped valid query",
+			body:     gzipData(t, packQuery(t, "www.example.com.", dns.TypeA)),
+			encoding: "gzip",
+			status:   http.StatusOK,
+		},
+		{
+			desc:     "POST with gzipped body too large when decompressed",
+			body:     gzipData(t, make([]byte, 8193)),
+			encoding: "gzip",
+			status:   http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:     "POST with invalid gzip data",
+			body:     packQuery(t, "www.example.com.", dns.TypeA),
+			encoding: "gzip",
+			status:   http.StatusBadRequest,
+		},
+		{
+			desc:     "POST with unsupported Content-Encoding",
+			body:     packQuery(t, "www.example.com.", dns.TypeA),
+			encoding: "br",
+			status:   http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, test := range gzipTests {
+		req := httptest.NewRequest("POST", "https://example.com", bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/dns-udpwireformat")
+		req.Header.Set("Content-Encoding", test.encoding)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
+
+var contentLengthTests = []struct {
+	desc   string
+	delta  int64
+	opts   []dohdns.Option
+	status int
+}{
+	{
+		desc:   "Matching Content-Length",
+		delta:  0,
+		opts:   []dohdns.Option{dohdns.WithStrictContentLength(true)},
+		status: http.StatusOK,
+	},
+	{
+		desc:   "Content-Length larger than body",
+		delta:  10,
+		opts:   []dohdns.Option{dohdns.WithStrictContentLength(true)},
+		status: http.StatusBadRequest,
+	},
+	{
+		desc:   "Truncated body without strict checking",
+		delta:  10,
+		opts:   nil,
+		status: http.StatusInternalServerError,
+	},
+}
+
+// TestStrictContentLength sends the requests over a raw connection to a
+// real server, since the server is what notices a body shorter than its
+// Content-Length when the client stops sending.
+func TestStrictContentLength(t *testing.T) {
+	for _, test := range contentLengthTests {
+		server := httptest.NewServer(dohdns.HandleRequest(answerDatabase{}, nil, test.opts...))
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			server.Close()
+			t.Fatalf("%s: unable to connect: %s", test.desc, err)
+		}
+
+		body := packQuery(t, "www.example.com.", dns.TypeA)
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/dns-udpwireformat\r\nContent-Length: %d\r\n\r\n", int64(len(body))+test.delta)
+		conn.Write(body)
+		conn.(*net.TCPConn).CloseWrite()
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			conn.Close()
+			server.Close()
+			t.Fatalf("%s: unable to read response: %s", test.desc, err)
+		}
+		resp.Body.Close()
+		conn.Close()
+		server.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
+
+var logFilterTests = []struct {
+	desc      string
+	filter    dohdns.LogFilter
+	errors    bool
+	successes bool
+}{
+	{
+		desc:      "Log all requests",
+		filter:    dohdns.LogAll,
+		errors:    true,
+		successes: true,
+	},
+	{
+		desc:      "Log errors only",
+		filter:    dohdns.LogErrors,
+		errors:    true,
+		successes: false,
+	},
+	{
+		desc:      "Log successes only",
+		filter:    dohdns.LogSuccesses,
+		errors:    false,
+		successes: true,
+	},
+}
+
+func TestLogFilter(t *testing.T) {
+	for _, test := range logFilterTests {
+		var buf bytes.Buffer
+		logger := log.New(&buf, "", 0)
+
+		handler := dohdns.HandleRequest(answerDatabase{}, logger, dohdns.WithLogFilter(test.filter))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://example.com", nil))
+
+		output := buf.String()
+
+		if strings.Contains(output, "successful GET request") != test.successes {
+			t.Errorf(
+				"%s: unexpected logging of successful request (got \"%s\", want logged %t)",
+				test.desc,
+				strings.TrimSpace(output),
+				test.successes,
+			)
+		}
+
+		if strings.Contains(output, "no 'dns' parameter") != test.errors {
+			t.Errorf(
+				"%s: unexpected logging of failed request (got \"%s\", want logged %t)",
+				test.desc,
+				strings.TrimSpace(output),
+				test.errors,
+			)
+		}
+	}
+}
+
+// slowDatabase answers like answerDatabase after a delay.
+type slowDatabase struct {
+	delay time.Duration
+}
+
+func (d slowDatabase) Query(qdata []byte) ([]byte, int, error) {
+	time.Sleep(d.delay)
+	return answerDatabase{}.Query(qdata)
+}
+
+var statusMapperTests = []struct {
+	desc     string
+	database dohdns.Database
+	url      string
+	mapper   dohdns.StatusMapper
+	status   int
+}{
+	{
+		desc:     "Default status for timeout",
+		database: dohdns.NewTimeout(slowDatabase{delay: 100 * time.Millisecond}, 10*time.Millisecond),
+		url:      "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		mapper:   nil,
+		status:   http.StatusGatewayTimeout,
+	},
+	{
+		desc:     "Mapped status for timeout",
+		database: dohdns.NewTimeout(slowDatabase{delay: 100 * time.Millisecond}, 10*time.Millisecond),
+		url:      "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		mapper: func(status int, err error, rcode int) int {
+			if status == http.StatusGatewayTimeout {
+				return http.StatusBadGateway
+			}
+			return status
+		},
+		status: http.StatusBadGateway,
+	},
+	{
+		desc:     "Mapped status for request error",
+		database: answerDatabase{},
+		url:      "https://example.com",
+		mapper: func(status int, err error, rcode int) int {
+			if rcode != -1 {
+				return http.StatusInternalServerError
+			}
+			return http.StatusUnprocessableEntity
+		},
+		status: http.StatusUnprocessableEntity,
+	},
+	{
+		desc:     "Mapper not used for successful requests",
+		database: answerDatabase{},
+		url:      "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		mapper: func(status int, err error, rcode int) int {
+			return http.StatusTeapot
+		},
+		status: http.StatusOK,
+	},
+}
+
+func TestStatusMapper(t *testing.T) {
+	for _, test := range statusMapperTests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(test.database, nil, dohdns.WithStatusMapper(test.mapper))
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+	}
+}
+
+// nxdomainDatabase answers every query with NXDOMAIN.
+type nxdomainDatabase struct{}
+
+func (nxdomainDatabase) Query(qdata []byte) ([]byte, int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(qdata); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	rdata, err := dohdns.NewReply(m, dns.RcodeNameError).Pack()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return rdata, http.StatusOK, nil
+}
+
+var responseStatusMapperTests = []struct {
+	desc     string
+	database dohdns.Database
+	opts     []dohdns.Option
+	status   int
+	body     bool
+}{
+	{
+		desc:     "NXDOMAIN by default",
+		database: nxdomainDatabase{},
+		opts:     nil,
+		status:   http.StatusOK,
+		body:     true,
+	},
+	{
+		desc:     "NXDOMAIN mapped",
+		database: nxdomainDatabase{},
+		opts:     []dohdns.Option{dohdns.WithResponseStatusMapper(dohdns.NXDomainStatus(http.StatusNotFound))},
+		status:   http.StatusNotFound,
+		body:     true,
+	},
+	{
+		desc:     "NXDOMAIN mapped to status without body",
+		database: nxdomainDatabase{},
+		opts:     []dohdns.Option{dohdns.WithResponseStatusMapper(dohdns.NXDomainStatus(http.StatusNoContent))},
+		status:   http.StatusNoContent,
+		body:     false,
+	},
+	{
+		desc:     "NOERROR not mapped",
+		database: answerDatabase{},
+		opts:     []dohdns.Option{dohdns.WithResponseStatusMapper(dohdns.NXDomainStatus(http.StatusNotFound))},
+		status:   http.StatusOK,
+		body:     true,
+	},
+}
+
+func TestResponseStatusMapper(t *testing.T) {
+	for _, test := range responseStatusMapperTests {
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(test.database, nil, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if (len(respBody) > 0) != test.body {
+			t.Errorf(
+				"%s: unexpected body (got %d bytes, want body %t)",
+				test.desc,
+				len(respBody),
+				test.body,
+			)
+		}
+	}
+}
+
+// BenchmarkHandleRequestGET measures the overhead of the GET handler using
+// EchoBackend, so no DNS parsing or network is involved in the backend.
+func BenchmarkHandleRequestGET(b *testing.B) {
+	handler := dohdns.HandleRequest(dohdns.EchoBackend{}, nil)
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// BenchmarkHandleRequestPOST measures the overhead of the POST handler
+// using EchoBackend.
+func BenchmarkHandleRequestPOST(b *testing.B) {
+	handler := dohdns.HandleRequest(dohdns.EchoBackend{}, nil)
+	qdata, _ := base64.RawURLEncoding.DecodeString("AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB")
+	body := bytes.NewReader(qdata)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		body.Reset(qdata)
+		req := httptest.NewRequest("POST", "https://example.com", body)
+		req.Header.Set("Content-Type", "application/dns-udpwireformat")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+var cacheControlTests = []struct {
+	desc         string
+	opts         []dohdns.Option
+	ttl          uint32
+	cacheControl string
+}{
+	{
+		desc:         "No Cache-Control by default",
+		opts:         nil,
+		ttl:          60,
+		cacheControl: "",
+	},
+	{
+		desc:         "Cache-Control from record TTL",
+		opts:         []dohdns.Option{dohdns.WithCacheControl()},
+		ttl:          60,
+		cacheControl: "max-age=60",
+	},
+	{
+		desc:         "Cache-Control after clamping",
+		opts:         []dohdns.Option{dohdns.WithCacheControl(), dohdns.WithMaxTTL(30)},
+		ttl:          30,
+		cacheControl: "max-age=30",
+	},
+	{
+		desc:         "MaxTTL above record TTL",
+		opts:         []dohdns.Option{dohdns.WithCacheControl(), dohdns.WithMaxTTL(120)},
+		ttl:          60,
+		cacheControl: "max-age=60",
+	},
+	{
+		desc:         "Clamping without Cache-Control",
+		opts:         []dohdns.Option{dohdns.WithMaxTTL(30)},
+		ttl:          30,
+		cacheControl: "",
+	},
+}
+
+func TestCacheControl(t *testing.T) {
+	for _, test := range cacheControlTests {
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.Header.Get("Cache-Control") != test.cacheControl {
+			t.Errorf(
+				"%s: unexpected Cache-Control header (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Cache-Control"),
+				test.cacheControl,
+			)
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		r := new(dns.Msg)
+		if err := r.Unpack(respBody); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if len(r.Answer) != 1 || r.Answer[0].Header().Ttl != test.ttl {
+			t.Errorf(
+				"%s: unexpected answer TTL (got %v, want %d)",
+				test.desc,
+				r.Answer,
+				test.ttl,
+			)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	handler := dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithETag())
+
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf(
+			"TestETag: unexpected status code (got %d, want %d)",
+			resp.StatusCode,
+			http.StatusOK,
+		)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("TestETag: missing ETag header")
+	}
+
+	steps := []struct {
+		desc        string
+		ifNoneMatch string
+		status      int
+		body        bool
+	}{
+		{desc: "Matching If-None-Match", ifNoneMatch: etag, status: http.StatusNotModified, body: false},
+		{desc: "Matching weak If-None-Match in list", ifNoneMatch: `"other", W/` + etag, status: http.StatusNotModified, body: false},
+		{desc: "Non-matching If-None-Match", ifNoneMatch: `"other"`, status: http.StatusOK, body: true},
+	}
+
+	for _, step := range steps {
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+		req.Header.Set("If-None-Match", step.ifNoneMatch)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+
+		if resp.StatusCode != step.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				step.desc,
+				resp.StatusCode,
+				step.status,
+			)
+		}
+
+		if (len(respBody) > 0) != step.body {
+			t.Errorf(
+				"%s: unexpected body length (got %d)",
+				step.desc,
+				len(respBody),
+			)
+		}
+
+		if resp.Header.Get("ETag") != etag {
+			t.Errorf(
+				"%s: unexpected ETag header (got %s, want %s)",
+				step.desc,
+				resp.Header.Get("ETag"),
+				etag,
+			)
+		}
+	}
+}
+
+var upstreamLogTests = []struct {
+	desc   string
+	opts   []dohdns.Option
+	header string
+}{
+	{
+		desc:   "Upstream logged",
+		opts:   nil,
+		header: "",
+	},
+	{
+		desc:   "Upstream logged and in header",
+		opts:   []dohdns.Option{dohdns.WithUpstreamServerHeader()},
+		header: "192.0.2.2",
+	},
+}
+
+func TestLogUpstream(t *testing.T) {
+	for _, test := range upstreamLogTests {
+		// The first server fails, so the query is answered by the second.
+		exchanger := newAddressExchanger("192.0.2.1:53")
+		database, err := dohdns.NewProxy([]string{"192.0.2.1", "192.0.2.2"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+
+		var buf bytes.Buffer
+		logger := log.New(&buf, "", 0)
+
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(database, logger, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		if !strings.Contains(buf.String(), "upstream 192.0.2.2") {
+			t.Errorf(
+				"%s: log line does not contain the upstream server (got \"%s\")",
+				test.desc,
+				strings.TrimSpace(buf.String()),
+			)
+		}
+
+		if w.Result().Header.Get("X-Upstream-Server") != test.header {
+			t.Errorf(
+				"%s: unexpected X-Upstream-Server header (got \"%s\", want \"%s\")",
+				test.desc,
+				w.Result().Header.Get("X-Upstream-Server"),
+				test.header,
+			)
+		}
+	}
+}
+
+var disabledMethodsTests = []struct {
+	desc   string
+	method string
+	opts   []dohdns.Option
+	status int
+	allow  string
+}{
+	{
+		desc:   "GET disabled",
+		method: "GET",
+		opts:   []dohdns.Option{dohdns.WithDisabledMethods(http.MethodGet)},
+		status: http.StatusMethodNotAllowed,
+		allow:  "POST, OPTIONS",
+	},
+	{
+		desc:   "POST with GET disabled",
+		method: "POST",
+		opts:   []dohdns.Option{dohdns.WithDisabledMethods(http.MethodGet)},
+		status: http.StatusOK,
+		allow:  "",
+	},
+	{
+		desc:   "GET enabled",
+		method: "GET",
+		opts:   nil,
+		status: http.StatusOK,
+		allow:  "",
+	},
+	{
+		desc:   "Unsupported PUT method",
+		method: "PUT",
+		opts:   nil,
+		status: http.StatusMethodNotAllowed,
+		allow:  "GET, POST, OPTIONS",
+	},
+}
+
+func TestDisabledMethods(t *testing.T) {
+	qdata := []byte{0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x77, 0x77, 0x77, 0x7, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x3, 0x63, 0x6f, 0x6d, 0x0, 0x0, 0x1, 0x0, 0x1}
+
+	for _, test := range disabledMethodsTests {
+		var req *http.Request
+		switch test.method {
+		case "POST":
+			req = httptest.NewRequest(test.method, "https://example.com", bytes.NewReader(qdata))
+			req.Header.Set("Content-Type", "application/dns-udpwireformat")
+		default:
+			req = httptest.NewRequest(test.method, "https://example.com?dns="+base64.RawURLEncoding.EncodeToString(qdata), nil)
+		}
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if resp.Header.Get("Allow") != test.allow {
+			t.Errorf(
+				"%s: unexpected Allow header (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Allow"),
+				test.allow,
+			)
+		}
+	}
+}
+
+var capabilitiesTests = []struct {
+	desc       string
+	opts       []dohdns.Option
+	status     int
+	allow      string
+	acceptPost string
+}{
+	{
+		desc:       "Default capabilities",
+		opts:       nil,
+		status:     http.StatusNoContent,
+		allow:      "GET, POST, OPTIONS",
+		acceptPost: "application/dns-udpwireformat",
+	},
+	{
+		desc:       "Additional content type",
+		opts:       []dohdns.Option{dohdns.WithContentTypes("application/dns-message")},
+		status:     http.StatusNoContent,
+		allow:      "GET, POST, OPTIONS",
+		acceptPost: "application/dns-udpwireformat, application/dns-message",
+	},
+	{
+		desc:       "POST disabled",
+		opts:       []dohdns.Option{dohdns.WithDisabledMethods(http.MethodPost)},
+		status:     http.StatusNoContent,
+		allow:      "GET, OPTIONS",
+		acceptPost: "",
+	},
+	{
+		desc:       "OPTIONS disabled",
+		opts:       []dohdns.Option{dohdns.WithDisabledMethods(http.MethodOptions)},
+		status:     http.StatusMethodNotAllowed,
+		allow:      "GET, POST",
+		acceptPost: "",
+	},
+}
+
+func TestCapabilities(t *testing.T) {
+	for _, test := range capabilitiesTests {
+		req := httptest.NewRequest("OPTIONS", "https://example.com", nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if resp.Header.Get("Allow") != test.allow {
+			t.Errorf(
+				"%s: unexpected Allow header (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Allow"),
+				test.allow,
+			)
+		}
+
+		if resp.Header.Get("Accept-Post") != test.acceptPost {
+			t.Errorf(
+				"%s: unexpected Accept-Post header (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Accept-Post"),
+				test.acceptPost,
+			)
+		}
+	}
+}
+
+var headersTests = []struct {
+	desc   string
+	url    string
+	status int
+}{
+	{
+		desc:   "Successful request",
+		url:    "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		status: http.StatusOK,
+	},
+	{
+		desc:   "Failed request",
+		url:    "https://example.com",
+		status: http.StatusBadRequest,
+	},
+}
+
+func TestHeaders(t *testing.T) {
+	headers := map[string]string{
+		"Strict-Transport-Security": "max-age=63072000",
+		"X-Content-Type-Options":    "nosniff",
+	}
+
+	for _, test := range headersTests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithHeaders(headers))
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		for name, value := range headers {
+			if resp.Header.Get(name) != value {
+				t.Errorf(
+					"%s: unexpected %s header (got \"%s\", want \"%s\")",
+					test.desc,
+					name,
+					resp.Header.Get(name),
+					value,
+				)
+			}
+		}
+	}
+}
+
+var multipartFormTests = []struct {
+	desc   string
+	field  string
+	opts   []dohdns.Option
+	status int
+}{
+	{
+		desc:   "Query in 'dns' field",
+		field:  "dns",
+		opts:   []dohdns.Option{dohdns.WithMultipartForm()},
+		status: http.StatusOK,
+	},
+	{
+		desc:   "Query in other field",
+		field:  "query",
+		opts:   []dohdns.Option{dohdns.WithMultipartForm()},
+		status: http.StatusBadRequest,
+	},
+	{
+		desc:   "Multipart form not enabled",
+		field:  "dns",
+		opts:   nil,
+		status: http.StatusUnsupportedMediaType,
+	},
+}
+
+func TestMultipartForm(t *testing.T) {
+	qdata := []byte{0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x77, 0x77, 0x77, 0x7, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x3, 0x63, 0x6f, 0x6d, 0x0, 0x0, 0x1, 0x0, 0x1}
+
+	for _, test := range multipartFormTests {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile(test.field, "query.bin")
+		if err != nil {
+			t.Fatalf("%s: unable to create form field: %s", test.desc, err)
+		}
+		fw.Write(qdata)
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "https://example.com", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(answerDatabase{}, nil, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			respBody, _ := ioutil.ReadAll(resp.Body)
+			m := new(dns.Msg)
+			if err := m.Unpack(respBody); err != nil {
+				t.Errorf("%s: unable to parse DNS data in response: %s", test.desc, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package dohdns
+
+import (
+	"errors"
+	"net/http"
+)
+
+// EchoBackend answers every query by returning it with the QR bit set,
+// without parsing it or using the network. It is meant for benchmarks and
+// tests measuring the overhead of the handlers and wrapping backends.
+type EchoBackend struct{}
+
+// Query returns a copy of qdata marked as a response.
+func (EchoBackend) Query(qdata []byte) ([]byte, int, error) {
+	// The flags are in the third byte of the 12 byte header.
+	if len(qdata) < 12 {
+		return nil, http.StatusBadRequest, classify(ErrInvalidMessage, errors.New("EchoBackend: message shorter than DNS header"))
+	}
+
+	rdata := make([]byte, len(qdata))
+	copy(rdata, qdata)
+	rdata[2] |= 0x80
+
+	return rdata, http.StatusOK, nil
+}
@@ -0,0 +1,41 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http"
+	"testing"
+)
+
+func TestEcho(t *testing.T) {
+	qdata := packQuery(t, "www.example.com.", dns.TypeA)
+
+	rdata, status, err := dohdns.EchoBackend{}.Query(qdata)
+	if err != nil {
+		t.Fatalf("TestEcho: unexpected error: %s", err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf(
+			"TestEcho: unexpected status code (got %d, want %d)",
+			status,
+			http.StatusOK,
+		)
+	}
+
+	m := new(dns.Msg)
+	m.Unpack(qdata)
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestEcho: unable to parse response: %s", err)
+	}
+
+	if !r.Response || r.Id != m.Id || r.Question[0] != m.Question[0] {
+		t.Errorf("TestEcho: unexpected response (got %s)", r)
+	}
+
+	if _, status, err := (dohdns.EchoBackend{}).Query([]byte{0, 1}); err == nil || status != http.StatusBadRequest {
+		t.Errorf("TestEcho: expected 400 for a truncated message (got %d)", status)
+	}
+}
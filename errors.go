@@ -0,0 +1,41 @@
+package dohdns
+
+import (
+	"errors"
+)
+
+// Errors classifying why a query failed. The errors returned by the
+// handlers and databases wrap them, keeping their own message, so loggers,
+// tracers and status mappers can tell the causes apart using errors.Is.
+var (
+	// ErrInvalidBase64 means the 'dns' parameter of a GET request is not
+	// valid base64url.
+	ErrInvalidBase64 = errors.New("invalid base64 encoding")
+
+	// ErrInvalidMessage means the query is not a valid DNS message in
+	// wire format.
+	ErrInvalidMessage = errors.New("invalid DNS message")
+
+	// ErrUpstreamFailed means no upstream server answered the query.
+	ErrUpstreamFailed = errors.New("upstream failed")
+)
+
+// classifiedError attaches one of the classifying errors to err without
+// changing its message.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+// classify returns err wrapped so it matches class in errors.Is.
+func classify(class error, err error) error {
+	return &classifiedError{class: class, err: err}
+}
@@ -0,0 +1,98 @@
+package dohdns_test
+
+import (
+	"context"
+	"errors"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http/httptest"
+	"testing"
+)
+
+var errorClasses = []error{
+	dohdns.ErrInvalidBase64,
+	dohdns.ErrInvalidMessage,
+	dohdns.ErrUpstreamFailed,
+}
+
+var classifiedErrorTests = []struct {
+	desc        string
+	url         string
+	exchangeErr error
+	want        error
+}{
+	{
+		desc: "Invalid base64",
+		url:  "https://example.com?dns=!!!",
+		want: dohdns.ErrInvalidBase64,
+	},
+	{
+		desc: "Invalid wire format",
+		url:  "https://example.com?dns=AAAA",
+		want: dohdns.ErrInvalidMessage,
+	},
+	{
+		desc:        "Upstream failure",
+		url:         "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		exchangeErr: errors.New("test error"),
+		want:        dohdns.ErrUpstreamFailed,
+	},
+}
+
+func TestClassifiedErrors(t *testing.T) {
+	for _, test := range classifiedErrorTests {
+		exchanger := dohdns.NewMockExchanger(answerLocalhost)
+		exchanger.Err = test.exchangeErr
+
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+
+		tracer := &fakeTracer{}
+		handler := dohdns.HandleRequest(database, nil, dohdns.WithTracer(tracer))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.url, nil))
+
+		if len(tracer.ended) != 1 {
+			t.Fatalf("%s: unexpected number of traced requests (got %d, want %d)", test.desc, len(tracer.ended), 1)
+		}
+
+		for _, class := range errorClasses {
+			if got := errors.Is(tracer.ended[0].Err, class); got != (class == test.want) {
+				t.Errorf(
+					"%s: unexpected classification of \"%v\" as \"%s\" (got %t, want %t)",
+					test.desc,
+					tracer.ended[0].Err,
+					class,
+					got,
+					class == test.want,
+				)
+			}
+		}
+	}
+}
+
+func TestClassifiedErrorsQueryResult(t *testing.T) {
+	exchanger := dohdns.NewMockExchanger(answerLocalhost)
+	exchanger.Err = errors.New("test error")
+
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestClassifiedErrorsQueryResult: unable to instantiate NewProxy: %s", err)
+	}
+
+	if _, err := database.QueryResult(context.Background(), []byte{0, 0, 0}); !errors.Is(err, dohdns.ErrInvalidMessage) {
+		t.Errorf("TestClassifiedErrorsQueryResult: unexpected error for invalid message: %v", err)
+	}
+
+	_, err = database.QueryResult(context.Background(), packQuery(t, "www.example.com.", dns.TypeA))
+	if !errors.Is(err, dohdns.ErrUpstreamFailed) || !errors.Is(err, exchanger.Err) {
+		t.Errorf("TestClassifiedErrorsQueryResult: unexpected error for upstream failure: %v", err)
+	}
+
+	// Query classifies errors the same way.
+	_, _, err = database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+	if !errors.Is(err, dohdns.ErrUpstreamFailed) || !errors.Is(err, exchanger.Err) {
+		t.Errorf("TestClassifiedErrorsQueryResult: unexpected error from Query: %v", err)
+	}
+}
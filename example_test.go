@@ -21,3 +21,20 @@ func ExampleHandleRequest() {
 
 	log.Fatal(http.ListenAndServeTLS(":443", certFile, keyFile, nil))
 }
+
+func ExampleServer() {
+	// Serve plain HTTP, for example when TLS is terminated by a proxy
+	// in front of the application.
+	database, err := dohdns.NewProxy(nil, "", "", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &dohdns.Server{
+		Addr:    "127.0.0.1:8080",
+		Handler: dohdns.HandleRequest(database, nil),
+		TLS:     false,
+	}
+
+	log.Fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,61 @@
+package dohdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// defaultFixtureTTL is the TTL of fixture records without a TTL.
+const defaultFixtureTTL uint32 = 60
+
+// FixtureBackend answers queries with canned responses loaded from a JSON
+// fixture, e.g. for testing DNS API clients. The answers follow the same
+// rules as StaticBackend.
+type FixtureBackend struct {
+	*StaticBackend
+}
+
+// FixtureRecord is a record in a fixture. TTL defaults to 60 seconds when
+// left out.
+type FixtureRecord struct {
+	Name  string  `json:"name"`
+	Type  string  `json:"type"`
+	Value string  `json:"value"`
+	TTL   *uint32 `json:"ttl,omitempty"`
+}
+
+// LoadFixture returns a new FixtureBackend answering from the JSON array
+// of records read from r, like:
+//
+//	[{"name": "www.example.com.", "type": "A", "value": "127.0.0.1", "ttl": 300}]
+func LoadFixture(r io.Reader) (*FixtureBackend, error) {
+	var fixture []FixtureRecord
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fixture); err != nil {
+		return nil, fmt.Errorf("LoadFixture: %s", err)
+	}
+
+	var records []string
+	for i, record := range fixture {
+		if record.Name == "" || record.Type == "" || record.Value == "" {
+			return nil, fmt.Errorf("LoadFixture: record %d: name, type and value are required", i)
+		}
+
+		ttl := defaultFixtureTTL
+		if record.TTL != nil {
+			ttl = *record.TTL
+		}
+
+		records = append(records, fmt.Sprintf("%s %d IN %s %s", record.Name, ttl, record.Type, record.Value))
+	}
+
+	sb, err := NewStatic(records)
+	if err != nil {
+		return nil, fmt.Errorf("LoadFixture: %s", err)
+	}
+
+	return &FixtureBackend{StaticBackend: sb}, nil
+}
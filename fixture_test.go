@@ -0,0 +1,123 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+const fixture = `[
+	{"name": "www.example.com.", "type": "A", "value": "127.0.0.1", "ttl": 300},
+	{"name": "www.example.com.", "type": "AAAA", "value": "::1"},
+	{"name": "example.com.", "type": "MX", "value": "10 mail.example.com."}
+]`
+
+var fixtureTests = []struct {
+	desc    string
+	qname   string
+	qtype   uint16
+	rcode   int
+	answers []string
+}{
+	{
+		desc:    "A record with TTL",
+		qname:   "www.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeSuccess,
+		answers: []string{"www.example.com.\t300\tIN\tA\t127.0.0.1"},
+	},
+	{
+		desc:    "AAAA record with default TTL",
+		qname:   "www.example.com.",
+		qtype:   dns.TypeAAAA,
+		rcode:   dns.RcodeSuccess,
+		answers: []string{"www.example.com.\t60\tIN\tAAAA\t::1"},
+	},
+	{
+		desc:    "MX record",
+		qname:   "example.com.",
+		qtype:   dns.TypeMX,
+		rcode:   dns.RcodeSuccess,
+		answers: []string{"example.com.\t60\tIN\tMX\t10 mail.example.com."},
+	},
+	{
+		desc:    "Unknown name",
+		qname:   "other.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeNameError,
+		answers: nil,
+	},
+}
+
+func TestFixture(t *testing.T) {
+	database, err := dohdns.LoadFixture(strings.NewReader(fixture))
+	if err != nil {
+		t.Fatalf("TestFixture: unable to load fixture: %s", err)
+	}
+
+	for _, test := range fixtureTests {
+		rdata, _, err := database.Query(packQuery(t, test.qname, test.qtype))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		var answers []string
+		for _, rr := range r.Answer {
+			answers = append(answers, rr.String())
+		}
+
+		if strings.Join(answers, "\n") != strings.Join(test.answers, "\n") {
+			t.Errorf(
+				"%s: unexpected answers (got %q, want %q)",
+				test.desc,
+				answers,
+				test.answers,
+			)
+		}
+	}
+}
+
+var invalidFixtureTests = []struct {
+	desc    string
+	fixture string
+}{
+	{
+		desc:    "Invalid JSON",
+		fixture: `[{"name": "www.example.com."`,
+	},
+	{
+		desc:    "Missing value",
+		fixture: `[{"name": "www.example.com.", "type": "A"}]`,
+	},
+	{
+		desc:    "Invalid value",
+		fixture: `[{"name": "www.example.com.", "type": "A", "value": "not-an-address"}]`,
+	},
+	{
+		desc:    "Unknown field",
+		fixture: `[{"name": "www.example.com.", "type": "A", "value": "127.0.0.1", "class": "IN"}]`,
+	},
+}
+
+func TestInvalidFixture(t *testing.T) {
+	for _, test := range invalidFixtureTests {
+		if _, err := dohdns.LoadFixture(strings.NewReader(test.fixture)); err == nil {
+			t.Errorf("%s: expected an error", test.desc)
+		}
+	}
+}
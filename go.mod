@@ -0,0 +1,19 @@
+module github.com/eest/dohdns
+
+go 1.24
+
+require (
+	github.com/miekg/dns v1.1.62
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/crypto v0.41.0
+	golang.org/x/sys v0.35.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
+)
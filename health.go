@@ -0,0 +1,259 @@
+package dohdns
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serverHealth tracks the consecutive failures of an upstream server.
+type serverHealth struct {
+	failures  int
+	downUntil time.Time
+}
+
+// unavailableError is returned by forward when all upstream servers are
+// considered down.
+type unavailableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+// forward sends m to servers in order until one of them answers, skipping
+// servers that are considered down. The server that answered is returned
+// along with the response. If all servers are down afterwards the error
+// is an *unavailableError.
+func (pb *ProxyBackend) forward(m *dns.Msg, servers []string) (*dns.Msg, string, error) {
+	err := errors.New("ProxyBackend: no upstream server available")
+
+	for _, server := range servers {
+		if !pb.available(server) {
+			continue
+		}
+
+		start := time.Now()
+
+		var r *dns.Msg
+		r, err = pb.exchangeServer(m, server)
+		if err != nil && pb.RetryNetworkErrors && transientError(err) {
+			r, err = pb.exchangeServer(m, server)
+		}
+		pb.record(server, err)
+
+		if elapsed := time.Since(start); pb.SlowQueryThreshold > 0 && elapsed > pb.SlowQueryThreshold && pb.Logger != nil {
+			pb.Logger.Printf("%s | slow query to %s took %s", m.Question[0].Name, server, elapsed)
+		}
+		if err == nil {
+			return r, server, nil
+		}
+	}
+
+	if retryAfter := pb.retryAfter(servers); retryAfter > 0 {
+		return nil, "", &unavailableError{err: err, retryAfter: retryAfter}
+	}
+
+	return nil, "", err
+}
+
+// transientError reports whether err is a network error likely to go away
+// when trying again, i.e. a temporary error or a refused connection.
+func transientError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Temporary()
+}
+
+// retryAfter returns how long it takes until the first of servers is
+// available again, or 0 if any server is available now.
+func (pb *ProxyBackend) retryAfter(servers []string) time.Duration {
+	if pb.FailureThreshold <= 0 || len(servers) == 0 {
+		return 0
+	}
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	now := time.Now()
+
+	var retryAfter time.Duration
+	for _, server := range servers {
+		h, ok := pb.health[server]
+		if !ok || !now.Before(h.downUntil) {
+			return 0
+		}
+
+		if d := h.downUntil.Sub(now); retryAfter == 0 || d < retryAfter {
+			retryAfter = d
+		}
+	}
+
+	return retryAfter
+}
+
+// address returns the address to send queries for server to. Servers may
+// include a port, e.g. "192.0.2.1:5353" or "[2001:db8::1]:5353", otherwise
+// Port is used.
+func (pb *ProxyBackend) address(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+
+	// An IPv6 address may be bracketed without a port.
+	server = strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+
+	return net.JoinHostPort(server, pb.Port)
+}
+
+// available reports whether server should be used for the next query.
+func (pb *ProxyBackend) available(server string) bool {
+	if pb.FailureThreshold <= 0 {
+		return true
+	}
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	h, ok := pb.health[server]
+	if !ok {
+		return true
+	}
+
+	// Once the cooldown has passed the server is tried again, a single
+	// further failure marks it as down again.
+	return !time.Now().Before(h.downUntil)
+}
+
+// record updates the health of server with the outcome of an exchange.
+func (pb *ProxyBackend) record(server string, err error) {
+	if pb.FailureThreshold <= 0 {
+		return
+	}
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if pb.health == nil {
+		pb.health = map[string]*serverHealth{}
+	}
+
+	h, ok := pb.health[server]
+	if !ok {
+		h = &serverHealth{}
+		pb.health[server] = h
+	}
+
+	if err == nil {
+		h.failures = 0
+		h.downUntil = time.Time{}
+		return
+	}
+
+	h.failures++
+	if h.failures >= pb.FailureThreshold {
+		h.downUntil = time.Now().Add(pb.Cooldown)
+	}
+}
+
+// StartProbes probes the servers once, then starts probing them every
+// ProbeInterval in the background until StopProbes is called. This detects
+// servers going down, and coming back, without waiting for client queries
+// to fail. Calling StartProbes while probes are running has no effect.
+func (pb *ProxyBackend) StartProbes() error {
+	if pb.ProbeInterval <= 0 {
+		return errors.New("ProxyBackend: ProbeInterval must be positive")
+	}
+
+	pb.mu.Lock()
+	if pb.probeStop != nil {
+		pb.mu.Unlock()
+		return nil
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	pb.probeStop = stop
+	pb.probeDone = done
+	pb.mu.Unlock()
+
+	pb.probe()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(pb.ProbeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pb.probe()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopProbes stops the probes started by StartProbes and waits for them to
+// finish.
+func (pb *ProxyBackend) StopProbes() {
+	pb.mu.Lock()
+	stop, done := pb.probeStop, pb.probeDone
+	pb.probeStop = nil
+	pb.probeDone = nil
+	pb.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// probe sends the probe query to all servers at once and records the
+// outcome. A SERVFAIL response counts as a failure.
+func (pb *ProxyBackend) probe() {
+	q := pb.ProbeQuery
+	if q.Name == "" {
+		q = dns.Question{Name: ".", Qtype: dns.TypeNS}
+	}
+	if q.Qclass == 0 {
+		q.Qclass = dns.ClassINET
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range pb.servers() {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+
+			m := new(dns.Msg)
+			m.Id = dns.Id()
+			m.RecursionDesired = true
+			m.Question = []dns.Question{q}
+
+			r, err := pb.exchangeServer(m, server)
+			if err == nil && r.Rcode == dns.RcodeServerFailure {
+				err = fmt.Errorf("ProxyBackend: probe of %s failed with SERVFAIL", server)
+			}
+			pb.record(server, err)
+		}(server)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,403 @@
+package dohdns_test
+
+import (
+	"errors"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// addressExchanger fails exchanges with the addresses in down and counts
+// the exchanges per address.
+type addressExchanger struct {
+	mu    sync.Mutex
+	down  map[string]bool
+	calls map[string]int
+}
+
+func newAddressExchanger(down ...string) *addressExchanger {
+	e := &addressExchanger{down: map[string]bool{}, calls: map[string]int{}}
+	for _, address := range down {
+		e.down[address] = true
+	}
+	return e
+}
+
+func (e *addressExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.calls[address]++
+	if e.down[address] {
+		return nil, 0, errors.New("test error")
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	return r, 0, nil
+}
+
+func (e *addressExchanger) count(address string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls[address]
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	exchanger := newAddressExchanger("192.0.2.1:53")
+	database, err := dohdns.NewProxy([]string{"192.0.2.1", "192.0.2.2"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestCircuitBreaker: unable to instantiate NewProxy: %s", err)
+	}
+	database.FailureThreshold = 2
+	database.Cooldown = 100 * time.Millisecond
+
+	steps := []struct {
+		desc  string
+		sleep time.Duration
+		dead  int
+		live  int
+	}{
+		{desc: "First failure fails over", dead: 1, live: 1},
+		{desc: "Second failure marks server down", dead: 2, live: 2},
+		{desc: "Down server is skipped", dead: 2, live: 3},
+		{desc: "Down server is retried after cooldown", sleep: 150 * time.Millisecond, dead: 3, live: 4},
+		{desc: "Failed retry marks server down again", dead: 3, live: 5},
+	}
+
+	for _, step := range steps {
+		time.Sleep(step.sleep)
+
+		if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+			t.Fatalf("%s: unexpected error: %s", step.desc, err)
+		}
+
+		if exchanger.count("192.0.2.1:53") != step.dead || exchanger.count("192.0.2.2:53") != step.live {
+			t.Errorf(
+				"%s: unexpected exchanges (got %d/%d, want %d/%d)",
+				step.desc,
+				exchanger.count("192.0.2.1:53"),
+				exchanger.count("192.0.2.2:53"),
+				step.dead,
+				step.live,
+			)
+		}
+	}
+}
+
+func TestAllServersFailing(t *testing.T) {
+	exchanger := newAddressExchanger("192.0.2.1:53", "192.0.2.2:53")
+	database, err := dohdns.NewProxy([]string{"192.0.2.1", "192.0.2.2"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestAllServersFailing: unable to instantiate NewProxy: %s", err)
+	}
+	database.FailureThreshold = 1
+	database.Cooldown = time.Minute
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err == nil {
+			t.Errorf("TestAllServersFailing: expected an error when all servers fail")
+		}
+	}
+
+	// The second query must not have touched any server.
+	if exchanger.count("192.0.2.1:53") != 1 || exchanger.count("192.0.2.2:53") != 1 {
+		t.Errorf(
+			"TestAllServersFailing: unexpected exchanges (got %d/%d, want 1/1)",
+			exchanger.count("192.0.2.1:53"),
+			exchanger.count("192.0.2.2:53"),
+		)
+	}
+}
+
+func TestAllServersDownRetryAfter(t *testing.T) {
+	exchanger := newAddressExchanger("192.0.2.1:53", "192.0.2.2:53")
+	database, err := dohdns.NewProxy([]string{"192.0.2.1", "192.0.2.2"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestAllServersDownRetryAfter: unable to instantiate NewProxy: %s", err)
+	}
+	database.FailureThreshold = 1
+	database.Cooldown = 30 * time.Second
+
+	handler := dohdns.HandleRequest(database, nil)
+
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf(
+			"TestAllServersDownRetryAfter: unexpected status code (got %d, want %d)",
+			resp.StatusCode,
+			http.StatusServiceUnavailable,
+		)
+	}
+
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 30 {
+		t.Errorf(
+			"TestAllServersDownRetryAfter: unexpected Retry-After header (got \"%s\", want 1-30)",
+			resp.Header.Get("Retry-After"),
+		)
+	}
+}
+
+func TestSomeServersDownNoRetryAfter(t *testing.T) {
+	exchanger := newAddressExchanger("192.0.2.1:53")
+	database, err := dohdns.NewProxy([]string{"192.0.2.1", "192.0.2.2"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestSomeServersDownNoRetryAfter: unable to instantiate NewProxy: %s", err)
+	}
+	database.FailureThreshold = 1
+	database.Cooldown = 30 * time.Second
+
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+	w := httptest.NewRecorder()
+	dohdns.HandleRequest(database, nil).ServeHTTP(w, req)
+
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Retry-After") != "" {
+		t.Errorf(
+			"TestSomeServersDownNoRetryAfter: unexpected response (got %d with Retry-After \"%s\", want %d without)",
+			resp.StatusCode,
+			resp.Header.Get("Retry-After"),
+			http.StatusOK,
+		)
+	}
+}
+
+func TestServerPorts(t *testing.T) {
+	servers := []string{"192.0.2.1:5353", "192.0.2.2", "[2001:db8::1]:5353", "2001:db8::2", "[2001:db8::3]"}
+	exchanger := newAddressExchanger("192.0.2.1:5353", "192.0.2.2:53", "[2001:db8::1]:5353", "[2001:db8::2]:53")
+
+	database, err := dohdns.NewProxy(servers, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestServerPorts: unable to instantiate NewProxy: %s", err)
+	}
+
+	if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestServerPorts: unexpected error: %s", err)
+	}
+
+	for _, address := range []string{"192.0.2.1:5353", "192.0.2.2:53", "[2001:db8::1]:5353", "[2001:db8::2]:53", "[2001:db8::3]:53"} {
+		if exchanger.count(address) != 1 {
+			t.Errorf(
+				"TestServerPorts: unexpected exchanges with %s (got %d, want %d)",
+				address,
+				exchanger.count(address),
+				1,
+			)
+		}
+	}
+}
+
+func TestSetServers(t *testing.T) {
+	exchanger := newAddressExchanger()
+	database, err := dohdns.NewProxy([]string{"192.0.2.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestSetServers: unable to instantiate NewProxy: %s", err)
+	}
+	database.FailureThreshold = 1
+
+	qdata := packQuery(t, "www.example.com.", dns.TypeA)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, _, err := database.Query(qdata); err != nil {
+					t.Errorf("TestSetServers: unexpected error: %s", err)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			database.SetServers([]string{"192.0.2.2"})
+		} else {
+			database.SetServers([]string{"192.0.2.1", "192.0.2.2"})
+		}
+	}
+	wg.Wait()
+
+	database.SetServers([]string{"192.0.2.3"})
+	if _, _, err := database.Query(qdata); err != nil {
+		t.Fatalf("TestSetServers: unexpected error: %s", err)
+	}
+
+	if exchanger.count("192.0.2.3:53") != 1 {
+		t.Errorf(
+			"TestSetServers: unexpected exchanges with new server (got %d, want %d)",
+			exchanger.count("192.0.2.3:53"),
+			1,
+		)
+	}
+}
+
+// flakyExchanger fails the first exchange with err and answers the
+// following ones.
+type flakyExchanger struct {
+	err   error
+	calls int
+}
+
+func (e *flakyExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.calls++
+	if e.calls == 1 {
+		return nil, 0, e.err
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	return r, 0, nil
+}
+
+// temporaryError is a net.Error reporting itself as temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary test error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+var retryNetworkErrorsTests = []struct {
+	desc               string
+	err                error
+	retryNetworkErrors bool
+	status             int
+	calls              int
+}{
+	{
+		desc:               "Temporary error retried",
+		err:                temporaryError{},
+		retryNetworkErrors: true,
+		status:             http.StatusOK,
+		calls:              2,
+	},
+	{
+		desc:               "Connection refused retried",
+		err:                &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("read", syscall.ECONNREFUSED)},
+		retryNetworkErrors: true,
+		status:             http.StatusOK,
+		calls:              2,
+	},
+	{
+		desc:               "Other error not retried",
+		err:                errors.New("test error"),
+		retryNetworkErrors: true,
+		status:             http.StatusInternalServerError,
+		calls:              1,
+	},
+	{
+		desc:               "Retry disabled",
+		err:                temporaryError{},
+		retryNetworkErrors: false,
+		status:             http.StatusInternalServerError,
+		calls:              1,
+	},
+}
+
+func TestRetryNetworkErrors(t *testing.T) {
+	for _, test := range retryNetworkErrorsTests {
+		exchanger := &flakyExchanger{err: test.err}
+		database, err := dohdns.NewProxy([]string{"192.0.2.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.RetryNetworkErrors = test.retryNetworkErrors
+
+		_, status, _ := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+
+		if status != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				test.status,
+			)
+		}
+
+		if exchanger.calls != test.calls {
+			t.Errorf(
+				"%s: unexpected number of exchanges (got %d, want %d)",
+				test.desc,
+				exchanger.calls,
+				test.calls,
+			)
+		}
+	}
+}
+
+func TestProbes(t *testing.T) {
+	exchanger := newAddressExchanger("192.0.2.1:53")
+	database, err := dohdns.NewProxy([]string{"192.0.2.1", "192.0.2.2"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestProbes: unable to instantiate NewProxy: %s", err)
+	}
+	database.FailureThreshold = 1
+	database.Cooldown = time.Minute
+	database.ProbeQuery = dns.Question{Name: "example.com.", Qtype: dns.TypeSOA}
+	database.ProbeInterval = time.Hour
+
+	if err := database.StartProbes(); err != nil {
+		t.Fatalf("TestProbes: unable to start probes: %s", err)
+	}
+	defer database.StopProbes()
+
+	// The probe has marked the first server down, so the query goes
+	// straight to the second one.
+	if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestProbes: unexpected error: %s", err)
+	}
+
+	if exchanger.count("192.0.2.1:53") != 1 || exchanger.count("192.0.2.2:53") != 2 {
+		t.Errorf(
+			"TestProbes: unexpected exchanges (got %d/%d, want 1/2)",
+			exchanger.count("192.0.2.1:53"),
+			exchanger.count("192.0.2.2:53"),
+		)
+	}
+}
+
+func TestProbesInterval(t *testing.T) {
+	exchanger := newAddressExchanger()
+	database, err := dohdns.NewProxy([]string{"192.0.2.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestProbesInterval: unable to instantiate NewProxy: %s", err)
+	}
+
+	if err := database.StartProbes(); err == nil {
+		t.Fatalf("TestProbesInterval: expected an error without ProbeInterval")
+	}
+
+	database.ProbeInterval = 20 * time.Millisecond
+	if err := database.StartProbes(); err != nil {
+		t.Fatalf("TestProbesInterval: unable to start probes: %s", err)
+	}
+	time.Sleep(110 * time.Millisecond)
+	database.StopProbes()
+
+	probes := exchanger.count("192.0.2.1:53")
+	if probes < 3 {
+		t.Errorf("TestProbesInterval: unexpected number of probes (got %d, want at least %d)", probes, 3)
+	}
+
+	// No probes are sent once stopped.
+	time.Sleep(50 * time.Millisecond)
+	if exchanger.count("192.0.2.1:53") != probes {
+		t.Errorf("TestProbesInterval: probes sent after StopProbes")
+	}
+}
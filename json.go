@@ -0,0 +1,196 @@
+package dohdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// jsonMimeType is the media type of responses from the JSON handler.
+const jsonMimeType string = "application/json"
+
+// jsonpMimeType is the alternative media type of JSON responses some
+// clients ask for with the 'ct' parameter.
+const jsonpMimeType string = "application/x-javascript"
+
+// JSONRequest handles GET requests for the JSON API, which takes the
+// question as 'name' and 'type' parameters and returns the response as
+// a JSON object, like the JSON APIs of public DNS providers.
+type JSONRequest struct {
+	Request
+}
+
+// jsonQuestion is a question in a JSON response.
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// jsonRR is a resource record in a JSON response.
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonResponse is the JSON representation of a DNS response.
+type jsonResponse struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRR       `json:"Answer,omitempty"`
+	Authority []jsonRR       `json:"Authority,omitempty"`
+}
+
+// HandleJSON returns a handler for the JSON API, e.g.
+// /resolve?name=www.example.com&type=AAAA. The options are the same as
+// for HandleRequest.
+func HandleJSON(database Database, log *log.Logger, opts ...Option) http.HandlerFunc {
+	return newHandler(database, log, opts, func(req Request) (*Result, error) {
+		if req.R.Method != http.MethodGet {
+			return nil, req.error(http.StatusMethodNotAllowed, fmt.Errorf("HandleJSON: only %s method is supported", http.MethodGet))
+		}
+
+		jr := &JSONRequest{Request: req}
+		err := jr.Handle()
+		return jr.result, err
+	})
+}
+
+// NewMux returns a handler serving the wire format API at /dns-query and
+// the JSON API at /resolve, both answered from database.
+func NewMux(database Database, opts ...Option) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", HandleRequest(database, nil, opts...))
+	mux.Handle("/resolve", HandleJSON(database, nil, opts...))
+
+	return mux
+}
+
+// Handle builds a query from the request parameters, hands it off to the
+// backend and writes the response as JSON.
+func (req *JSONRequest) Handle() error {
+	params := req.R.URL.Query()
+
+	name := params.Get("name")
+	if name == "" {
+		return req.error(http.StatusBadRequest, fmt.Errorf("JSON: no 'name' parameter in request"))
+	}
+
+	// The 'ct' parameter selects the response format, like in the JSON
+	// APIs of public DNS providers.
+	ct := params.Get("ct")
+	switch ct {
+	case "":
+		ct = jsonMimeType
+	case jsonMimeType, jsonpMimeType, dohMediaType, mimeType:
+	default:
+		return req.error(http.StatusBadRequest, fmt.Errorf("JSON: unsupported 'ct' parameter %s", ct))
+	}
+
+	qtype := dns.TypeA
+	if t := params.Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = parseType(t); !ok {
+			return req.error(http.StatusBadRequest, fmt.Errorf("JSON: invalid 'type' parameter %s", t))
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.CheckingDisabled = parseFlag(params.Get("cd"))
+	if parseFlag(params.Get("do")) {
+		m.SetEdns0(4096, true)
+	}
+
+	qdata, err := m.Pack()
+	if err != nil {
+		return req.error(http.StatusBadRequest, fmt.Errorf("JSON: invalid 'name' parameter: %s", err))
+	}
+
+	rdata, httpStatus, err := req.query(qdata)
+	if err != nil {
+		return req.error(httpStatus, err)
+	}
+
+	if ct == dohMediaType || ct == mimeType {
+		req.W.Header().Set("Content-Type", ct)
+		req.respond(rdata)
+		return nil
+	}
+
+	if req.Opts.MaxTTL > 0 || req.Opts.CacheControl {
+		rdata = req.adjustTTL(rdata)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		return req.error(http.StatusBadGateway, fmt.Errorf("JSON: unable to parse response: %s", err))
+	}
+
+	req.W.Header().Set("Content-Type", ct)
+	return json.NewEncoder(req.W).Encode(newJSONResponse(r))
+}
+
+// newJSONResponse converts r to its JSON representation.
+func newJSONResponse(r *dns.Msg) *jsonResponse {
+	resp := &jsonResponse{
+		Status: r.Rcode,
+		TC:     r.Truncated,
+		RD:     r.RecursionDesired,
+		RA:     r.RecursionAvailable,
+		AD:     r.AuthenticatedData,
+		CD:     r.CheckingDisabled,
+	}
+
+	for _, q := range r.Question {
+		resp.Question = append(resp.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+
+	resp.Answer = jsonRRs(r.Answer)
+	resp.Authority = jsonRRs(r.Ns)
+
+	return resp
+}
+
+// jsonRRs converts rrs to their JSON representation.
+func jsonRRs(rrs []dns.RR) []jsonRR {
+	var out []jsonRR
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		out = append(out, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+
+	return out
+}
+
+// parseType parses a query type given by number or mnemonic, e.g. "28" or
+// "AAAA".
+func parseType(s string) (uint16, bool) {
+	if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return uint16(n), true
+	}
+
+	qtype, ok := dns.StringToType[strings.ToUpper(s)]
+	return qtype, ok
+}
+
+// parseFlag reports whether a flag parameter like 'cd' is set.
+func parseFlag(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
@@ -0,0 +1,263 @@
+package dohdns_test
+
+import (
+	"encoding/json"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+var jsonTests = []struct {
+	desc   string
+	url    string
+	status int
+	qtype  uint16
+	data   string
+}{
+	{
+		desc:   "A query",
+		url:    "https://example.com/resolve?name=www.example.com",
+		status: http.StatusOK,
+		qtype:  dns.TypeA,
+		data:   "127.0.0.1",
+	},
+	{
+		desc:   "Type by number",
+		url:    "https://example.com/resolve?name=www.example.com.&type=1",
+		status: http.StatusOK,
+		qtype:  dns.TypeA,
+		data:   "127.0.0.1",
+	},
+	{
+		desc:   "Missing name",
+		url:    "https://example.com/resolve",
+		status: http.StatusBadRequest,
+	},
+	{
+		desc:   "Invalid type",
+		url:    "https://example.com/resolve?name=www.example.com&type=INVALID",
+		status: http.StatusBadRequest,
+	},
+}
+
+func TestJSON(t *testing.T) {
+	for _, test := range jsonTests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleJSON(answerDatabase{}, nil)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var body struct {
+			Status   int
+			Question []struct {
+				Name string `json:"name"`
+				Type uint16 `json:"type"`
+			}
+			Answer []struct {
+				Name string `json:"name"`
+				Type uint16 `json:"type"`
+				TTL  uint32 `json:"TTL"`
+				Data string `json:"data"`
+			}
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: unable to parse JSON response: %s", test.desc, err)
+		}
+
+		if body.Status != dns.RcodeSuccess || len(body.Question) != 1 || body.Question[0].Type != test.qtype {
+			t.Errorf("%s: unexpected response (got %+v)", test.desc, body)
+		}
+
+		if len(body.Answer) != 1 || body.Answer[0].Data != test.data || body.Answer[0].TTL != 60 {
+			t.Errorf(
+				"%s: unexpected answer (got %+v, want data \"%s\")",
+				test.desc,
+				body.Answer,
+				test.data,
+			)
+		}
+	}
+}
+
+var muxTests = []struct {
+	desc        string
+	url         string
+	contentType string
+}{
+	{
+		desc:        "Wire format API",
+		url:         "https://example.com/dns-query?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		contentType: "application/dns-udpwireformat",
+	},
+	{
+		desc:        "JSON API",
+		url:         "https://example.com/resolve?name=www.example.com&type=A",
+		contentType: "application/json",
+	},
+}
+
+func TestMux(t *testing.T) {
+	mux := dohdns.NewMux(answerDatabase{})
+
+	for _, test := range muxTests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				http.StatusOK,
+			)
+		}
+
+		if resp.Header.Get("Content-Type") != test.contentType {
+			t.Errorf(
+				"%s: unexpected Content-Type (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Content-Type"),
+				test.contentType,
+			)
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		switch test.contentType {
+		case "application/json":
+			if !json.Valid(respBody) {
+				t.Errorf("%s: response is not valid JSON", test.desc)
+			}
+		default:
+			m := new(dns.Msg)
+			if err := m.Unpack(respBody); err != nil {
+				t.Errorf("%s: unable to parse DNS data in response: %s", test.desc, err)
+			}
+		}
+	}
+}
+
+var jsonContentTypeTests = []struct {
+	desc            string
+	ct              string
+	status          int
+	respContentType string
+	wire            bool
+}{
+	{
+		desc:            "No 'ct' parameter",
+		ct:              "",
+		status:          http.StatusOK,
+		respContentType: "application/json",
+	},
+	{
+		desc:            "JSON",
+		ct:              "application/json",
+		status:          http.StatusOK,
+		respContentType: "application/json",
+	},
+	{
+		desc:            "JSON as JavaScript",
+		ct:              "application/x-javascript",
+		status:          http.StatusOK,
+		respContentType: "application/x-javascript",
+	},
+	{
+		desc:            "Wire format",
+		ct:              "application/dns-message",
+		status:          http.StatusOK,
+		respContentType: "application/dns-message",
+		wire:            true,
+	},
+	{
+		desc:            "Legacy wire format",
+		ct:              "application/dns-udpwireformat",
+		status:          http.StatusOK,
+		respContentType: "application/dns-udpwireformat",
+		wire:            true,
+	},
+	{
+		desc:            "Unsupported type",
+		ct:              "text/html",
+		status:          http.StatusBadRequest,
+		respContentType: "text/plain; charset=utf-8",
+	},
+}
+
+func TestJSONContentType(t *testing.T) {
+	for _, test := range jsonContentTypeTests {
+		params := url.Values{"name": {"www.example.com"}}
+		if test.ct != "" {
+			params.Set("ct", test.ct)
+		}
+
+		req := httptest.NewRequest("GET", "https://example.com/resolve?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleJSON(answerDatabase{}, nil)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if resp.Header.Get("Content-Type") != test.respContentType {
+			t.Errorf(
+				"%s: unexpected Content-Type (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Content-Type"),
+				test.respContentType,
+			)
+		}
+
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		if test.wire {
+			m := new(dns.Msg)
+			if err := m.Unpack(respBody); err != nil || len(m.Answer) != 1 {
+				t.Errorf("%s: unexpected wire format response (error %v)", test.desc, err)
+			}
+			continue
+		}
+
+		var body struct {
+			Status int
+		}
+		if err := json.Unmarshal(respBody, &body); err != nil {
+			t.Errorf("%s: unable to parse JSON response: %s", test.desc, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package dohdns
+
+import (
+	"github.com/miekg/dns"
+	"net/http"
+)
+
+// StructuredLogger is the interface used for structured logging of
+// requests. It is implemented by *slog.Logger, the arguments are
+// alternating keys and values.
+type StructuredLogger interface {
+	Info(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// WithStructuredLogger logs requests to logger, with the client address,
+// method, request ID, question and upstream server as attributes. The
+// LogFilter applies like for the *log.Logger passed to the handler.
+func WithStructuredLogger(logger StructuredLogger) Option {
+	return func(o *Options) {
+		o.StructuredLogger = logger
+	}
+}
+
+// logStructured logs the request r to the StructuredLogger.
+func (o Options) logStructured(r *http.Request, result *Result, err error) {
+	args := []any{"remote", r.RemoteAddr, "method", r.Method}
+
+	if id := RequestID(r.Context()); id != "" {
+		args = append(args, "request_id", id)
+	}
+	if result != nil && result.Question != nil {
+		args = append(args, "qname", result.Question.Name, "qtype", dns.TypeToString[result.Question.Qtype])
+	}
+	if result != nil && result.Upstream != "" {
+		args = append(args, "upstream", result.Upstream)
+	}
+
+	if err != nil {
+		if o.LogFilter != LogSuccesses {
+			o.StructuredLogger.Error("failed request", append(args, "error", err.Error())...)
+		}
+		return
+	}
+
+	if o.LogFilter != LogErrors {
+		o.StructuredLogger.Info("successful request", args...)
+	}
+}
@@ -0,0 +1,74 @@
+package dohdns_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/eest/dohdns"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+)
+
+var structuredLoggerTests = []struct {
+	desc  string
+	url   string
+	attrs map[string]string
+}{
+	{
+		desc: "Successful request",
+		url:  "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		attrs: map[string]string{
+			"level":    "INFO",
+			"msg":      "successful request",
+			"method":   "GET",
+			"qname":    "www.example.com.",
+			"qtype":    "A",
+			"upstream": "127.0.0.1",
+		},
+	},
+	{
+		desc: "Failed request",
+		url:  "https://example.com",
+		attrs: map[string]string{
+			"level":  "ERROR",
+			"msg":    "failed request",
+			"method": "GET",
+			"error":  "GET: no 'dns' parameter in request",
+		},
+	},
+}
+
+func TestStructuredLogger(t *testing.T) {
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(answerLocalhost))
+	if err != nil {
+		t.Fatalf("TestStructuredLogger: unable to instantiate NewProxy: %s", err)
+	}
+
+	for _, test := range structuredLoggerTests {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(database, nil, dohdns.WithStructuredLogger(logger))
+		handler.ServeHTTP(w, req)
+
+		var record map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("%s: unable to parse log record %q: %s", test.desc, buf.String(), err)
+		}
+
+		for key, value := range test.attrs {
+			if record[key] != value {
+				t.Errorf(
+					"%s: unexpected %s attribute (got \"%v\", want \"%s\")",
+					test.desc,
+					key,
+					record[key],
+					value,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package dohdns
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// sizeBuckets are the upper bounds in bytes used for the message size
+// histograms.
+var sizeBuckets = []float64{32, 64, 128, 256, 512, 1024, 2048, 4096, 8192}
+
+// Histogram is a snapshot of observed values sorted into buckets.
+type Histogram struct {
+	// Buckets holds the upper bound of each bucket.
+	Buckets []float64
+
+	// Counts holds the number of observations less than or equal to the
+	// upper bound of the bucket at the same index, i.e. the counts are
+	// cumulative.
+	Counts []uint64
+
+	// Count is the total number of observations.
+	Count uint64
+
+	// Sum is the sum of all observed values.
+	Sum float64
+}
+
+// observe records v in h.
+func (h *Histogram) observe(v float64) {
+	for i, bound := range h.Buckets {
+		if v <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += v
+}
+
+// copy returns a deep copy of h.
+func (h *Histogram) copy() Histogram {
+	return Histogram{
+		Buckets: append([]float64(nil), h.Buckets...),
+		Counts:  append([]uint64(nil), h.Counts...),
+		Count:   h.Count,
+		Sum:     h.Sum,
+	}
+}
+
+// newHistogram returns an empty Histogram with the given buckets.
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: buckets,
+		Counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Metrics collects statistics about the requests handled by
+// HandleRequest, and about a CacheBackend or QtypeMetricsBackend using it.
+// It is safe for concurrent use. The zero value is ready to use.
+type Metrics struct {
+	mu           sync.Mutex
+	requestSize  *Histogram
+	responseSize *Histogram
+	cache        CacheStats
+	qtypes       map[string]uint64
+}
+
+// CacheStats holds the counters of a CacheBackend.
+type CacheStats struct {
+	// Hits and Misses count queries answered from the cache and queries
+	// passed on to the wrapped database.
+	Hits   uint64
+	Misses uint64
+
+	// Expirations counts entries removed from the cache because their
+	// TTL expired, or with ServeStale enabled because MaxStale passed.
+	// Evictions counts entries removed to make room when the cache held
+	// MaxEntries responses.
+	Expirations uint64
+	Evictions   uint64
+}
+
+// NewMetrics returns a new, empty, Metrics collector.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requestSize:  newHistogram(sizeBuckets),
+		responseSize: newHistogram(sizeBuckets),
+		qtypes:       map[string]uint64{},
+	}
+}
+
+// initHistograms creates the histograms of a Metrics not created with
+// NewMetrics. m.mu must be held.
+func (m *Metrics) initHistograms() {
+	if m.requestSize == nil {
+		m.requestSize = newHistogram(sizeBuckets)
+	}
+	if m.responseSize == nil {
+		m.responseSize = newHistogram(sizeBuckets)
+	}
+}
+
+// ObserveRequestSize records the size in bytes of a DNS query.
+func (m *Metrics) ObserveRequestSize(size int) {
+	m.mu.Lock()
+	m.initHistograms()
+	m.requestSize.observe(float64(size))
+	m.mu.Unlock()
+}
+
+// ObserveResponseSize records the size in bytes of a DNS response.
+func (m *Metrics) ObserveResponseSize(size int) {
+	m.mu.Lock()
+	m.initHistograms()
+	m.responseSize.observe(float64(size))
+	m.mu.Unlock()
+}
+
+// RequestSize returns a snapshot of the DNS query size histogram.
+func (m *Metrics) RequestSize() Histogram {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initHistograms()
+	return m.requestSize.copy()
+}
+
+// ResponseSize returns a snapshot of the DNS response size histogram.
+func (m *Metrics) ResponseSize() Histogram {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initHistograms()
+	return m.responseSize.copy()
+}
+
+// ObserveCacheHit records a query answered from the cache.
+func (m *Metrics) ObserveCacheHit() {
+	m.mu.Lock()
+	m.cache.Hits++
+	m.mu.Unlock()
+}
+
+// ObserveCacheMiss records a query not answered from the cache.
+func (m *Metrics) ObserveCacheMiss() {
+	m.mu.Lock()
+	m.cache.Misses++
+	m.mu.Unlock()
+}
+
+// ObserveCacheExpiration records an expired entry removed from the cache.
+func (m *Metrics) ObserveCacheExpiration() {
+	m.mu.Lock()
+	m.cache.Expirations++
+	m.mu.Unlock()
+}
+
+// ObserveCacheEviction records an entry removed from the full cache.
+func (m *Metrics) ObserveCacheEviction() {
+	m.mu.Lock()
+	m.cache.Evictions++
+	m.mu.Unlock()
+}
+
+// Cache returns a snapshot of the cache counters.
+func (m *Metrics) Cache() CacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cache
+}
+
+// ObserveQtype records a query of type qtype. Types unknown to
+// github.com/miekg/dns are counted as "OTHER", so arbitrary queries can
+// not create any number of counters.
+func (m *Metrics) ObserveQtype(qtype uint16) {
+	name, ok := dns.TypeToString[qtype]
+	if !ok {
+		name = "OTHER"
+	}
+
+	m.mu.Lock()
+	if m.qtypes == nil {
+		m.qtypes = map[string]uint64{}
+	}
+	m.qtypes[name]++
+	m.mu.Unlock()
+}
+
+// Qtypes returns a snapshot of the number of queries by type name, e.g.
+// "AAAA".
+func (m *Metrics) Qtypes() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	qtypes := make(map[string]uint64, len(m.qtypes))
+	for name, count := range m.qtypes {
+		qtypes[name] = count
+	}
+
+	return qtypes
+}
+
+// MetricsHandler returns a handler exposing metrics in the Prometheus text
+// format, to be mounted at e.g. "/metrics" for scraping.
+func MetricsHandler(metrics *Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+
+		writeHistogram(&b, "dohdns_request_size_bytes", "Size of DNS queries in bytes.", metrics.RequestSize())
+		writeHistogram(&b, "dohdns_response_size_bytes", "Size of DNS responses in bytes.", metrics.ResponseSize())
+
+		cache := metrics.Cache()
+		writeCounter(&b, "dohdns_cache_hits_total", "Queries answered from the cache.", cache.Hits)
+		writeCounter(&b, "dohdns_cache_misses_total", "Queries not answered from the cache.", cache.Misses)
+		writeCounter(&b, "dohdns_cache_expirations_total", "Cache entries removed after they expired.", cache.Expirations)
+		writeCounter(&b, "dohdns_cache_evictions_total", "Cache entries removed because the cache was full.", cache.Evictions)
+
+		writeLabeledCounter(&b, "dohdns_queries_total", "Queries by type.", "qtype", metrics.Qtypes())
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(b.Bytes())
+	})
+}
+
+// writeHistogram writes h named name to w in the Prometheus text format.
+func writeHistogram(w io.Writer, name string, help string, h Histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.Sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+// writeCounter writes the counter named name to w in the Prometheus text
+// format.
+func writeCounter(w io.Writer, name string, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+// writeLabeledCounter writes the counter named name with one value per
+// label value to w in the Prometheus text format, sorted by label value.
+func writeLabeledCounter(w io.Writer, name string, help string, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, key, values[key])
+	}
+}
+
+// formatFloat formats v for the Prometheus text format.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
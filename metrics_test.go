@@ -0,0 +1,136 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsSizes(t *testing.T) {
+	metrics := dohdns.NewMetrics()
+
+	// The query for www.example.com (A) is 33 bytes, the uncompressed
+	// answer from answerDatabase 64 bytes.
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+	w := httptest.NewRecorder()
+
+	handler := dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithMetrics(metrics))
+	handler.ServeHTTP(w, req)
+
+	sizeTests := []struct {
+		desc      string
+		histogram dohdns.Histogram
+		sum       float64
+		firstHit  int
+	}{
+		{
+			desc:      "Request size",
+			histogram: metrics.RequestSize(),
+			sum:       33,
+			firstHit:  1,
+		},
+		{
+			desc:      "Response size",
+			histogram: metrics.ResponseSize(),
+			sum:       64,
+			firstHit:  1,
+		},
+	}
+
+	for _, test := range sizeTests {
+		if test.histogram.Count != 1 {
+			t.Errorf(
+				"%s: unexpected observation count (got %d, want %d)",
+				test.desc,
+				test.histogram.Count,
+				1,
+			)
+		}
+
+		if test.histogram.Sum != test.sum {
+			t.Errorf(
+				"%s: unexpected sum (got %f, want %f)",
+				test.desc,
+				test.histogram.Sum,
+				test.sum,
+			)
+		}
+
+		for i, count := range test.histogram.Counts {
+			want := uint64(0)
+			if i >= test.firstHit {
+				want = 1
+			}
+			if count != want {
+				t.Errorf(
+					"%s: unexpected count for bucket %f (got %d, want %d)",
+					test.desc,
+					test.histogram.Buckets[i],
+					count,
+					want,
+				)
+			}
+		}
+	}
+}
+
+func TestMetricsZeroValue(t *testing.T) {
+	var metrics dohdns.Metrics
+
+	handler := dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithMetrics(&metrics))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil))
+
+	if count := metrics.RequestSize().Count; count != 1 {
+		t.Errorf("TestMetricsZeroValue: unexpected request size count (got %d, want %d)", count, 1)
+	}
+
+	w := httptest.NewRecorder()
+	dohdns.MetricsHandler(&metrics).ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/metrics", nil))
+
+	if body := w.Body.String(); !strings.Contains(body, "dohdns_response_size_bytes_count 1\n") {
+		t.Errorf("TestMetricsZeroValue: missing response size count in:\n%s", body)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	metrics := dohdns.NewMetrics()
+
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+	dohdns.HandleRequest(answerDatabase{}, nil, dohdns.WithMetrics(metrics)).ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	dohdns.MetricsHandler(metrics).ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/metrics", nil))
+
+	resp := w.Result()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf(
+			"TestMetricsHandler: unexpected Content-Type (got \"%s\", want text/plain)",
+			resp.Header.Get("Content-Type"),
+		)
+	}
+
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE dohdns_request_size_bytes histogram",
+		"dohdns_request_size_bytes_bucket{le=\"32\"} 0",
+		"dohdns_request_size_bytes_bucket{le=\"64\"} 1",
+		"dohdns_request_size_bytes_bucket{le=\"+Inf\"} 1",
+		"dohdns_request_size_bytes_sum 33",
+		"dohdns_request_size_bytes_count 1",
+		"# TYPE dohdns_response_size_bytes histogram",
+		"dohdns_response_size_bytes_sum 64",
+		"dohdns_response_size_bytes_count 1",
+		"# TYPE dohdns_cache_hits_total counter",
+		"dohdns_cache_hits_total 0",
+		"dohdns_cache_misses_total 0",
+		"dohdns_cache_expirations_total 0",
+		"dohdns_cache_evictions_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("TestMetricsHandler: missing line \"%s\" in:\n%s", line, body)
+		}
+	}
+}
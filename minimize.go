@@ -0,0 +1,75 @@
+package dohdns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net/http"
+)
+
+// MinimizeBackend wraps another Database and strips sections from its
+// responses that clients only needing the answer can do without, to limit
+// the data handed out.
+type MinimizeBackend struct {
+	Database Database
+
+	// StripAdditional removes all records except the OPT record from
+	// the additional section.
+	StripAdditional bool
+
+	// StripAuthority removes all records from the authority section.
+	StripAuthority bool
+}
+
+// NewMinimize returns a new MinimizeBackend wrapping database which strips
+// the additional section.
+func NewMinimize(database Database) *MinimizeBackend {
+	return &MinimizeBackend{Database: database, StripAdditional: true}
+}
+
+// Query passes qdata to the wrapped database and minimizes the response.
+func (mb *MinimizeBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := mb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details from the wrapped
+// database.
+func (mb *MinimizeBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	result, err := queryResult(ctx, mb.Database, qdata)
+	if err != nil || result.Status != http.StatusOK {
+		return result, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(result.Data); err != nil {
+		result.Data, result.Status = nil, http.StatusInternalServerError
+		return result, err
+	}
+
+	if mb.StripAdditional {
+		var extra []dns.RR
+		if opt := r.IsEdns0(); opt != nil {
+			extra = append(extra, opt)
+		}
+		r.Extra = extra
+	}
+
+	if mb.StripAuthority {
+		r.Ns = nil
+	}
+
+	rdata, err := r.Pack()
+	if err != nil {
+		result.Data, result.Status = nil, http.StatusInternalServerError
+		return result, err
+	}
+
+	result.Data = rdata
+
+	return result, nil
+}
+
+// Qclasses returns the query classes answered by the wrapped database.
+func (mb *MinimizeBackend) Qclasses() []uint16 {
+	return databaseQclasses(mb.Database)
+}
@@ -0,0 +1,106 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+// answerWithSections answers A queries with an answer, an authority and an
+// additional record, and an OPT record.
+func answerWithSections(m *dns.Msg) *dns.Msg {
+	r := answerLocalhost(m)
+	r.Ns = append(r.Ns, &dns.NS{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+		Ns:  "ns1.example.com.",
+	})
+	r.Extra = append(r.Extra, &dns.A{
+		Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	r.SetEdns0(1232, false)
+	return r
+}
+
+var minimizeTests = []struct {
+	desc            string
+	stripAdditional bool
+	stripAuthority  bool
+	ns              int
+	extra           int
+}{
+	{
+		desc:            "Strip additional only",
+		stripAdditional: true,
+		ns:              1,
+		extra:           1,
+	},
+	{
+		desc:           "Strip authority only",
+		stripAuthority: true,
+		ns:             0,
+		extra:          2,
+	},
+	{
+		desc:            "Strip additional and authority",
+		stripAdditional: true,
+		stripAuthority:  true,
+		ns:              0,
+		extra:           1,
+	},
+}
+
+func TestMinimize(t *testing.T) {
+	for _, test := range minimizeTests {
+		proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(answerWithSections))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+
+		database := dohdns.NewMinimize(proxy)
+		database.StripAdditional = test.stripAdditional
+		database.StripAuthority = test.stripAuthority
+
+		rdata, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if len(r.Answer) != 1 {
+			t.Errorf(
+				"%s: unexpected number of answers (got %d, want %d)",
+				test.desc,
+				len(r.Answer),
+				1,
+			)
+		}
+
+		if len(r.Ns) != test.ns {
+			t.Errorf(
+				"%s: unexpected number of authority records (got %d, want %d)",
+				test.desc,
+				len(r.Ns),
+				test.ns,
+			)
+		}
+
+		if len(r.Extra) != test.extra {
+			t.Errorf(
+				"%s: unexpected number of additional records (got %d, want %d)",
+				test.desc,
+				len(r.Extra),
+				test.extra,
+			)
+		}
+
+		if r.IsEdns0() == nil {
+			t.Errorf("%s: OPT record was stripped", test.desc)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package dohdns
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// MockExchanger is an in-process Exchanger that never touches the network.
+// It is meant for testing code built on top of ProxyBackend, for example
+// Database wrappers, without running a DNS server.
+type MockExchanger struct {
+	// Handler builds the response to a query. If Handler is nil, or
+	// returns nil, an empty reply to the query is used.
+	Handler func(*dns.Msg) *dns.Msg
+
+	// Delay is how long Exchange waits before answering.
+	Delay time.Duration
+
+	// Timeout makes Exchange fail with a timeout error after Timeout has
+	// passed if Delay is longer than Timeout. Zero means no timeout.
+	Timeout time.Duration
+
+	// Err, if set, is returned by Exchange instead of a response.
+	Err error
+
+	mu    sync.Mutex
+	calls int
+}
+
+// NewMockExchanger returns a new MockExchanger answering queries with the
+// messages built by handler.
+func NewMockExchanger(handler func(*dns.Msg) *dns.Msg) *MockExchanger {
+	return &MockExchanger{Handler: handler}
+}
+
+// Exchange answers m after the configured delay, or returns the configured
+// error. The address is ignored.
+func (e *MockExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.mu.Lock()
+	e.calls++
+	e.mu.Unlock()
+
+	if e.Timeout > 0 && e.Delay > e.Timeout {
+		time.Sleep(e.Timeout)
+		return nil, e.Timeout, mockTimeoutError{}
+	}
+
+	time.Sleep(e.Delay)
+
+	if e.Err != nil {
+		return nil, e.Delay, e.Err
+	}
+
+	var r *dns.Msg
+	if e.Handler != nil {
+		r = e.Handler(m)
+	}
+	if r == nil {
+		r = new(dns.Msg)
+		r.SetReply(m)
+	}
+
+	return r, e.Delay, nil
+}
+
+// Calls returns the number of times Exchange has been called.
+func (e *MockExchanger) Calls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
+
+// mockTimeoutError is returned by MockExchanger when the delay exceeds the
+// timeout. It implements net.Error like the errors from dns.Client.
+type mockTimeoutError struct{}
+
+func (mockTimeoutError) Error() string   { return "MockExchanger: i/o timeout" }
+func (mockTimeoutError) Timeout() bool   { return true }
+func (mockTimeoutError) Temporary() bool { return true }
@@ -0,0 +1,134 @@
+package dohdns_test
+
+import (
+	"errors"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// answerLocalhost answers A queries with 127.0.0.1.
+func answerLocalhost(m *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("127.0.0.1"),
+	})
+	return r
+}
+
+var mockExchangerTests = []struct {
+	desc    string
+	delay   time.Duration
+	timeout time.Duration
+	err     error
+	status  int
+	answers int
+	timeErr bool
+}{
+	{
+		desc:    "Answer from handler",
+		status:  http.StatusOK,
+		answers: 1,
+	},
+	{
+		desc:    "Answer within timeout",
+		delay:   10 * time.Millisecond,
+		timeout: time.Second,
+		status:  http.StatusOK,
+		answers: 1,
+	},
+	{
+		desc:    "Delay exceeding timeout",
+		delay:   time.Second,
+		timeout: 10 * time.Millisecond,
+		status:  http.StatusInternalServerError,
+		timeErr: true,
+	},
+	{
+		desc:   "Configured error",
+		err:    errors.New("test error"),
+		status: http.StatusInternalServerError,
+	},
+}
+
+func TestMockExchanger(t *testing.T) {
+	for _, test := range mockExchangerTests {
+		exchanger := dohdns.NewMockExchanger(answerLocalhost)
+		exchanger.Delay = test.delay
+		exchanger.Timeout = test.timeout
+		exchanger.Err = test.err
+
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+
+		start := time.Now()
+		rdata, status, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+
+		if status != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				test.status,
+			)
+		}
+
+		if exchanger.Calls() != 1 {
+			t.Errorf(
+				"%s: unexpected number of exchanges (got %d, want %d)",
+				test.desc,
+				exchanger.Calls(),
+				1,
+			)
+		}
+
+		if test.timeErr {
+			var nerr net.Error
+			if !errors.As(err, &nerr) || !nerr.Timeout() {
+				t.Errorf("%s: expected a timeout error, got: %v", test.desc, err)
+			}
+			if elapsed := time.Since(start); elapsed >= test.delay {
+				t.Errorf(
+					"%s: exchange did not time out early (took %s, delay %s)",
+					test.desc,
+					elapsed,
+					test.delay,
+				)
+			}
+			continue
+		}
+
+		if test.err != nil {
+			if !errors.Is(err, test.err) || !errors.Is(err, dohdns.ErrUpstreamFailed) {
+				t.Errorf(
+					"%s: unexpected err (got \"%v\", want \"%v\")",
+					test.desc,
+					err,
+					test.err,
+				)
+			}
+			continue
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if len(r.Answer) != test.answers {
+			t.Errorf(
+				"%s: unexpected number of answers (got %d, want %d)",
+				test.desc,
+				len(r.Answer),
+				test.answers,
+			)
+		}
+	}
+}
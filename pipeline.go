@@ -0,0 +1,270 @@
+package dohdns
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"sync"
+	"time"
+)
+
+// PipelineExchanger is an Exchanger keeping one persistent TCP or TLS
+// connection per upstream server and sending all queries to that server
+// over it, without waiting for earlier queries to be answered (RFC 7766).
+// Responses may arrive in any order and are matched to their queries by
+// transaction ID.
+//
+// Queries are sent with an ID that is unique among the queries pending on
+// the connection, the response is returned with the ID of the original
+// query. A connection closed by the server is redialed on the next query.
+type PipelineExchanger struct {
+	// Net is the protocol used, "tcp" (the default) or "tcp-tls".
+	Net string
+
+	// TLSConfig is used for "tcp-tls" connections.
+	TLSConfig *tls.Config
+
+	// Timeout bounds connecting to a server as well as sending a query
+	// and waiting for its response. The default is 2 seconds.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	conns   map[string]*pipelineConn
+	dialing map[string]*pipelineDial
+}
+
+// NewPipelineExchanger returns a new PipelineExchanger using network, see
+// PipelineExchanger.Net.
+func NewPipelineExchanger(network string) *PipelineExchanger {
+	return &PipelineExchanger{Net: network}
+}
+
+// pipelineDial is a connection being dialed, c and err are set once done
+// is closed.
+type pipelineDial struct {
+	done chan struct{}
+	c    *pipelineConn
+	err  error
+}
+
+// pipelineConn is a connection shared by the queries to one server.
+type pipelineConn struct {
+	conn *dns.Conn
+
+	// writeMu serializes writing queries to the connection.
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	err     error
+	done    chan struct{}
+}
+
+// timeout returns the configured timeout or the default.
+func (e *PipelineExchanger) timeout() time.Duration {
+	if e.Timeout > 0 {
+		return e.Timeout
+	}
+	return 2 * time.Second
+}
+
+// Exchange sends m to the server at address over the shared connection and
+// waits for the matching response.
+func (e *PipelineExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	c, err := e.conn(address)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	q := m.Copy()
+	ch := c.register(q)
+	if ch == nil {
+		return nil, 0, c.closedErr()
+	}
+	defer c.unregister(q.Id)
+
+	start := time.Now()
+	timeout := e.timeout()
+
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(start.Add(timeout))
+	err = c.conn.WriteMsg(q)
+	c.writeMu.Unlock()
+	if err != nil {
+		// A partially written query breaks the framing of the
+		// connection, so it cannot be used anymore.
+		c.close(err)
+		return nil, 0, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		r.Id = m.Id
+		return r, time.Since(start), nil
+	case <-c.done:
+		return nil, time.Since(start), c.closedErr()
+	case <-timer.C:
+		return nil, time.Since(start), fmt.Errorf("PipelineExchanger: %w", os.ErrDeadlineExceeded)
+	}
+}
+
+// Close closes all connections. Pending queries fail, later queries open
+// new connections.
+func (e *PipelineExchanger) Close() error {
+	e.mu.Lock()
+	conns := e.conns
+	e.conns = nil
+	e.mu.Unlock()
+
+	for _, c := range conns {
+		c.close(errors.New("PipelineExchanger: connection closed"))
+	}
+
+	return nil
+}
+
+// conn returns the open connection to address, dialing a new one if
+// needed. Dialing happens without holding e.mu, so a slow server does not
+// hold up queries to other servers. Queries arriving while a connection to
+// their server is being dialed wait for that dial.
+func (e *PipelineExchanger) conn(address string) (*pipelineConn, error) {
+	e.mu.Lock()
+
+	if c, ok := e.conns[address]; ok {
+		select {
+		case <-c.done:
+		default:
+			e.mu.Unlock()
+			return c, nil
+		}
+	}
+
+	if d, ok := e.dialing[address]; ok {
+		e.mu.Unlock()
+		<-d.done
+		return d.c, d.err
+	}
+
+	d := &pipelineDial{done: make(chan struct{})}
+	if e.dialing == nil {
+		e.dialing = map[string]*pipelineDial{}
+	}
+	e.dialing[address] = d
+	e.mu.Unlock()
+
+	d.c, d.err = e.dial(address)
+
+	e.mu.Lock()
+	delete(e.dialing, address)
+	if d.err == nil {
+		if e.conns == nil {
+			e.conns = map[string]*pipelineConn{}
+		}
+		e.conns[address] = d.c
+	}
+	e.mu.Unlock()
+	close(d.done)
+
+	return d.c, d.err
+}
+
+// dial opens a new connection to address.
+func (e *PipelineExchanger) dial(address string) (*pipelineConn, error) {
+	client := &dns.Client{Net: e.Net, TLSConfig: e.TLSConfig, DialTimeout: e.timeout()}
+	if client.Net == "" {
+		client.Net = "tcp"
+	}
+
+	conn, err := client.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pipelineConn{
+		conn:    conn,
+		pending: map[uint16]chan *dns.Msg{},
+		done:    make(chan struct{}),
+	}
+	go c.read()
+
+	return c, nil
+}
+
+// register assigns q an ID not used by any other pending query and returns
+// the channel its response is delivered on. It returns nil if the
+// connection is closed.
+func (c *pipelineConn) register(q *dns.Msg) chan *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil
+	}
+
+	q.Id = dns.Id()
+	for c.pending[q.Id] != nil {
+		q.Id = dns.Id()
+	}
+
+	// Buffered so read never blocks on a query that gave up waiting.
+	ch := make(chan *dns.Msg, 1)
+	c.pending[q.Id] = ch
+
+	return ch
+}
+
+// unregister forgets the pending query with id.
+func (c *pipelineConn) unregister(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// read delivers the responses arriving on the connection until it fails.
+func (c *pipelineConn) read() {
+	for {
+		r, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		c.mu.Lock()
+		ch := c.pending[r.Id]
+		delete(c.pending, r.Id)
+		c.mu.Unlock()
+
+		// Responses to queries that timed out are dropped.
+		if ch != nil {
+			ch <- r
+		}
+	}
+}
+
+// close closes the connection, failing pending queries with err. Only the
+// first call has any effect.
+func (c *pipelineConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	c.conn.Close()
+	close(c.done)
+}
+
+// closedErr returns the error the connection was closed with.
+func (c *pipelineConn) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return fmt.Errorf("PipelineExchanger: connection failed: %s", c.err)
+}
@@ -0,0 +1,233 @@
+package dohdns_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipelineServer accepts TCP connections and answers queries in batches of
+// size, in the reverse order they arrived in, so responses are only sent
+// if the client pipelines its queries. Queries for noresponse.example.com
+// are never answered.
+type pipelineServer struct {
+	l    net.Listener
+	size int
+
+	mu    sync.Mutex
+	conns int
+	ids   map[uint16]int
+}
+
+func newPipelineServer(t *testing.T, size int) *pipelineServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &pipelineServer{l: l, size: size, ids: map[uint16]int{}}
+	go s.serve()
+
+	return s
+}
+
+func (s *pipelineServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+
+		go s.serveConn(&dns.Conn{Conn: conn})
+	}
+}
+
+func (s *pipelineServer) serveConn(conn *dns.Conn) {
+	defer conn.Close()
+
+	for {
+		var batch []*dns.Msg
+		for len(batch) < s.size {
+			m, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.ids[m.Id]++
+			s.mu.Unlock()
+
+			if m.Question[0].Name != "noresponse.example.com." {
+				batch = append(batch, m)
+			}
+		}
+
+		for i := len(batch) - 1; i >= 0; i-- {
+			if err := conn.WriteMsg(answerLocalhost(batch[i])); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *pipelineServer) stats() (conns int, duplicateIDs bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, n := range s.ids {
+		if n > 1 {
+			duplicateIDs = true
+		}
+	}
+
+	return s.conns, duplicateIDs
+}
+
+func TestPipelineExchanger(t *testing.T) {
+	const queries = 8
+
+	server := newPipelineServer(t, queries)
+
+	exchanger := dohdns.NewPipelineExchanger("tcp")
+	exchanger.Timeout = 2 * time.Second
+	defer exchanger.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// All queries use the same ID, the exchanger has to make
+			// them unique on the connection.
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.com.", dns.TypeA)
+			m.Id = 1234
+
+			r, _, err := exchanger.Exchange(m, server.l.Addr().String())
+			if err != nil {
+				t.Errorf("TestPipelineExchanger: unexpected error: %s", err)
+				return
+			}
+
+			if r.Id != m.Id || len(r.Answer) != 1 {
+				t.Errorf(
+					"TestPipelineExchanger: unexpected response (got ID %d with %d answers, want ID %d with 1)",
+					r.Id,
+					len(r.Answer),
+					m.Id,
+				)
+			}
+		}()
+	}
+	wg.Wait()
+
+	conns, duplicateIDs := server.stats()
+
+	if conns != 1 {
+		t.Errorf("TestPipelineExchanger: unexpected number of connections (got %d, want %d)", conns, 1)
+	}
+
+	if duplicateIDs {
+		t.Errorf("TestPipelineExchanger: queries pending at the same time shared an ID")
+	}
+}
+
+func TestPipelineExchangerTimeout(t *testing.T) {
+	server := newPipelineServer(t, 1)
+
+	exchanger := dohdns.NewPipelineExchanger("tcp")
+	exchanger.Timeout = 100 * time.Millisecond
+	defer exchanger.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("noresponse.example.com.", dns.TypeA)
+
+	start := time.Now()
+	_, _, err := exchanger.Exchange(m, server.l.Addr().String())
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("TestPipelineExchangerTimeout: unexpected error (got %v, want %s)", err, os.ErrDeadlineExceeded)
+	}
+
+	if elapsed > 500*time.Millisecond {
+		t.Errorf(
+			"TestPipelineExchangerTimeout: query took too long (got %s, want at most %s)",
+			elapsed,
+			500*time.Millisecond,
+		)
+	}
+
+	// The connection is still usable after a timeout.
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	if _, _, err := exchanger.Exchange(m, server.l.Addr().String()); err != nil {
+		t.Errorf("TestPipelineExchangerTimeout: unexpected error after timeout: %s", err)
+	}
+
+	if conns, _ := server.stats(); conns != 1 {
+		t.Errorf("TestPipelineExchangerTimeout: unexpected number of connections (got %d, want %d)", conns, 1)
+	}
+}
+
+func TestPipelineExchangerSlowDial(t *testing.T) {
+	// Borrow the certificate of an httptest server for the TLS
+	// listener.
+	hs := httptest.NewUnstartedServer(nil)
+	hs.StartTLS()
+	defer hs.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", hs.TLS)
+	if err != nil {
+		t.Fatalf("TestPipelineExchangerSlowDial: unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	server := &pipelineServer{l: l, size: 1, ids: map[uint16]int{}}
+	go server.serve()
+
+	// Connections to the blackholed server are never accepted, so the
+	// TLS handshake does not complete until the timeout.
+	blackhole, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestPipelineExchangerSlowDial: unable to listen: %s", err)
+	}
+	defer blackhole.Close()
+
+	exchanger := dohdns.NewPipelineExchanger("tcp-tls")
+	exchanger.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	exchanger.Timeout = time.Second
+	defer exchanger.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		exchanger.Exchange(m, blackhole.Addr().String())
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, _, err := exchanger.Exchange(m, l.Addr().String()); err != nil {
+		t.Errorf("TestPipelineExchangerSlowDial: unexpected error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("TestPipelineExchangerSlowDial: query held up by dialing another server (took %s)", elapsed)
+	}
+
+	<-done
+}
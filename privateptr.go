@@ -0,0 +1,196 @@
+package dohdns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// privateNetworks are the networks PrivatePTRBackend answers for by
+// default: the private IPv4 ranges of RFC 1918 and IPv6 unique local
+// addresses (RFC 4193).
+var privateNetworks = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// PrivatePTRBackend wraps another Database and answers reverse lookups of
+// private addresses itself, so they do not leak to public upstream
+// servers (RFC 6303). Queries for names at or below the reverse zones of
+// Networks, e.g. 10.in-addr.arpa., are answered locally: PTR queries for
+// the address of an entry in Names with that name, others with NXDOMAIN.
+// Other queries are passed on.
+type PrivatePTRBackend struct {
+	Database Database
+
+	// Networks lists the networks answered for, the default is the
+	// private IPv4 ranges of RFC 1918 and IPv6 unique local addresses.
+	Networks []*net.IPNet
+
+	// Names maps addresses to the names returned in PTR records for
+	// them, e.g. "10.0.0.1": "gateway.internal.". It is parsed on the
+	// first query and must not be modified afterwards.
+	Names map[string]string
+
+	// SOATemplate, if set, provides the fields of the SOA record in
+	// negative responses, see StaticBackend.SOATemplate.
+	SOATemplate *dns.SOA
+
+	once      sync.Once
+	names     map[string]string
+	addresses []net.IP
+}
+
+// NewPrivatePTR returns a new PrivatePTRBackend wrapping database and
+// answering for the default private networks.
+func NewPrivatePTR(database Database) *PrivatePTRBackend {
+	pb := &PrivatePTRBackend{Database: database}
+
+	for _, network := range privateNetworks {
+		_, n, _ := net.ParseCIDR(network)
+		pb.Networks = append(pb.Networks, n)
+	}
+
+	return pb
+}
+
+// Query answers reverse lookups of private addresses and passes everything
+// else on to the wrapped database.
+func (pb *PrivatePTRBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := pb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details about the query.
+func (pb *PrivatePTRBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil || len(m.Question) != 1 || m.Question[0].Qclass != dns.ClassINET {
+		return queryResult(ctx, pb.Database, qdata)
+	}
+
+	q := m.Question[0]
+
+	ip, bits, host := reversePrefix(q.Name)
+	if ip == nil || !pb.private(ip, bits) {
+		return queryResult(ctx, pb.Database, qdata)
+	}
+
+	pb.once.Do(pb.parseNames)
+
+	result := &Result{Question: &q}
+
+	r := NewReply(m, dns.RcodeSuccess)
+	r.Authoritative = true
+
+	if name, ok := pb.names[ip.String()]; ok && host {
+		if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+			r.Answer = append(r.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+				Ptr: dns.Fqdn(name),
+			})
+		}
+	} else if !pb.covers(ip, bits) {
+		// Names leading to configured addresses exist, but have no
+		// records.
+		r.Rcode = dns.RcodeNameError
+	}
+
+	if len(r.Answer) == 0 {
+		r.Ns = append(r.Ns, syntheticSOA(q.Name, pb.SOATemplate))
+	}
+
+	rdata, err := r.Pack()
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		return result, err
+	}
+
+	result.Data = rdata
+	result.Status = http.StatusOK
+
+	return result, nil
+}
+
+// Qclasses returns the query classes answered by the wrapped database.
+func (pb *PrivatePTRBackend) Qclasses() []uint16 {
+	return databaseQclasses(pb.Database)
+}
+
+// parseNames parses the addresses in Names.
+func (pb *PrivatePTRBackend) parseNames() {
+	pb.names = map[string]string{}
+	for address, name := range pb.Names {
+		if ip := net.ParseIP(address); ip != nil {
+			pb.names[ip.String()] = name
+			pb.addresses = append(pb.addresses, ip)
+		}
+	}
+}
+
+// private reports whether the addresses starting with the first bits of ip
+// are all in one of the networks.
+func (pb *PrivatePTRBackend) private(ip net.IP, bits int) bool {
+	for _, n := range pb.Networks {
+		ones, _ := n.Mask.Size()
+		if bits >= ones && len(ip) == len(n.IP) && n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// covers reports whether a configured address starts with the first bits
+// of ip.
+func (pb *PrivatePTRBackend) covers(ip net.IP, bits int) bool {
+	prefix := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, 8*len(ip))}
+	for _, address := range pb.addresses {
+		if prefix.Contains(address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reversePrefix returns the address prefix of the reverse lookup name,
+// e.g. 10.0.0.0 and 8 bits for "10.in-addr.arpa.". The labels of name are
+// read from the right until the address is complete or a label is not
+// part of an address. host reports whether name is exactly the reverse
+// name of the complete address. The returned address is nil if name is not
+// in the reverse tree.
+func reversePrefix(name string) (ip net.IP, bits int, host bool) {
+	name = dns.CanonicalName(name)
+
+	var labels []string
+	var base, size int
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		base, size = 10, 8
+		ip = make(net.IP, net.IPv4len)
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		base, size = 16, 4
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil, 0, false
+	}
+
+	// The rightmost label holds the highest bits.
+	parsed := 0
+	for i := len(labels) - 1; i >= 0 && bits < 8*len(ip); i-- {
+		v, err := strconv.ParseUint(labels[i], base, size)
+		if err != nil || (base == 16 && len(labels[i]) != 1) {
+			break
+		}
+		ip[bits/8] |= byte(v) << uint(8-size-bits%8)
+		bits += size
+		parsed++
+	}
+
+	return ip, bits, parsed == len(labels) && bits == 8*len(ip)
+}
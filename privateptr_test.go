@@ -0,0 +1,151 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+var privatePTRTests = []struct {
+	desc   string
+	qname  string
+	qtype  uint16
+	rcode  int
+	ptr    string
+	passed bool
+}{
+	{
+		desc:  "Private IPv4 address",
+		qname: "1.0.0.10.in-addr.arpa.",
+		qtype: dns.TypePTR,
+		rcode: dns.RcodeNameError,
+	},
+	{
+		desc:  "Configured private IPv4 address",
+		qname: "1.1.168.192.IN-ADDR.ARPA.",
+		qtype: dns.TypePTR,
+		rcode: dns.RcodeSuccess,
+		ptr:   "gateway.internal.",
+	},
+	{
+		desc:  "Configured address with other type",
+		qname: "1.1.168.192.in-addr.arpa.",
+		qtype: dns.TypeTXT,
+		rcode: dns.RcodeSuccess,
+	},
+	{
+		desc:  "Unique local IPv6 address",
+		qname: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+		qtype: dns.TypePTR,
+		rcode: dns.RcodeNameError,
+	},
+	{
+		desc:   "Public IPv4 address is passed on",
+		qname:  "8.8.8.8.in-addr.arpa.",
+		qtype:  dns.TypePTR,
+		rcode:  dns.RcodeSuccess,
+		passed: true,
+	},
+	{
+		desc:  "Private IPv4 reverse zone",
+		qname: "10.in-addr.arpa.",
+		qtype: dns.TypeSOA,
+		rcode: dns.RcodeNameError,
+	},
+	{
+		desc:  "Private IPv4 reverse zone of a /12",
+		qname: "20.172.in-addr.arpa.",
+		qtype: dns.TypeNS,
+		rcode: dns.RcodeNameError,
+	},
+	{
+		desc:  "Name below a private IPv4 address",
+		qname: "_tcp.1.0.0.10.in-addr.arpa.",
+		qtype: dns.TypePTR,
+		rcode: dns.RcodeNameError,
+	},
+	{
+		desc:  "Name leading to a configured address",
+		qname: "1.168.192.in-addr.arpa.",
+		qtype: dns.TypePTR,
+		rcode: dns.RcodeSuccess,
+	},
+	{
+		desc:  "Unique local IPv6 reverse zone",
+		qname: "d.f.ip6.arpa.",
+		qtype: dns.TypeSOA,
+		rcode: dns.RcodeNameError,
+	},
+	{
+		desc:   "Reverse zone larger than a private network is passed on",
+		qname:  "172.in-addr.arpa.",
+		qtype:  dns.TypeNS,
+		rcode:  dns.RcodeSuccess,
+		passed: true,
+	},
+	{
+		desc:   "Public IPv6 address is passed on",
+		qname:  "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+		qtype:  dns.TypePTR,
+		rcode:  dns.RcodeSuccess,
+		passed: true,
+	},
+	{
+		desc:   "Forward name is passed on",
+		qname:  "www.example.com.",
+		qtype:  dns.TypeA,
+		rcode:  dns.RcodeSuccess,
+		passed: true,
+	},
+}
+
+func TestPrivatePTR(t *testing.T) {
+	for _, test := range privatePTRTests {
+		backend := &namedDatabase{}
+		database := dohdns.NewPrivatePTR(backend)
+		database.Names = map[string]string{"192.168.1.1": "gateway.internal"}
+
+		rdata, _, err := database.Query(packQuery(t, test.qname, test.qtype))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		if (len(backend.names) == 1) != test.passed {
+			t.Errorf("%s: unexpected queries to wrapped database (got %v)", test.desc, backend.names)
+		}
+
+		if test.passed {
+			continue
+		}
+
+		if test.ptr == "" {
+			if len(r.Answer) != 0 || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Errorf("%s: unexpected negative response (got %v answers, %v authority)", test.desc, r.Answer, r.Ns)
+			}
+			continue
+		}
+
+		if len(r.Answer) != 1 {
+			t.Fatalf("%s: unexpected number of answers (got %d, want 1)", test.desc, len(r.Answer))
+		}
+
+		ptr, ok := r.Answer[0].(*dns.PTR)
+		if !ok || ptr.Ptr != test.ptr {
+			t.Errorf("%s: unexpected answer (got %s, want PTR %s)", test.desc, r.Answer[0], test.ptr)
+		}
+	}
+}
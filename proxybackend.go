@@ -1,9 +1,18 @@
 package dohdns
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/miekg/dns"
+	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,28 +23,282 @@ type Exchanger interface {
 }
 
 // ProxyBackend passes on queries to a recursive DNS resolver.
+//
+// Servers may include a port, like "192.0.2.1:5353", Port is used for
+// servers without one. Use SetServers to change the servers while queries
+// are being handled.
 type ProxyBackend struct {
 	Servers    []string
 	Port       string
 	ResolvConf string
 	Exchanger  Exchanger
+
+	// BlockedQtypes lists query types that are answered with REFUSED
+	// instead of being passed on, e.g. dns.TypeANY or dns.TypeAXFR.
+	BlockedQtypes []uint16
+
+	// RandomizeCase enables DNS 0x20 encoding: the case of the letters
+	// in the outgoing query name is randomized and the response must echo
+	// the exact same casing, otherwise SERVFAIL is returned.
+	RandomizeCase bool
+
+	// LowercaseNames converts the query name to lowercase before passing
+	// the query on, so upstream servers and caches see a single spelling
+	// of each name. The response carries the name as sent by the client.
+	// It can be combined with RandomizeCase, which is applied to the
+	// lowercase name.
+	LowercaseNames bool
+
+	// FormErr makes Query answer malformed queries with a wire format
+	// FORMERR response, along with the 400 status, when at least the
+	// message header is readable. Otherwise only the status is returned.
+	FormErr bool
+
+	// Logger, if set, is used to report details about upstream
+	// responses, such as Extended DNS Errors (RFC 8914).
+	Logger *log.Logger
+
+	// SlowQueryThreshold, if set, makes Query report exchanges with an
+	// upstream server taking longer than the threshold to Logger.
+	SlowQueryThreshold time.Duration
+
+	// FailureThreshold is the number of consecutive failures after which
+	// a server is considered down and skipped for Cooldown, after which
+	// it is tried again. Zero disables skipping servers.
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	// ResponseHook, if set, is called with the upstream response before
+	// it is packed, allowing it to be modified. If it returns an error
+	// the query fails with ResponseHookStatus, or 500 if that is unset.
+	ResponseHook       func(*dns.Msg) error
+	ResponseHookStatus int
+
+	// RetryBadVers makes Query retry a query without EDNS0 when the
+	// upstream server responds with BADVERS, like resolvers do when
+	// talking to servers not supporting the EDNS version used.
+	RetryBadVers bool
+
+	// AllowInvalidNames disables rejecting queries with 400 when the
+	// query name is not a valid domain name, or contains a label with a
+	// literal dot.
+	AllowInvalidNames bool
+
+	// RequireRD rejects queries without the RD (recursion desired) bit
+	// with 400, as a forwarding server can only answer recursively.
+	RequireRD bool
+
+	// ForceRD sets the RD bit on queries passed on to the upstream
+	// servers. The response carries the RD bit of the original query.
+	ForceRD bool
+
+	// ForceDO sets the DO bit on queries passed on to the upstream
+	// servers, adding an OPT record if needed, e.g. to have them validate
+	// and return DNSSEC records regardless of the client. DNSSEC records
+	// are stripped from responses to clients without the DO bit like with
+	// StripDNSSEC, and the response carries the EDNS0 settings of the
+	// original query.
+	ForceDO bool
+
+	// NoDataHook, if set, is called with the question of each query the
+	// upstream answered with NODATA, i.e. NOERROR without answers.
+	NoDataHook func(dns.Question)
+
+	// NoDataSOA adds a synthetic SOA record to the authority section of
+	// NODATA responses lacking one, so clients can cache the negative
+	// answer (RFC 2308).
+	NoDataSOA bool
+
+	// SOATemplate, if set, provides the fields of the SOA record added
+	// by NoDataSOA, see StaticBackend.SOATemplate.
+	SOATemplate *dns.SOA
+
+	// AllowUpstreamOverride makes Query send queries to the upstream
+	// server given in the context by the handler, see
+	// WithUpstreamOverride, instead of Servers.
+	AllowUpstreamOverride bool
+
+	// SanitizeQuery removes all records except the OPT record from the
+	// additional section of queries, as well as any answer and authority
+	// records, before they are passed on.
+	SanitizeQuery bool
+
+	// MaxResponseSize, if set, limits the size of packed responses in
+	// bytes. Larger responses are replaced by a truncated one with the
+	// TC bit set and all records except the OPT record dropped.
+	MaxResponseSize int
+
+	// StripDNSSEC removes DNSSEC records such as RRSIG and NSEC from
+	// responses to queries without the DO bit, like resolvers do (RFC
+	// 4035). Records of the queried type are kept.
+	StripDNSSEC bool
+
+	// ValidateQR rejects upstream responses without the QR bit set,
+	// which are malformed, answering SERVFAIL instead.
+	ValidateQR bool
+
+	// CompressThreshold, if set, enables DNS name compression for
+	// responses larger than CompressThreshold bytes when packed without
+	// it, saving bandwidth on large responses and CPU on small ones.
+	CompressThreshold int
+
+	// RetryNetworkErrors makes Query retry a query once on the same
+	// server when the exchange fails with a transient network error, like
+	// a temporary error or a refused connection, before moving on to the
+	// next server.
+	RetryNetworkErrors bool
+
+	// VerifyQuestion rejects upstream responses with a question section
+	// not matching the query in name, ignoring case, type and class,
+	// answering SERVFAIL instead. Mismatched responses may be the result
+	// of a broken upstream or of spoofing.
+	VerifyQuestion bool
+
+	// Cookies enables DNS Cookies (RFC 7873) towards the upstream servers:
+	// a client cookie is sent with each query, and the server cookie
+	// returned by each server is remembered and sent with later queries.
+	// Responses echoing the wrong client cookie are rejected. Cookies sent
+	// by clients are replaced, and cookies are removed from responses.
+	// Queries without EDNS0 are sent without a cookie.
+	Cookies bool
+
+	// ProbeQuery is the query sent to each server by the probes started
+	// with StartProbes, every ProbeInterval. The default is ". IN NS".
+	// Probe results update the health of the servers like client queries
+	// do, so FailureThreshold must be set for them to have any effect.
+	ProbeQuery    dns.Question
+	ProbeInterval time.Duration
+
+	mu        sync.Mutex
+	health    map[string]*serverHealth
+	cookies   map[string]*upstreamCookie
+	probeStop chan struct{}
+	probeDone chan struct{}
+}
+
+// ErrNoServers is returned by NewProxy when no servers are supplied and
+// reading them from resolv.conf has been disabled with WithoutResolvConf.
+var ErrNoServers = errors.New("NewProxy: no servers supplied and resolv.conf fallback is disabled")
+
+// proxyConfig holds the settings modified by ProxyOption.
+type proxyConfig struct {
+	net          string
+	noResolvConf bool
+	localAddr    string
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+}
+
+// ProxyOption modifies how NewProxy sets up the ProxyBackend.
+type ProxyOption func(*proxyConfig)
+
+// WithNet sets the protocol used to talk to the upstream servers: "udp",
+// "tcp" or "tcp-tls". It only applies to the default dns.Client, i.e. when
+// no Exchanger is passed to NewProxy. The default is "udp".
+func WithNet(network string) ProxyOption {
+	return func(c *proxyConfig) {
+		c.net = network
+	}
+}
+
+// WithoutResolvConf requires servers to be passed to NewProxy explicitly
+// instead of falling back to reading them from resolv.conf, which may not
+// exist in minimal containers. NewProxy returns ErrNoServers if no servers
+// are supplied.
+func WithoutResolvConf() ProxyOption {
+	return func(c *proxyConfig) {
+		c.noResolvConf = true
+	}
+}
+
+// WithLocalAddr sets the local IP address outgoing queries are sent from,
+// e.g. on multi-homed hosts. Like WithNet it only applies to the default
+// dns.Client.
+func WithLocalAddr(ip string) ProxyOption {
+	return func(c *proxyConfig) {
+		c.localAddr = ip
+	}
+}
+
+// WithTimeouts sets the dial and read timeouts used when talking to the
+// upstream servers, bounding how long a query to a server not responding
+// takes to fail. Zero keeps the dns package default of 2 seconds. Like
+// WithNet it only applies to the default dns.Client.
+func WithTimeouts(dial time.Duration, read time.Duration) ProxyOption {
+	return func(c *proxyConfig) {
+		c.dialTimeout = dial
+		c.readTimeout = read
+	}
+}
+
+// SetServers replaces the upstream servers, e.g. when reloading the
+// configuration. It is safe to call while queries are being handled, each
+// query uses either the old or the new servers. The health of the old
+// servers is forgotten.
+func (pb *ProxyBackend) SetServers(servers []string) {
+	servers = append([]string(nil), servers...)
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	pb.Servers = servers
+	pb.health = nil
+}
+
+// servers returns the current upstream servers.
+func (pb *ProxyBackend) servers() []string {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	return pb.Servers
+}
+
+// ServersFromEnv returns the comma separated list of servers in the
+// environment variable name, e.g. "192.0.2.1, 192.0.2.2:5353". The result
+// is nil if the variable is unset or empty, which makes NewProxy fall back
+// to resolv.conf.
+func ServersFromEnv(name string) []string {
+	var servers []string
+
+	for _, server := range strings.Split(os.Getenv(name), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers
 }
 
 // NewProxy returns a new ProxyBackend instance.
-func NewProxy(servers []string, port string, resolvconf string, exchanger Exchanger) (*ProxyBackend, error) {
+func NewProxy(servers []string, port string, resolvconf string, exchanger Exchanger, opts ...ProxyOption) (*ProxyBackend, error) {
+
+	config := proxyConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	switch config.net {
+	case "", "udp", "tcp", "tcp-tls":
+	default:
+		return nil, fmt.Errorf("NewProxy: unsupported network %q", config.net)
+	}
 
 	if resolvconf == "" {
 		resolvconf = "/etc/resolv.conf"
 	}
 
+	if len(servers) == 0 && config.noResolvConf {
+		return nil, ErrNoServers
+	}
+
 	// Default to parsing resolve.conf file.
 	if servers == nil {
-		config, err := dns.ClientConfigFromFile(resolvconf)
+		clientConfig, err := dns.ClientConfigFromFile(resolvconf)
 		if err != nil {
 			return nil, err
 		}
 
-		servers = config.Servers
+		servers = clientConfig.Servers
 	}
 
 	// Default to port 53.
@@ -45,27 +308,522 @@ func NewProxy(servers []string, port string, resolvconf string, exchanger Exchan
 
 	// Default to returning a normal dns.Client pointer.
 	if exchanger == nil {
-		exchanger = new(dns.Client)
+		client := &dns.Client{
+			Net:         config.net,
+			DialTimeout: config.dialTimeout,
+			ReadTimeout: config.readTimeout,
+		}
+
+		if config.localAddr != "" {
+			ip := net.ParseIP(config.localAddr)
+			if ip == nil {
+				return nil, fmt.Errorf("NewProxy: invalid local address %q", config.localAddr)
+			}
+
+			// The dialer needs an address matching the network.
+			var localAddr net.Addr
+			if config.net == "" || config.net == "udp" {
+				localAddr = &net.UDPAddr{IP: ip}
+			} else {
+				localAddr = &net.TCPAddr{IP: ip}
+			}
+			// The dialer timeout also caps the read timeout of the
+			// client, so it must not be shorter.
+			dialTimeout := 2 * time.Second
+			if config.dialTimeout > 0 {
+				dialTimeout = config.dialTimeout
+			}
+			if config.readTimeout > dialTimeout {
+				dialTimeout = config.readTimeout
+			}
+			client.Dialer = &net.Dialer{LocalAddr: localAddr, Timeout: dialTimeout}
+		}
+
+		exchanger = client
 	}
 
 	return &ProxyBackend{Servers: servers, Port: port, Exchanger: exchanger}, nil
 }
 
-// Query expects to send a request to a recursive DNS resolver.
+// Query expects to send a request to a recursive DNS resolver. Errors of
+// the Exchanger are wrapped to match ErrUpstreamFailed, errors.Is and
+// errors.As still match the original error.
 func (pb *ProxyBackend) Query(qdata []byte) ([]byte, int, error) {
-	c := pb.Exchanger
+	result, err := pb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports the question of the query.
+func (pb *ProxyBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	result := &Result{}
 	m := new(dns.Msg)
 
 	err := m.Unpack(qdata)
 	if err != nil {
-		return nil, http.StatusBadRequest, err
+		result.Status = http.StatusBadRequest
+		if pb.FormErr {
+			result.Data = formErr(qdata)
+		}
+		return result, classify(ErrInvalidMessage, err)
+	}
+
+	// DNS allows multiple questions in theory, but in practice a query
+	// always carries exactly one, which is also what the code below
+	// relies on.
+	if len(m.Question) != 1 {
+		result.Status = http.StatusBadRequest
+		return result, fmt.Errorf("ProxyBackend: query must contain exactly 1 question, found %d", len(m.Question))
+	}
+
+	q := m.Question[0]
+	result.Question = &q
+
+	// Blocked queries are refused whatever the state of the servers.
+	if pb.blocked(q.Qtype) {
+		result.Data, result.Status, err = reply(m, dns.RcodeRefused)
+		return result, err
+	}
+
+	if !pb.AllowInvalidNames && !validName(q.Name) {
+		result.Status = http.StatusBadRequest
+		return result, fmt.Errorf("ProxyBackend: invalid query name %s", q.Name)
+	}
+
+	if pb.RequireRD && !m.RecursionDesired {
+		result.Status = http.StatusBadRequest
+		return result, errors.New("ProxyBackend: query does not have the RD bit set")
+	}
+
+	servers := pb.servers()
+	if pb.AllowUpstreamOverride {
+		if upstream := UpstreamOverride(ctx); upstream != "" {
+			servers = []string{upstream}
+		}
+	}
+
+	if pb.SanitizeQuery {
+		sanitize(m)
+	}
+
+	// A ProxyBackend created without NewProxy may lack servers.
+	if len(servers) == 0 {
+		result.Status = http.StatusInternalServerError
+		return result, errors.New("ProxyBackend: no upstream servers configured")
+	}
+
+	result.Data, result.Status, err = pb.exchange(m, servers, result)
+
+	return result, err
+}
+
+// exchange sends the query m to one of servers and returns the packed
+// response. Details about the response are recorded in result.
+func (pb *ProxyBackend) exchange(m *dns.Msg, servers []string, result *Result) ([]byte, int, error) {
+	// The name may be rewritten below, responses to the client must
+	// carry the original one.
+	original := m.Question[0].Name
+	if pb.LowercaseNames {
+		m.Question[0].Name = strings.ToLower(original)
+	}
+
+	var qname string
+	if pb.RandomizeCase {
+		qname = m.Question[0].Name
+		m.Question[0].Name = randomizeCase(qname)
+	}
+
+	rd := m.RecursionDesired
+	if pb.ForceRD {
+		m.RecursionDesired = true
+	}
+
+	q := m
+	if pb.ForceDO && !dnssecOK(m) {
+		q = withDO(m)
+	}
+
+	r, server, err := pb.forward(q, servers)
+	if err == nil && pb.RetryBadVers && r.Rcode == dns.RcodeBadVers && q.IsEdns0() != nil {
+		r, server, err = pb.forward(withoutEdns0(q), servers)
+	}
+	result.Upstream = server
+
+	// Every reply to the client, including the SERVFAIL responses made
+	// from m below, must carry the RD bit of the original query.
+	if pb.ForceRD {
+		m.RecursionDesired = rd
+		if err == nil {
+			r.RecursionDesired = rd
+		}
+	}
+	if err != nil {
+		// Tell the client when to come back if all servers are down.
+		var uerr *unavailableError
+		if errors.As(err, &uerr) {
+			result.RetryAfter = uerr.retryAfter
+			return nil, http.StatusServiceUnavailable, classify(ErrUpstreamFailed, err)
+		}
+		return nil, http.StatusInternalServerError, classify(ErrUpstreamFailed, err)
+	}
+
+	if pb.ValidateQR && !r.Response {
+		if pb.Logger != nil {
+			pb.Logger.Printf("%s | response from %s without QR bit", result.Question.Name, server)
+		}
+		m.Question[0].Name = original
+		return reply(m, dns.RcodeServerFailure)
+	}
+
+	if pb.RandomizeCase {
+		// The casing must be echoed exactly, a mismatch indicates a
+		// spoofed or broken response.
+		sent := m.Question[0].Name
+		m.Question[0].Name = qname
+		if len(r.Question) == 0 || r.Question[0].Name != sent {
+			m.Question[0].Name = original
+			return reply(m, dns.RcodeServerFailure)
+		}
+		restoreCase(r, sent, qname)
+	}
+
+	if pb.LowercaseNames {
+		lowered := m.Question[0].Name
+		m.Question[0].Name = original
+		if len(r.Question) > 0 && r.Question[0].Name == lowered {
+			restoreCase(r, lowered, original)
+		}
+	}
+
+	if pb.VerifyQuestion && !sameQuestion(r, m.Question[0]) {
+		if pb.Logger != nil {
+			pb.Logger.Printf("%s | response from %s with mismatched question", result.Question.Name, server)
+		}
+		return reply(m, dns.RcodeServerFailure)
+	}
+
+	// Extended DNS Errors are passed on to the client as part of the
+	// packed response, but are also extracted for observability.
+	result.ExtendedErrors = extendedErrors(r)
+	if pb.Logger != nil {
+		for _, ede := range result.ExtendedErrors {
+			pb.Logger.Printf(
+				"%s | extended DNS error %d (%s): %s",
+				result.Question.Name,
+				ede.InfoCode,
+				dns.ExtendedErrorCodeToString[ede.InfoCode],
+				ede.ExtraText,
+			)
+		}
+	}
+
+	if (pb.StripDNSSEC || pb.ForceDO) && !dnssecOK(m) {
+		stripDNSSEC(r, m.Question[0].Qtype)
+	}
+
+	if pb.ForceDO && !dnssecOK(m) {
+		// Hide the forced DO bit from the client.
+		if m.IsEdns0() == nil {
+			r = withoutEdns0(r)
+		} else if opt := r.IsEdns0(); opt != nil {
+			opt.SetDo(false)
+		}
+	}
+
+	if noData(r) {
+		if pb.NoDataHook != nil {
+			pb.NoDataHook(*result.Question)
+		}
+		if pb.NoDataSOA && !hasSOA(r.Ns) {
+			r.Ns = append(r.Ns, syntheticSOA(result.Question.Name, pb.SOATemplate))
+		}
+	}
+
+	if pb.ResponseHook != nil {
+		if err := pb.ResponseHook(r); err != nil {
+			httpStatus := pb.ResponseHookStatus
+			if httpStatus == 0 {
+				httpStatus = http.StatusInternalServerError
+			}
+			return nil, httpStatus, err
+		}
+	}
+
+	if pb.CompressThreshold > 0 {
+		r.Compress = false
 	}
 
-	r, _, err := c.Exchange(m, net.JoinHostPort(pb.Servers[0], pb.Port))
+	rdata, err := r.Pack()
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
+	if pb.CompressThreshold > 0 && len(rdata) > pb.CompressThreshold {
+		r.Compress = true
+		rdata, err = r.Pack()
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	if pb.MaxResponseSize > 0 && len(rdata) > pb.MaxResponseSize {
+		truncate(r)
+		rdata, err = r.Pack()
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	return rdata, http.StatusOK, nil
+}
+
+// dnssecTypes lists the record types removed by stripDNSSEC.
+var dnssecTypes = []uint16{
+	dns.TypeRRSIG,
+	dns.TypeNSEC,
+	dns.TypeNSEC3,
+	dns.TypeNSEC3PARAM,
+	dns.TypeDNSKEY,
+	dns.TypeDS,
+}
+
+// dnssecOK reports whether the query m has the DO bit set.
+func dnssecOK(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// stripDNSSEC removes DNSSEC records not of type qtype from all sections
+// of the response r, except the OPT record.
+func stripDNSSEC(r *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			t := rr.Header().Rrtype
+			if t == qtype || !isDNSSECType(t) {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+
+	r.Answer = strip(r.Answer)
+	r.Ns = strip(r.Ns)
+	r.Extra = strip(r.Extra)
+}
+
+// isDNSSECType reports whether t is one of dnssecTypes.
+func isDNSSECType(t uint16) bool {
+	for _, dt := range dnssecTypes {
+		if dt == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// truncate sets the TC bit on the response r and drops all records but
+// the OPT record, telling the client the answer did not fit.
+func truncate(r *dns.Msg) {
+	r.Truncated = true
+	r.Answer = nil
+	r.Ns = nil
+
+	var extra []dns.RR
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	r.Extra = extra
+}
+
+// sameQuestion reports whether the response r has exactly one question,
+// matching q.
+func sameQuestion(r *dns.Msg, q dns.Question) bool {
+	if len(r.Question) != 1 {
+		return false
+	}
+
+	rq := r.Question[0]
+
+	return strings.EqualFold(rq.Name, q.Name) && rq.Qtype == q.Qtype && rq.Qclass == q.Qclass
+}
+
+// noData reports whether r is a NODATA response: NOERROR without answers,
+// which is not a referral.
+func noData(r *dns.Msg) bool {
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 {
+		return false
+	}
+
+	for _, rr := range r.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasSOA reports whether rrs contains a SOA record.
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validName reports whether name is a valid domain name. Unpack accepts
+// labels containing a literal dot and presents them escaped as "\.", such
+// names are rejected as they are easily mistaken for a different name.
+func validName(name string) bool {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' {
+			if i+1 < len(name) && name[i+1] == '.' {
+				return false
+			}
+			// Skip the escaped character.
+			i++
+		}
+	}
+
+	return true
+}
+
+// sanitize removes all records but the OPT record from the query m.
+func sanitize(m *dns.Msg) {
+	m.Answer = nil
+	m.Ns = nil
+
+	var extra []dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// withDO returns a copy of m with the DO bit set, adding an OPT record if
+// m has none.
+func withDO(m *dns.Msg) *dns.Msg {
+	c := m.Copy()
+
+	if opt := c.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		c.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	return c
+}
+
+// withoutEdns0 returns a copy of m with the OPT record removed.
+func withoutEdns0(m *dns.Msg) *dns.Msg {
+	c := m.Copy()
+	c.Extra = nil
+
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			c.Extra = append(c.Extra, rr)
+		}
+	}
+
+	return c
+}
+
+// blocked reports whether queries of type qtype should be refused.
+func (pb *ProxyBackend) blocked(qtype uint16) bool {
+	for _, t := range pb.BlockedQtypes {
+		if t == qtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extendedErrors returns the Extended DNS Error options in r, if any.
+func extendedErrors(r *dns.Msg) []*dns.EDNS0_EDE {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	var edes []*dns.EDNS0_EDE
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			edes = append(edes, ede)
+		}
+	}
+
+	return edes
+}
+
+// randomizeCase returns name with the case of each letter randomized.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if rand.Intn(2) == 0 {
+				b[i] = c ^ 0x20
+			}
+		}
+	}
+	return string(b)
+}
+
+// restoreCase replaces the randomized name sent with the original name in
+// the question and in any records owned by it.
+func restoreCase(r *dns.Msg, sent string, name string) {
+	r.Question[0].Name = name
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name == sent {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+// formErr returns a packed FORMERR response to the malformed query in qdata,
+// or nil if not even the header can be read.
+func formErr(qdata []byte) []byte {
+	// The DNS header is 12 bytes long, the first 4 bytes hold the ID and
+	// the flags we want to echo back.
+	if len(qdata) < 12 {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint16(qdata[2:4])
+
+	r := new(dns.Msg)
+	r.Id = binary.BigEndian.Uint16(qdata[0:2])
+	r.Response = true
+	r.Opcode = int(flags>>11) & 0xF
+	r.RecursionDesired = flags&(1<<8) != 0
+	r.Rcode = dns.RcodeFormatError
+
+	rdata, err := r.Pack()
+	if err != nil {
+		return nil
+	}
+
+	return rdata
+}
+
+// reply returns a packed response with the given rcode to the query m.
+func reply(m *dns.Msg, rcode int) ([]byte, int, error) {
+	r := NewReply(m, rcode)
+
 	rdata, err := r.Pack()
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
@@ -0,0 +1,1840 @@
+package dohdns_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingExchanger answers every query with an empty reply and keeps
+// track of the messages it was asked to exchange.
+type recordingExchanger struct {
+	queries []*dns.Msg
+}
+
+func (e *recordingExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.queries = append(e.queries, m.Copy())
+	r := new(dns.Msg)
+	r.SetReply(m)
+	return r, 0, nil
+}
+
+// packQuery returns the wire format of a query for name and qtype.
+func packQuery(t *testing.T, name string, qtype uint16) []byte {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	qdata, err := m.Pack()
+	if err != nil {
+		t.Fatalf("unable to pack query for %s: %s", name, err)
+	}
+	return qdata
+}
+
+var blockedQtypesTests = []struct {
+	desc      string
+	qtype     uint16
+	rcode     int
+	exchanged bool
+}{
+	{
+		desc:      "Blocked ANY query",
+		qtype:     dns.TypeANY,
+		rcode:     dns.RcodeRefused,
+		exchanged: false,
+	},
+	{
+		desc:      "Blocked AXFR query",
+		qtype:     dns.TypeAXFR,
+		rcode:     dns.RcodeRefused,
+		exchanged: false,
+	},
+	{
+		desc:      "Allowed A query",
+		qtype:     dns.TypeA,
+		rcode:     dns.RcodeSuccess,
+		exchanged: true,
+	},
+}
+
+func TestBlockedQtypes(t *testing.T) {
+	for _, test := range blockedQtypesTests {
+		exchanger := &recordingExchanger{}
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.BlockedQtypes = []uint16{dns.TypeANY, dns.TypeAXFR}
+
+		rdata, status, err := database.Query(packQuery(t, "www.example.com.", test.qtype))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		if status != http.StatusOK {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				http.StatusOK,
+			)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		if exchanged := len(exchanger.queries) > 0; exchanged != test.exchanged {
+			t.Errorf(
+				"%s: unexpected exchange (got %t, want %t)",
+				test.desc,
+				exchanged,
+				test.exchanged,
+			)
+		}
+	}
+}
+
+func TestBlockedQtypesWithoutServers(t *testing.T) {
+	database := &dohdns.ProxyBackend{BlockedQtypes: []uint16{dns.TypeANY}}
+
+	rdata, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeANY))
+	if err != nil {
+		t.Fatalf("TestBlockedQtypesWithoutServers: unexpected error: %s", err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestBlockedQtypesWithoutServers: unable to parse response: %s", err)
+	}
+
+	if r.Rcode != dns.RcodeRefused {
+		t.Errorf(
+			"TestBlockedQtypesWithoutServers: unexpected rcode (got %s, want %s)",
+			dns.RcodeToString[r.Rcode],
+			dns.RcodeToString[dns.RcodeRefused],
+		)
+	}
+}
+
+// lowercaseExchanger answers with the question name lowercased, like a
+// server that does not preserve the case of the query name.
+type lowercaseExchanger struct{}
+
+func (lowercaseExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+	return r, 0, nil
+}
+
+// A long name makes it practically impossible for the randomized casing to
+// end up identical to the original.
+const randomizeCaseName = "abcdefghijklmnopqrstuvwxyz.abcdefghijklmnopqrstuvwxyz.example.com."
+
+func TestRandomizeCase(t *testing.T) {
+	exchanger := &recordingExchanger{}
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestRandomizeCase: unable to instantiate NewProxy: %s", err)
+	}
+	database.RandomizeCase = true
+
+	rdata, _, err := database.Query(packQuery(t, randomizeCaseName, dns.TypeA))
+	if err != nil {
+		t.Fatalf("TestRandomizeCase: unexpected error: %s", err)
+	}
+
+	sent := exchanger.queries[0].Question[0].Name
+	if sent == randomizeCaseName || !strings.EqualFold(sent, randomizeCaseName) {
+		t.Errorf(
+			"TestRandomizeCase: outgoing name not randomized (got %s, want case variation of %s)",
+			sent,
+			randomizeCaseName,
+		)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestRandomizeCase: unable to parse response: %s", err)
+	}
+
+	if r.Rcode != dns.RcodeSuccess {
+		t.Errorf(
+			"TestRandomizeCase: unexpected rcode (got %s, want %s)",
+			dns.RcodeToString[r.Rcode],
+			dns.RcodeToString[dns.RcodeSuccess],
+		)
+	}
+
+	if r.Question[0].Name != randomizeCaseName {
+		t.Errorf(
+			"TestRandomizeCase: original casing not restored (got %s, want %s)",
+			r.Question[0].Name,
+			randomizeCaseName,
+		)
+	}
+}
+
+func TestRandomizeCaseMismatch(t *testing.T) {
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", lowercaseExchanger{})
+	if err != nil {
+		t.Fatalf("TestRandomizeCaseMismatch: unable to instantiate NewProxy: %s", err)
+	}
+	database.RandomizeCase = true
+
+	rdata, _, err := database.Query(packQuery(t, randomizeCaseName, dns.TypeA))
+	if err != nil {
+		t.Fatalf("TestRandomizeCaseMismatch: unexpected error: %s", err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestRandomizeCaseMismatch: unable to parse response: %s", err)
+	}
+
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf(
+			"TestRandomizeCaseMismatch: unexpected rcode (got %s, want %s)",
+			dns.RcodeToString[r.Rcode],
+			dns.RcodeToString[dns.RcodeServerFailure],
+		)
+	}
+}
+
+func TestNewProxyNet(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestNewProxyNet: unable to listen: %s", err)
+	}
+
+	dnsServerReady := make(chan struct{})
+	dnsServer := &dns.Server{
+		Listener:          l,
+		Handler:           &dnsRequestHandler{},
+		NotifyStartedFunc: func() { close(dnsServerReady) },
+	}
+	go dnsServer.ActivateAndServe()
+	defer dnsServer.Shutdown()
+	<-dnsServerReady
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	database, err := dohdns.NewProxy([]string{host}, port, "", nil, dohdns.WithNet("tcp"))
+	if err != nil {
+		t.Fatalf("TestNewProxyNet: unable to instantiate NewProxy: %s", err)
+	}
+
+	client, ok := database.Exchanger.(*dns.Client)
+	if !ok {
+		t.Fatalf("TestNewProxyNet: unexpected Exchanger type %T", database.Exchanger)
+	}
+
+	if client.Net != "tcp" {
+		t.Errorf(
+			"TestNewProxyNet: unexpected client Net (got \"%s\", want \"%s\")",
+			client.Net,
+			"tcp",
+		)
+	}
+
+	rdata, status, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("TestNewProxyNet: query over TCP failed: %s", err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf(
+			"TestNewProxyNet: unexpected status code (got %d, want %d)",
+			status,
+			http.StatusOK,
+		)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestNewProxyNet: unable to parse response: %s", err)
+	}
+
+	if len(r.Answer) != 1 {
+		t.Errorf(
+			"TestNewProxyNet: unexpected number of answers (got %d, want %d)",
+			len(r.Answer),
+			1,
+		)
+	}
+}
+
+var localAddrTests = []struct {
+	desc      string
+	net       string
+	localAddr net.Addr
+}{
+	{
+		desc:      "UDP local address",
+		net:       "udp",
+		localAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")},
+	},
+	{
+		desc:      "TCP local address",
+		net:       "tcp",
+		localAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")},
+	},
+}
+
+func TestNewProxyLocalAddr(t *testing.T) {
+	for _, test := range localAddrTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", nil, dohdns.WithNet(test.net), dohdns.WithLocalAddr("127.0.0.1"))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+
+		client, ok := database.Exchanger.(*dns.Client)
+		if !ok {
+			t.Fatalf("%s: unexpected Exchanger type %T", test.desc, database.Exchanger)
+		}
+
+		if client.Dialer == nil || !reflect.DeepEqual(client.Dialer.LocalAddr, test.localAddr) {
+			t.Errorf(
+				"%s: unexpected dialer local address (got %v, want %s)",
+				test.desc,
+				client.Dialer,
+				test.localAddr,
+			)
+		}
+	}
+
+	if _, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", nil, dohdns.WithLocalAddr("invalid")); err == nil {
+		t.Errorf("TestNewProxyLocalAddr: expected an error for an invalid local address")
+	}
+}
+
+func TestNewProxyTimeouts(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestNewProxyTimeouts: unable to listen: %s", err)
+	}
+
+	dnsServerReady := make(chan struct{})
+	dnsServer := &dns.Server{
+		PacketConn:        pc,
+		Handler:           &dnsRequestHandler{},
+		NotifyStartedFunc: func() { close(dnsServerReady) },
+	}
+	go dnsServer.ActivateAndServe()
+	defer dnsServer.Shutdown()
+	<-dnsServerReady
+
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+
+	timeout := 200 * time.Millisecond
+	database, err := dohdns.NewProxy([]string{host}, port, "", nil, dohdns.WithTimeouts(timeout, timeout))
+	if err != nil {
+		t.Fatalf("TestNewProxyTimeouts: unable to instantiate NewProxy: %s", err)
+	}
+
+	start := time.Now()
+	_, status, err := database.Query(packQuery(t, "noresponse.example.com.", dns.TypeA))
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Errorf("TestNewProxyTimeouts: expected an error")
+	}
+
+	if status != http.StatusInternalServerError {
+		t.Errorf(
+			"TestNewProxyTimeouts: unexpected status code (got %d, want %d)",
+			status,
+			http.StatusInternalServerError,
+		)
+	}
+
+	if elapsed > 500*time.Millisecond {
+		t.Errorf(
+			"TestNewProxyTimeouts: query took too long (got %s, want at most %s)",
+			elapsed,
+			500*time.Millisecond,
+		)
+	}
+}
+
+func TestNewProxyUnsupportedNet(t *testing.T) {
+	if _, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", nil, dohdns.WithNet("sctp")); err == nil {
+		t.Errorf("TestNewProxyUnsupportedNet: expected an error for an unsupported network")
+	}
+}
+
+var formErrTests = []struct {
+	desc   string
+	qdata  []byte
+	formed bool
+}{
+	{
+		desc: "Truncated query with readable header",
+		// Header for ID 0x1234 with RD set and a single question, but
+		// the question itself is cut short.
+		qdata:  []byte{0x12, 0x34, 0x1, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x77, 0x77},
+		formed: true,
+	},
+	{
+		desc:   "Garbage query",
+		qdata:  []byte{0xde, 0xad, 0xbe, 0xef},
+		formed: false,
+	},
+}
+
+func TestFormErr(t *testing.T) {
+	for _, test := range formErrTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", &recordingExchanger{})
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.FormErr = true
+
+		req := httptest.NewRequest("POST", "https://example.com", bytes.NewReader(test.qdata))
+		req.Header.Set("Content-Type", "application/dns-udpwireformat")
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(database, nil)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				http.StatusBadRequest,
+			)
+		}
+
+		if !test.formed {
+			if !bytes.Equal(respBody, []byte("Bad Request\n")) {
+				t.Errorf(
+					"%s: unexpected respBody (got \"%#v\", want \"%#v\")",
+					test.desc,
+					respBody,
+					[]byte("Bad Request\n"),
+				)
+			}
+			continue
+		}
+
+		if resp.Header.Get("Content-Type") != "application/dns-udpwireformat" {
+			t.Errorf(
+				"%s: unexpected Content-Type (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Content-Type"),
+				"application/dns-udpwireformat",
+			)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(respBody); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != dns.RcodeFormatError || r.Id != 0x1234 || !r.Response || !r.RecursionDesired {
+			t.Errorf(
+				"%s: unexpected response header (got %s)",
+				test.desc,
+				r.MsgHdr.String(),
+			)
+		}
+	}
+}
+
+func TestExtendedErrors(t *testing.T) {
+	exchanger := dohdns.NewMockExchanger(func(m *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetRcode(m, dns.RcodeServerFailure)
+		r.SetEdns0(1232, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeDNSBogus,
+			ExtraText: "validation failure",
+		})
+		return r
+	})
+
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestExtendedErrors: unable to instantiate NewProxy: %s", err)
+	}
+
+	var buf bytes.Buffer
+	database.Logger = log.New(&buf, "", 0)
+
+	result, err := database.QueryResult(context.Background(), packQuery(t, "www.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("TestExtendedErrors: unexpected error: %s", err)
+	}
+
+	if len(result.ExtendedErrors) != 1 || result.ExtendedErrors[0].InfoCode != dns.ExtendedErrorCodeDNSBogus {
+		t.Errorf(
+			"TestExtendedErrors: unexpected extended errors in result (got %v)",
+			result.ExtendedErrors,
+		)
+	}
+
+	// The option must be preserved in the response to the client.
+	r := new(dns.Msg)
+	if err := r.Unpack(result.Data); err != nil {
+		t.Fatalf("TestExtendedErrors: unable to parse response: %s", err)
+	}
+
+	opt := r.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("TestExtendedErrors: extended error not passed on in response")
+	}
+
+	if ede, ok := opt.Option[0].(*dns.EDNS0_EDE); !ok || ede.ExtraText != "validation failure" {
+		t.Errorf(
+			"TestExtendedErrors: unexpected option in response (got %v)",
+			opt.Option[0],
+		)
+	}
+
+	if !strings.Contains(buf.String(), "extended DNS error 6 (DNSSEC Bogus): validation failure") {
+		t.Errorf(
+			"TestExtendedErrors: log does not contain the extended error (got \"%s\")",
+			strings.TrimSpace(buf.String()),
+		)
+	}
+}
+
+func TestNewProxyWithoutResolvConf(t *testing.T) {
+	// The resolv.conf path does not exist, so an error other than
+	// ErrNoServers would mean the file was read anyway.
+	_, err := dohdns.NewProxy(nil, "", "/nonexistent-resolv.conf", nil, dohdns.WithoutResolvConf())
+	if err != dohdns.ErrNoServers {
+		t.Errorf(
+			"TestNewProxyWithoutResolvConf: unexpected err (got \"%v\", want \"%v\")",
+			err,
+			dohdns.ErrNoServers,
+		)
+	}
+
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "/nonexistent-resolv.conf", nil, dohdns.WithoutResolvConf())
+	if err != nil {
+		t.Fatalf("TestNewProxyWithoutResolvConf: unexpected error with explicit servers: %s", err)
+	}
+
+	if len(database.Servers) != 1 || database.Servers[0] != "127.0.0.1" {
+		t.Errorf(
+			"TestNewProxyWithoutResolvConf: unexpected servers (got %v, want %v)",
+			database.Servers,
+			[]string{"127.0.0.1"},
+		)
+	}
+}
+
+var questionCountTests = []struct {
+	desc      string
+	questions []dns.Question
+}{
+	{
+		desc:      "Query without question",
+		questions: nil,
+	},
+	{
+		desc: "Query with two questions",
+		questions: []dns.Question{
+			{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "www.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		},
+	},
+}
+
+func TestQuestionCount(t *testing.T) {
+	for _, test := range questionCountTests {
+		exchanger := &recordingExchanger{}
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.RandomizeCase = true
+		database.BlockedQtypes = []uint16{dns.TypeANY}
+
+		m := new(dns.Msg)
+		m.Id = dns.Id()
+		m.Question = test.questions
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		_, status, err := database.Query(qdata)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.desc)
+		}
+
+		if status != http.StatusBadRequest {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				http.StatusBadRequest,
+			)
+		}
+
+		if len(exchanger.queries) != 0 {
+			t.Errorf("%s: query was passed on upstream", test.desc)
+		}
+	}
+}
+
+// answerDualStack answers with both an A and an AAAA record.
+func answerDualStack(m *dns.Msg) *dns.Msg {
+	r := answerLocalhost(m)
+	r.Answer = append(r.Answer, &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+		AAAA: net.ParseIP("::1"),
+	})
+	return r
+}
+
+func TestResponseHook(t *testing.T) {
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(answerDualStack))
+	if err != nil {
+		t.Fatalf("TestResponseHook: unable to instantiate NewProxy: %s", err)
+	}
+
+	database.ResponseHook = func(r *dns.Msg) error {
+		var answers []dns.RR
+		for _, rr := range r.Answer {
+			if rr.Header().Rrtype != dns.TypeAAAA {
+				answers = append(answers, rr)
+			}
+		}
+		r.Answer = answers
+		return nil
+	}
+
+	rdata, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeANY))
+	if err != nil {
+		t.Fatalf("TestResponseHook: unexpected error: %s", err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestResponseHook: unable to parse response: %s", err)
+	}
+
+	if types := rrTypes(r.Answer); !equalTypes(types, []uint16{dns.TypeA}) {
+		t.Errorf(
+			"TestResponseHook: unexpected answer types (got %v, want %v)",
+			types,
+			[]uint16{dns.TypeA},
+		)
+	}
+}
+
+func TestResponseHookError(t *testing.T) {
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(answerDualStack))
+	if err != nil {
+		t.Fatalf("TestResponseHookError: unable to instantiate NewProxy: %s", err)
+	}
+
+	database.ResponseHook = func(r *dns.Msg) error {
+		return errors.New("test error")
+	}
+	database.ResponseHookStatus = http.StatusBadGateway
+
+	_, status, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+	if err == nil {
+		t.Errorf("TestResponseHookError: expected an error")
+	}
+
+	if status != http.StatusBadGateway {
+		t.Errorf(
+			"TestResponseHookError: unexpected status code (got %d, want %d)",
+			status,
+			http.StatusBadGateway,
+		)
+	}
+}
+
+// answerBadVers answers queries with EDNS0 with BADVERS and queries
+// without it like answerLocalhost.
+func answerBadVers(m *dns.Msg) *dns.Msg {
+	if m.IsEdns0() == nil {
+		return answerLocalhost(m)
+	}
+
+	r := new(dns.Msg)
+	r.SetRcode(m, dns.RcodeBadVers)
+	r.SetEdns0(4096, false)
+	return r
+}
+
+var badVersTests = []struct {
+	desc         string
+	retryBadVers bool
+	rcode        int
+	calls        int
+}{
+	{
+		desc:         "BADVERS passed on by default",
+		retryBadVers: false,
+		rcode:        dns.RcodeBadVers,
+		calls:        1,
+	},
+	{
+		desc:         "BADVERS retried without EDNS0",
+		retryBadVers: true,
+		rcode:        dns.RcodeSuccess,
+		calls:        2,
+	},
+}
+
+func TestRetryBadVers(t *testing.T) {
+	for _, test := range badVersTests {
+		exchanger := dohdns.NewMockExchanger(answerBadVers)
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.RetryBadVers = test.retryBadVers
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		rdata, _, err := database.Query(qdata)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		if exchanger.Calls() != test.calls {
+			t.Errorf(
+				"%s: unexpected number of upstream exchanges (got %d, want %d)",
+				test.desc,
+				exchanger.Calls(),
+				test.calls,
+			)
+		}
+	}
+}
+
+// craftedQuery returns a wire format A query for the given labels, which
+// may contain characters not allowed by dns.Msg.Pack.
+func craftedQuery(labels ...string) []byte {
+	qdata := []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range labels {
+		qdata = append(qdata, byte(len(label)))
+		qdata = append(qdata, label...)
+	}
+	return append(qdata, 0, 0, 1, 0, 1)
+}
+
+var validateNamesTests = []struct {
+	desc          string
+	qdata         []byte
+	validateNames bool
+	status        int
+}{
+	{
+		desc:          "Valid name",
+		qdata:         craftedQuery("www", "example", "com"),
+		validateNames: true,
+		status:        http.StatusOK,
+	},
+	{
+		desc:          "Label containing a dot",
+		qdata:         craftedQuery("www", "example.com", "evil"),
+		validateNames: true,
+		status:        http.StatusBadRequest,
+	},
+	{
+		desc:          "Label containing a dot without validation",
+		qdata:         craftedQuery("www", "example.com", "evil"),
+		validateNames: false,
+		status:        http.StatusOK,
+	},
+}
+
+func TestValidateNames(t *testing.T) {
+	for _, test := range validateNamesTests {
+		exchanger := dohdns.NewMockExchanger(nil)
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.AllowInvalidNames = !test.validateNames
+
+		_, status, err := database.Query(test.qdata)
+
+		if status != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				test.status,
+			)
+		}
+
+		if (err != nil) != (test.status != http.StatusOK) {
+			t.Errorf("%s: unexpected error: %v", test.desc, err)
+		}
+	}
+}
+
+var serversFromEnvTests = []struct {
+	desc    string
+	value   string
+	servers []string
+}{
+	{
+		desc:    "Server list",
+		value:   "192.0.2.1, 192.0.2.2:5353,[2001:db8::1]:53",
+		servers: []string{"192.0.2.1", "192.0.2.2:5353", "[2001:db8::1]:53"},
+	},
+	{
+		desc:    "Empty entries are ignored",
+		value:   "192.0.2.1,, ",
+		servers: []string{"192.0.2.1"},
+	},
+	{
+		desc:    "Empty variable",
+		value:   "",
+		servers: nil,
+	},
+}
+
+func TestServersFromEnv(t *testing.T) {
+	for _, test := range serversFromEnvTests {
+		t.Setenv("DOHDNS_TEST_SERVERS", test.value)
+
+		servers := dohdns.ServersFromEnv("DOHDNS_TEST_SERVERS")
+
+		if !reflect.DeepEqual(servers, test.servers) {
+			t.Errorf(
+				"%s: unexpected servers (got %q, want %q)",
+				test.desc,
+				servers,
+				test.servers,
+			)
+		}
+	}
+}
+
+var recursionDesiredTests = []struct {
+	desc       string
+	rd         bool
+	requireRD  bool
+	forceRD    bool
+	status     int
+	upstreamRD bool
+}{
+	{
+		desc:       "RD unset passed on by default",
+		rd:         false,
+		status:     http.StatusOK,
+		upstreamRD: false,
+	},
+	{
+		desc:       "RD unset rejected",
+		rd:         false,
+		requireRD:  true,
+		status:     http.StatusBadRequest,
+		upstreamRD: false,
+	},
+	{
+		desc:       "RD set accepted",
+		rd:         true,
+		requireRD:  true,
+		status:     http.StatusOK,
+		upstreamRD: true,
+	},
+	{
+		desc:       "RD forced",
+		rd:         false,
+		forceRD:    true,
+		status:     http.StatusOK,
+		upstreamRD: true,
+	},
+}
+
+func TestRecursionDesired(t *testing.T) {
+	for _, test := range recursionDesiredTests {
+		exchanger := &recordingExchanger{}
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.RequireRD = test.requireRD
+		database.ForceRD = test.forceRD
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		m.RecursionDesired = test.rd
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		rdata, status, _ := database.Query(qdata)
+
+		if status != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				test.status,
+			)
+		}
+
+		if test.status != http.StatusOK {
+			if len(exchanger.queries) != 0 {
+				t.Errorf("%s: rejected query was passed on", test.desc)
+			}
+			continue
+		}
+
+		if len(exchanger.queries) != 1 || exchanger.queries[0].RecursionDesired != test.upstreamRD {
+			t.Errorf("%s: unexpected RD bit in upstream query (want %t)", test.desc, test.upstreamRD)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.RecursionDesired != test.rd {
+			t.Errorf(
+				"%s: unexpected RD bit in response (got %t, want %t)",
+				test.desc,
+				r.RecursionDesired,
+				test.rd,
+			)
+		}
+	}
+}
+
+var forceRDFailureTests = []struct {
+	desc           string
+	handler        func(*dns.Msg) *dns.Msg
+	validateQR     bool
+	verifyQuestion bool
+}{
+	{
+		desc:       "Response without QR bit",
+		handler:    answerWithoutQR,
+		validateQR: true,
+	},
+	{
+		desc: "Response with mismatched question",
+		handler: func(m *dns.Msg) *dns.Msg {
+			r := answerLocalhost(m)
+			r.Question[0].Name = "www.example.net."
+			return r
+		},
+		verifyQuestion: true,
+	},
+}
+
+func TestForceRDFailure(t *testing.T) {
+	for _, test := range forceRDFailureTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(test.handler))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.ForceRD = true
+		database.ValidateQR = test.validateQR
+		database.VerifyQuestion = test.verifyQuestion
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		m.RecursionDesired = false
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		rdata, _, err := database.Query(qdata)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != dns.RcodeServerFailure || r.RecursionDesired {
+			t.Errorf(
+				"%s: unexpected response (got %s with RD %t, want %s without RD)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				r.RecursionDesired,
+				dns.RcodeToString[dns.RcodeServerFailure],
+			)
+		}
+	}
+}
+
+var noDataTests = []struct {
+	desc      string
+	qtype     uint16
+	noDataSOA bool
+	noData    bool
+	ns        int
+}{
+	{
+		desc:   "NODATA response is detected",
+		qtype:  dns.TypeAAAA,
+		noData: true,
+		ns:     0,
+	},
+	{
+		desc:      "NODATA response gets SOA",
+		qtype:     dns.TypeAAAA,
+		noDataSOA: true,
+		noData:    true,
+		ns:        1,
+	},
+	{
+		desc:      "Positive response",
+		qtype:     dns.TypeA,
+		noDataSOA: true,
+		noData:    false,
+		ns:        0,
+	},
+}
+
+func TestNoData(t *testing.T) {
+	for _, test := range noDataTests {
+		// answerLocalhost answers every query with an A record, drop it
+		// for other query types.
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(func(m *dns.Msg) *dns.Msg {
+			r := answerLocalhost(m)
+			if m.Question[0].Qtype != dns.TypeA {
+				r.Answer = nil
+			}
+			return r
+		}))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+
+		var questions []dns.Question
+		database.NoDataHook = func(q dns.Question) {
+			questions = append(questions, q)
+		}
+		database.NoDataSOA = test.noDataSOA
+
+		rdata, _, err := database.Query(packQuery(t, "www.example.com.", test.qtype))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		if (len(questions) == 1) != test.noData {
+			t.Errorf(
+				"%s: unexpected NODATA detection (got %v, want detected %t)",
+				test.desc,
+				questions,
+				test.noData,
+			)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if len(r.Ns) != test.ns {
+			t.Fatalf(
+				"%s: unexpected number of authority records (got %d, want %d)",
+				test.desc,
+				len(r.Ns),
+				test.ns,
+			)
+		}
+
+		if test.ns > 0 {
+			if _, ok := r.Ns[0].(*dns.SOA); !ok {
+				t.Errorf(
+					"%s: unexpected authority record (got %s, want SOA)",
+					test.desc,
+					r.Ns[0],
+				)
+			}
+		}
+	}
+}
+
+func TestNoServers(t *testing.T) {
+	database := &dohdns.ProxyBackend{}
+
+	_, status, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+	if err == nil {
+		t.Errorf("TestNoServers: expected an error")
+	}
+
+	if status != http.StatusInternalServerError {
+		t.Errorf(
+			"TestNoServers: unexpected status code (got %d, want %d)",
+			status,
+			http.StatusInternalServerError,
+		)
+	}
+}
+
+var sanitizeQueryTests = []struct {
+	desc     string
+	sanitize bool
+	extra    []uint16
+	answers  int
+}{
+	{
+		desc:    "Injected records passed on by default",
+		extra:   []uint16{dns.TypeA, dns.TypeOPT},
+		answers: 1,
+	},
+	{
+		desc:     "Injected records removed",
+		sanitize: true,
+		extra:    []uint16{dns.TypeOPT},
+		answers:  0,
+	},
+}
+
+func TestSanitizeQuery(t *testing.T) {
+	for _, test := range sanitizeQueryTests {
+		exchanger := &recordingExchanger{}
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.SanitizeQuery = test.sanitize
+
+		injected := &dns.A{
+			Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 86400},
+			A:   net.ParseIP("192.0.2.66"),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		m.Answer = append(m.Answer, injected)
+		m.Extra = append(m.Extra, injected)
+		m.SetEdns0(4096, false)
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		if _, _, err := database.Query(qdata); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		if len(exchanger.queries) != 1 {
+			t.Fatalf("%s: unexpected number of exchanges (got %d, want 1)", test.desc, len(exchanger.queries))
+		}
+
+		q := exchanger.queries[0]
+
+		if types := rrTypes(q.Extra); !equalTypes(types, test.extra) {
+			t.Errorf(
+				"%s: unexpected additional records (got %v, want %v)",
+				test.desc,
+				types,
+				test.extra,
+			)
+		}
+
+		if len(q.Answer) != test.answers {
+			t.Errorf(
+				"%s: unexpected number of answer records (got %d, want %d)",
+				test.desc,
+				len(q.Answer),
+				test.answers,
+			)
+		}
+	}
+}
+
+// answerLarge answers with 50 TXT records.
+func answerLarge(m *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	for i := 0; i < 50; i++ {
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{strings.Repeat("x", 100)},
+		})
+	}
+	return r
+}
+
+var maxResponseSizeTests = []struct {
+	desc            string
+	maxResponseSize int
+	truncated       bool
+	answers         int
+}{
+	{
+		desc:            "no limit",
+		maxResponseSize: 0,
+		truncated:       false,
+		answers:         50,
+	},
+	{
+		desc:            "response within limit",
+		maxResponseSize: 65535,
+		truncated:       false,
+		answers:         50,
+	},
+	{
+		desc:            "response exceeding limit",
+		maxResponseSize: 512,
+		truncated:       true,
+		answers:         0,
+	},
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	for _, test := range maxResponseSizeTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(answerLarge))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.MaxResponseSize = test.maxResponseSize
+
+		rdata, status, err := database.Query(packQuery(t, "www.example.com.", dns.TypeTXT))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		if status != http.StatusOK {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				http.StatusOK,
+			)
+		}
+
+		if test.maxResponseSize > 0 && len(rdata) > test.maxResponseSize {
+			t.Errorf(
+				"%s: response exceeds limit (got %d bytes, want at most %d)",
+				test.desc,
+				len(rdata),
+				test.maxResponseSize,
+			)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Truncated != test.truncated {
+			t.Errorf(
+				"%s: unexpected TC bit (got %t, want %t)",
+				test.desc,
+				r.Truncated,
+				test.truncated,
+			)
+		}
+
+		if len(r.Answer) != test.answers {
+			t.Errorf(
+				"%s: unexpected number of answers (got %d, want %d)",
+				test.desc,
+				len(r.Answer),
+				test.answers,
+			)
+		}
+	}
+}
+
+// answerSigned answers with an A record and its RRSIG, along with a NSEC
+// record in the authority section.
+func answerSigned(m *dns.Msg) *dns.Msg {
+	r := answerLocalhost(m)
+	name := m.Question[0].Name
+	r.Answer = append(r.Answer, &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+		TypeCovered: dns.TypeA,
+		Algorithm:   dns.ECDSAP256SHA256,
+		Labels:      3,
+		OrigTtl:     60,
+		SignerName:  "example.com.",
+		Signature:   "dGVzdA==",
+	})
+	r.Ns = append(r.Ns, &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+		NextDomain: "z." + name,
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	})
+	return r
+}
+
+var stripDNSSECTests = []struct {
+	desc        string
+	stripDNSSEC bool
+	do          bool
+	qtype       uint16
+	answers     []uint16
+	authority   int
+}{
+	{
+		desc:        "query without DO stripped",
+		stripDNSSEC: true,
+		do:          false,
+		qtype:       dns.TypeA,
+		answers:     []uint16{dns.TypeA},
+		authority:   0,
+	},
+	{
+		desc:        "query with DO kept",
+		stripDNSSEC: true,
+		do:          true,
+		qtype:       dns.TypeA,
+		answers:     []uint16{dns.TypeA, dns.TypeRRSIG},
+		authority:   1,
+	},
+	{
+		desc:        "RRSIG query kept",
+		stripDNSSEC: true,
+		do:          false,
+		qtype:       dns.TypeRRSIG,
+		answers:     []uint16{dns.TypeA, dns.TypeRRSIG},
+		authority:   0,
+	},
+	{
+		desc:        "stripping disabled",
+		stripDNSSEC: false,
+		do:          false,
+		qtype:       dns.TypeA,
+		answers:     []uint16{dns.TypeA, dns.TypeRRSIG},
+		authority:   1,
+	},
+}
+
+func TestStripDNSSEC(t *testing.T) {
+	for _, test := range stripDNSSECTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(answerSigned))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.StripDNSSEC = test.stripDNSSEC
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", test.qtype)
+		if test.do {
+			m.SetEdns0(4096, true)
+		}
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		rdata, _, err := database.Query(qdata)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if types := rrTypes(r.Answer); !equalTypes(types, test.answers) {
+			t.Errorf(
+				"%s: unexpected answer types (got %v, want %v)",
+				test.desc,
+				types,
+				test.answers,
+			)
+		}
+
+		if len(r.Ns) != test.authority {
+			t.Errorf(
+				"%s: unexpected number of authority records (got %d, want %d)",
+				test.desc,
+				len(r.Ns),
+				test.authority,
+			)
+		}
+	}
+}
+
+var slowQueryTests = []struct {
+	desc  string
+	delay time.Duration
+	slow  bool
+}{
+	{
+		desc:  "Fast query not logged",
+		delay: 0,
+		slow:  false,
+	},
+	{
+		desc:  "Slow query logged",
+		delay: 50 * time.Millisecond,
+		slow:  true,
+	},
+}
+
+func TestSlowQueryThreshold(t *testing.T) {
+	for _, test := range slowQueryTests {
+		exchanger := dohdns.NewMockExchanger(answerLocalhost)
+		exchanger.Delay = test.delay
+
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.SlowQueryThreshold = 20 * time.Millisecond
+
+		var buf bytes.Buffer
+		database.Logger = log.New(&buf, "", 0)
+
+		if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		logged := strings.Contains(buf.String(), "www.example.com. | slow query to 127.0.0.1 took ")
+		if logged != test.slow {
+			t.Errorf(
+				"%s: unexpected slow query log (got \"%s\", want logged %t)",
+				test.desc,
+				buf.String(),
+				test.slow,
+			)
+		}
+	}
+}
+
+var forceDOTests = []struct {
+	desc    string
+	edns0   bool
+	do      bool
+	answers []uint16
+}{
+	{
+		desc:    "query without EDNS0",
+		edns0:   false,
+		do:      false,
+		answers: []uint16{dns.TypeA},
+	},
+	{
+		desc:    "query without DO",
+		edns0:   true,
+		do:      false,
+		answers: []uint16{dns.TypeA},
+	},
+	{
+		desc:    "query with DO",
+		edns0:   true,
+		do:      true,
+		answers: []uint16{dns.TypeA, dns.TypeRRSIG},
+	},
+}
+
+func TestForceDO(t *testing.T) {
+	for _, test := range forceDOTests {
+		var upstreamDO bool
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(func(m *dns.Msg) *dns.Msg {
+			opt := m.IsEdns0()
+			upstreamDO = opt != nil && opt.Do()
+
+			r := answerSigned(m)
+			r.SetEdns0(4096, upstreamDO)
+			return r
+		}))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.ForceDO = true
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		if test.edns0 {
+			m.SetEdns0(4096, test.do)
+		}
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		rdata, _, err := database.Query(qdata)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		if !upstreamDO {
+			t.Errorf("%s: query passed on without the DO bit", test.desc)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if types := rrTypes(r.Answer); !equalTypes(types, test.answers) {
+			t.Errorf(
+				"%s: unexpected answer types (got %v, want %v)",
+				test.desc,
+				types,
+				test.answers,
+			)
+		}
+
+		opt := r.IsEdns0()
+		if (opt != nil) != test.edns0 || (opt != nil && opt.Do() != test.do) {
+			t.Errorf(
+				"%s: unexpected OPT record in response (got %v, want EDNS0 %t with DO %t)",
+				test.desc,
+				opt,
+				test.edns0,
+				test.do,
+			)
+		}
+	}
+}
+
+// answerWithoutQR answers like answerLocalhost but with the QR bit unset.
+func answerWithoutQR(m *dns.Msg) *dns.Msg {
+	r := answerLocalhost(m)
+	r.Response = false
+	return r
+}
+
+var validateQRTests = []struct {
+	desc       string
+	validateQR bool
+	handler    func(*dns.Msg) *dns.Msg
+	rcode      int
+}{
+	{
+		desc:       "QR set",
+		validateQR: true,
+		handler:    answerLocalhost,
+		rcode:      dns.RcodeSuccess,
+	},
+	{
+		desc:       "QR unset",
+		validateQR: true,
+		handler:    answerWithoutQR,
+		rcode:      dns.RcodeServerFailure,
+	},
+	{
+		desc:       "QR unset without validation",
+		validateQR: false,
+		handler:    answerWithoutQR,
+		rcode:      dns.RcodeSuccess,
+	},
+}
+
+func TestValidateQR(t *testing.T) {
+	for _, test := range validateQRTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(test.handler))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.ValidateQR = test.validateQR
+
+		rdata, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+	}
+}
+
+var validateQRCaseTests = []struct {
+	desc           string
+	randomizeCase  bool
+	lowercaseNames bool
+}{
+	{
+		desc:          "QR unset with randomized case",
+		randomizeCase: true,
+	},
+	{
+		desc:           "QR unset with lowercased names",
+		lowercaseNames: true,
+	},
+	{
+		desc:           "QR unset with lowercased and randomized names",
+		randomizeCase:  true,
+		lowercaseNames: true,
+	},
+}
+
+func TestValidateQRCase(t *testing.T) {
+	for _, test := range validateQRCaseTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(answerWithoutQR))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.ValidateQR = true
+		database.RandomizeCase = test.randomizeCase
+		database.LowercaseNames = test.lowercaseNames
+
+		rdata, _, err := database.Query(packQuery(t, "WWW.Example.COM.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != dns.RcodeServerFailure {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[dns.RcodeServerFailure],
+			)
+		}
+
+		if len(r.Question) != 1 || r.Question[0].Name != "WWW.Example.COM." {
+			t.Errorf("%s: question not restored (got %v, want WWW.Example.COM.)", test.desc, r.Question)
+		}
+	}
+}
+
+var compressThresholdTests = []struct {
+	desc       string
+	handler    func(*dns.Msg) *dns.Msg
+	compressed bool
+}{
+	{
+		desc:       "small response",
+		handler:    answerLocalhost,
+		compressed: false,
+	},
+	{
+		desc:       "large response",
+		handler:    answerLarge,
+		compressed: true,
+	},
+}
+
+func TestCompressThreshold(t *testing.T) {
+	for _, test := range compressThresholdTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(test.handler))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.CompressThreshold = 512
+
+		rdata, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		// Compare with the response packed both ways.
+		r.Compress = false
+		uncompressed, _ := r.Pack()
+		r.Compress = true
+		compressed, _ := r.Pack()
+
+		if len(compressed) >= len(uncompressed) {
+			t.Fatalf("%s: compression does not reduce the response size", test.desc)
+		}
+
+		want := len(uncompressed)
+		if test.compressed {
+			want = len(compressed)
+		}
+
+		if len(rdata) != want {
+			t.Errorf(
+				"%s: unexpected response size (got %d, want %d)",
+				test.desc,
+				len(rdata),
+				want,
+			)
+		}
+	}
+}
+
+// answerOtherQuestion answers with the question name replaced.
+func answerOtherQuestion(m *dns.Msg) *dns.Msg {
+	r := answerLocalhost(m)
+	r.Question[0].Name = "www.example.net."
+	return r
+}
+
+// answerOtherQtype answers with the question type replaced.
+func answerOtherQtype(m *dns.Msg) *dns.Msg {
+	r := answerLocalhost(m)
+	r.Question[0].Qtype = dns.TypeAAAA
+	return r
+}
+
+// answerUppercase answers with the question name in upper case.
+func answerUppercase(m *dns.Msg) *dns.Msg {
+	r := answerLocalhost(m)
+	r.Question[0].Name = strings.ToUpper(r.Question[0].Name)
+	return r
+}
+
+var verifyQuestionTests = []struct {
+	desc           string
+	verifyQuestion bool
+	handler        func(*dns.Msg) *dns.Msg
+	rcode          int
+}{
+	{
+		desc:           "Matching question",
+		verifyQuestion: true,
+		handler:        answerLocalhost,
+		rcode:          dns.RcodeSuccess,
+	},
+	{
+		desc:           "Question differing in case",
+		verifyQuestion: true,
+		handler:        answerUppercase,
+		rcode:          dns.RcodeSuccess,
+	},
+	{
+		desc:           "Different name",
+		verifyQuestion: true,
+		handler:        answerOtherQuestion,
+		rcode:          dns.RcodeServerFailure,
+	},
+	{
+		desc:           "Different type",
+		verifyQuestion: true,
+		handler:        answerOtherQtype,
+		rcode:          dns.RcodeServerFailure,
+	},
+	{
+		desc:           "Different name without verification",
+		verifyQuestion: false,
+		handler:        answerOtherQuestion,
+		rcode:          dns.RcodeSuccess,
+	},
+}
+
+func TestVerifyQuestion(t *testing.T) {
+	for _, test := range verifyQuestionTests {
+		database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(test.handler))
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.VerifyQuestion = test.verifyQuestion
+
+		rdata, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+	}
+}
+
+func TestLowercaseNames(t *testing.T) {
+	var names []string
+	exchanger := dohdns.NewMockExchanger(func(m *dns.Msg) *dns.Msg {
+		names = append(names, m.Question[0].Name)
+		return answerLocalhost(m)
+	})
+
+	proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestLowercaseNames: unable to instantiate NewProxy: %s", err)
+	}
+	proxy.LowercaseNames = true
+
+	database := dohdns.NewCache(proxy)
+
+	for _, name := range []string{"WWW.Example.COM.", "www.example.com."} {
+		rdata, _, err := database.Query(packQuery(t, name, dns.TypeA))
+		if err != nil {
+			t.Fatalf("TestLowercaseNames: unexpected error for %s: %s", name, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("TestLowercaseNames: unable to parse response for %s: %s", name, err)
+		}
+
+		if len(r.Question) != 1 || r.Question[0].Name != name {
+			t.Errorf("TestLowercaseNames: unexpected question (got %v, want %s)", r.Question, name)
+		}
+	}
+
+	// Both spellings are answered from the same cache entry.
+	if len(names) != 1 || names[0] != "www.example.com." {
+		t.Errorf("TestLowercaseNames: unexpected upstream queries (got %q, want %q)", names, []string{"www.example.com."})
+	}
+}
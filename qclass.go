@@ -0,0 +1,99 @@
+package dohdns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/http"
+)
+
+// QclassDatabase is implemented by databases answering other query classes
+// than IN, e.g. ChaosBackend. Unless WithQclasses is used HandleRequest
+// accepts the classes returned by Qclasses. Databases wrapping another
+// database implement it to report the classes of the wrapped one.
+type QclassDatabase interface {
+	Database
+	Qclasses() []uint16
+}
+
+// databaseQclasses returns the query classes answered by database.
+func databaseQclasses(database Database) []uint16 {
+	if qdb, ok := database.(QclassDatabase); ok {
+		return qdb.Qclasses()
+	}
+
+	return []uint16{dns.ClassINET}
+}
+
+// classResult returns the result for the query in qdata if its class is
+// not accepted. The result is nil if the class is accepted or the question
+// can not be read, which is left to the database.
+func (req *Request) classResult(qdata []byte) (*Result, error) {
+	m := questionMsg(qdata)
+	if m == nil {
+		return nil, nil
+	}
+
+	q := m.Question[0]
+	if req.acceptedClass(q.Qclass) {
+		return nil, nil
+	}
+
+	result := &Result{Question: &q}
+	err := fmt.Errorf("query class %s is not accepted", dns.ClassToString[q.Qclass])
+
+	if req.Opts.QclassForbidden {
+		result.Status = http.StatusForbidden
+		return result, err
+	}
+
+	result.Data, result.Status, err = reply(m, dns.RcodeRefused)
+
+	return result, err
+}
+
+// questionMsg returns a message holding only the header flags and the
+// question of the query in qdata, without parsing the rest of it. It
+// returns nil unless the query has exactly one question that can be read.
+func questionMsg(qdata []byte) *dns.Msg {
+	// The question follows the 12 byte header, the QDCOUNT is at offset 4.
+	if len(qdata) < 12 || binary.BigEndian.Uint16(qdata[4:6]) != 1 {
+		return nil
+	}
+
+	name, off, err := dns.UnpackDomainName(qdata, 12)
+	if err != nil || len(qdata) < off+4 {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint16(qdata[2:4])
+
+	m := new(dns.Msg)
+	m.Id = binary.BigEndian.Uint16(qdata[0:2])
+	m.Opcode = int(flags>>11) & 0xF
+	m.RecursionDesired = flags&(1<<8) != 0
+	m.CheckingDisabled = flags&(1<<4) != 0
+	m.Question = []dns.Question{{
+		Name:   name,
+		Qtype:  binary.BigEndian.Uint16(qdata[off : off+2]),
+		Qclass: binary.BigEndian.Uint16(qdata[off+2 : off+4]),
+	}}
+
+	return m
+}
+
+// acceptedClass reports whether queries of class qclass are accepted.
+func (req *Request) acceptedClass(qclass uint16) bool {
+	classes := req.Opts.Qclasses
+	if classes == nil {
+		classes = databaseQclasses(req.DB)
+	}
+
+	for _, c := range classes {
+		if c == qclass {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,150 @@
+package dohdns_test
+
+import (
+	"encoding/base64"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var qclassTests = []struct {
+	desc     string
+	database dohdns.Database
+	qclass   uint16
+	opts     []dohdns.Option
+	status   int
+	rcode    int
+}{
+	{
+		desc:     "IN query accepted",
+		database: answerDatabase{},
+		qclass:   dns.ClassINET,
+		status:   http.StatusOK,
+		rcode:    dns.RcodeSuccess,
+	},
+	{
+		desc:     "HS query refused",
+		database: answerDatabase{},
+		qclass:   dns.ClassHESIOD,
+		status:   http.StatusOK,
+		rcode:    dns.RcodeRefused,
+	},
+	{
+		desc:     "HS query forbidden",
+		database: answerDatabase{},
+		qclass:   dns.ClassHESIOD,
+		opts:     []dohdns.Option{dohdns.WithQclassForbidden()},
+		status:   http.StatusForbidden,
+		rcode:    -1,
+	},
+	{
+		desc:     "CH query refused without diagnostics",
+		database: answerDatabase{},
+		qclass:   dns.ClassCHAOS,
+		status:   http.StatusOK,
+		rcode:    dns.RcodeRefused,
+	},
+	{
+		desc:     "CH query accepted with diagnostics",
+		database: dohdns.NewChaos(answerDatabase{}, "test", "test"),
+		qclass:   dns.ClassCHAOS,
+		status:   http.StatusOK,
+		rcode:    dns.RcodeSuccess,
+	},
+	{
+		desc:     "CH query accepted with wrapped diagnostics",
+		database: dohdns.NewTimeout(dohdns.NewChaos(answerDatabase{}, "test", "test"), time.Second),
+		qclass:   dns.ClassCHAOS,
+		status:   http.StatusOK,
+		rcode:    dns.RcodeSuccess,
+	},
+	{
+		desc:     "CH query accepted with routed diagnostics",
+		database: dohdns.NewRouting(map[string]dohdns.Database{"bind.": dohdns.NewChaos(answerDatabase{}, "test", "test")}, answerDatabase{}),
+		qclass:   dns.ClassCHAOS,
+		status:   http.StatusOK,
+		rcode:    dns.RcodeSuccess,
+	},
+	{
+		desc:     "CH query accepted with qtype routed diagnostics",
+		database: dohdns.NewQtypeRouting(map[uint16]dohdns.Database{dns.TypeTXT: dohdns.NewChaos(answerDatabase{}, "test", "test")}, nil),
+		qclass:   dns.ClassCHAOS,
+		status:   http.StatusOK,
+		rcode:    dns.RcodeSuccess,
+	},
+	{
+		desc:     "CH query refused without routed diagnostics",
+		database: dohdns.NewRouting(map[string]dohdns.Database{"example.com.": answerDatabase{}}, answerDatabase{}),
+		qclass:   dns.ClassCHAOS,
+		status:   http.StatusOK,
+		rcode:    dns.RcodeRefused,
+	},
+	{
+		desc:     "CH query refused when not configured",
+		database: dohdns.NewChaos(answerDatabase{}, "test", "test"),
+		qclass:   dns.ClassCHAOS,
+		opts:     []dohdns.Option{dohdns.WithQclasses(dns.ClassINET)},
+		status:   http.StatusOK,
+		rcode:    dns.RcodeRefused,
+	},
+	{
+		desc:     "HS query accepted when configured",
+		database: answerDatabase{},
+		qclass:   dns.ClassHESIOD,
+		opts:     []dohdns.Option{dohdns.WithQclasses(dns.ClassINET, dns.ClassHESIOD)},
+		status:   http.StatusOK,
+		rcode:    dns.RcodeSuccess,
+	},
+}
+
+func TestQclasses(t *testing.T) {
+	for _, test := range qclassTests {
+		m := new(dns.Msg)
+		m.SetQuestion("version.bind.", dns.TypeTXT)
+		m.Question[0].Qclass = test.qclass
+		qdata, err := m.Pack()
+		if err != nil {
+			t.Fatalf("%s: unable to pack query: %s", test.desc, err)
+		}
+
+		req := httptest.NewRequest("GET", "https://example.com?dns="+base64.RawURLEncoding.EncodeToString(qdata), nil)
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(test.database, nil, test.opts...)
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if test.rcode < 0 {
+			continue
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		r := new(dns.Msg)
+		if err := r.Unpack(respBody); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package dohdns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+)
+
+// QtypeMetricsBackend wraps another Database and counts the queries passed
+// to it by type in Metrics, e.g. to see how A, AAAA and HTTPS queries are
+// distributed for capacity planning. Queries that can not be parsed are
+// not counted.
+type QtypeMetricsBackend struct {
+	Database Database
+
+	// Metrics, if set, collects the query counts.
+	Metrics *Metrics
+}
+
+// NewQtypeMetrics returns a new QtypeMetricsBackend wrapping database and
+// counting queries in metrics.
+func NewQtypeMetrics(database Database, metrics *Metrics) *QtypeMetricsBackend {
+	return &QtypeMetricsBackend{Database: database, Metrics: metrics}
+}
+
+// Query counts the query in qdata and passes it to the wrapped database.
+func (qb *QtypeMetricsBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := qb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details from the wrapped
+// database.
+func (qb *QtypeMetricsBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(qdata); err == nil && len(m.Question) == 1 && qb.Metrics != nil {
+		qb.Metrics.ObserveQtype(m.Question[0].Qtype)
+	}
+
+	return queryResult(ctx, qb.Database, qdata)
+}
+
+// Qclasses returns the query classes answered by the wrapped database.
+func (qb *QtypeMetricsBackend) Qclasses() []uint16 {
+	return databaseQclasses(qb.Database)
+}
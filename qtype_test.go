@@ -0,0 +1,61 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQtypeMetrics(t *testing.T) {
+	metrics := dohdns.NewMetrics()
+	database := dohdns.NewQtypeMetrics(answerDatabase{}, metrics)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeA, 65000} {
+		if _, _, err := database.Query(packQuery(t, "www.example.com.", qtype)); err != nil {
+			t.Fatalf("TestQtypeMetrics: unexpected error: %s", err)
+		}
+	}
+
+	qtypes := metrics.Qtypes()
+
+	for name, want := range map[string]uint64{"A": 2, "AAAA": 1, "OTHER": 1, "HTTPS": 0} {
+		if qtypes[name] != want {
+			t.Errorf("TestQtypeMetrics: unexpected count for %s (got %d, want %d)", name, qtypes[name], want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	dohdns.MetricsHandler(metrics).ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/metrics", nil))
+
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE dohdns_queries_total counter",
+		"dohdns_queries_total{qtype=\"A\"} 2",
+		"dohdns_queries_total{qtype=\"AAAA\"} 1",
+		"dohdns_queries_total{qtype=\"OTHER\"} 1",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("TestQtypeMetrics: missing line \"%s\" in:\n%s", line, body)
+		}
+	}
+}
+
+func TestQtypeMetricsZeroValue(t *testing.T) {
+	var metrics dohdns.Metrics
+
+	for _, database := range []*dohdns.QtypeMetricsBackend{
+		dohdns.NewQtypeMetrics(answerDatabase{}, &metrics),
+		dohdns.NewQtypeMetrics(answerDatabase{}, nil),
+	} {
+		if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+			t.Fatalf("TestQtypeMetricsZeroValue: unexpected error: %s", err)
+		}
+	}
+
+	if count := metrics.Qtypes()["A"]; count != 1 {
+		t.Errorf("TestQtypeMetricsZeroValue: unexpected count for A (got %d, want %d)", count, 1)
+	}
+}
@@ -0,0 +1,167 @@
+package dohdns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bucket is the token bucket of a client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the rate of requests per client address using a
+// token bucket: each client may send Burst requests at once, refilled at
+// Rate requests per second. Requests exceeding the limit get a 429 Too
+// Many Requests response. It is safe for concurrent use.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	// Refused answers requests exceeding the limit with a DNS response
+	// with RCODE REFUSED instead, when the query can be parsed, as
+	// clients only parsing DNS can not interpret a 429 response.
+	Refused bool
+
+	// TrustedProxies lists the networks of proxies whose X-Forwarded-For
+	// header is used to find the client address.
+	TrustedProxies []*net.IPNet
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter returns a new RateLimiter allowing rate requests per
+// second with bursts of burst requests per client.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst}
+}
+
+// Handler wraps handler so that only requests within the rate limit are
+// passed on.
+func (rl *RateLimiter) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var client string
+		if ip := clientIP(r, rl.TrustedProxies); ip != nil {
+			client = ip.String()
+		}
+
+		if rl.allow(client, time.Now()) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if rl.Refused {
+			if rdata := refusedQuery(r); rdata != nil {
+				w.Header().Set("Content-Type", mimeType)
+				w.Write(rdata)
+				return
+			}
+		}
+
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	})
+}
+
+// allow reports whether a request from client at now is within the rate
+// limit, taking a token from its bucket if so.
+func (rl *RateLimiter) allow(client string, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.buckets == nil {
+		rl.buckets = map[string]*bucket{}
+	}
+
+	// Forget clients whose buckets have been refilled, so the map does
+	// not grow without bounds.
+	if now.Sub(rl.lastSweep) > time.Minute {
+		for c, b := range rl.buckets {
+			if rl.refill(b, now) >= float64(rl.Burst) {
+				delete(rl.buckets, c)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(rl.Burst), last: now}
+		rl.buckets[client] = b
+	}
+
+	b.tokens = rl.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// refill returns the tokens in b at now, capped at Burst.
+func (rl *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.Rate
+	if tokens > float64(rl.Burst) {
+		tokens = float64(rl.Burst)
+	}
+
+	return tokens
+}
+
+// refusedQuery returns a packed REFUSED response to the query in r, or
+// nil if there is no query that can be parsed.
+func refusedQuery(r *http.Request) []byte {
+	m := requestQuery(r)
+	if m == nil {
+		return nil
+	}
+
+	rdata, _, err := reply(m, dns.RcodeRefused)
+	if err != nil {
+		return nil
+	}
+
+	return rdata
+}
+
+// requestQuery returns the query in r, or nil if there is none that can be
+// parsed. The body of POST requests is replaced, so it can be read again
+// in full.
+func requestQuery(r *http.Request) *dns.Msg {
+	var qdata []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		qdata, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		qdata, err = ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		body := r.Body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(qdata), body), body}
+	}
+	if err != nil || len(qdata) == 0 {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	if m.Unpack(qdata) != nil || len(m.Question) != 1 {
+		return nil
+	}
+
+	return m
+}
@@ -0,0 +1,121 @@
+package dohdns_test
+
+import (
+	"bytes"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var rateLimitTests = []struct {
+	desc            string
+	refused         bool
+	method          string
+	status          int
+	respContentType string
+	rcode           int
+}{
+	{
+		desc:            "Limit exceeded",
+		refused:         false,
+		method:          "GET",
+		status:          http.StatusTooManyRequests,
+		respContentType: "text/plain; charset=utf-8",
+	},
+	{
+		desc:            "Limit exceeded in DNS mode with GET",
+		refused:         true,
+		method:          "GET",
+		status:          http.StatusOK,
+		respContentType: "application/dns-udpwireformat",
+		rcode:           dns.RcodeRefused,
+	},
+	{
+		desc:            "Limit exceeded in DNS mode with POST",
+		refused:         true,
+		method:          "POST",
+		status:          http.StatusOK,
+		respContentType: "application/dns-udpwireformat",
+		rcode:           dns.RcodeRefused,
+	},
+}
+
+func TestRateLimiter(t *testing.T) {
+	qdata := []byte{0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x77, 0x77, 0x77, 0x7, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x3, 0x63, 0x6f, 0x6d, 0x0, 0x0, 0x1, 0x0, 0x1}
+
+	for _, test := range rateLimitTests {
+		// A single request is allowed, refilled very slowly.
+		limiter := dohdns.NewRateLimiter(0.001, 1)
+		limiter.Refused = test.refused
+		handler := limiter.Handler(dohdns.HandleRequest(answerDatabase{}, nil))
+
+		for i := 0; i < 2; i++ {
+			var req *http.Request
+			switch test.method {
+			case "POST":
+				req = httptest.NewRequest(test.method, "https://example.com", bytes.NewReader(qdata))
+				req.Header.Set("Content-Type", "application/dns-udpwireformat")
+			default:
+				req = httptest.NewRequest(test.method, "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			resp := w.Result()
+			respBody, _ := ioutil.ReadAll(resp.Body)
+
+			if i == 0 {
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf(
+						"%s: unexpected status code for first request (got %d, want %d)",
+						test.desc,
+						resp.StatusCode,
+						http.StatusOK,
+					)
+				}
+				continue
+			}
+
+			if resp.StatusCode != test.status {
+				t.Errorf(
+					"%s: unexpected status code (got %d, want %d)",
+					test.desc,
+					resp.StatusCode,
+					test.status,
+				)
+			}
+
+			if resp.Header.Get("Content-Type") != test.respContentType {
+				t.Errorf(
+					"%s: unexpected Content-Type (got \"%s\", want \"%s\")",
+					test.desc,
+					resp.Header.Get("Content-Type"),
+					test.respContentType,
+				)
+			}
+
+			if !test.refused {
+				continue
+			}
+
+			r := new(dns.Msg)
+			if err := r.Unpack(respBody); err != nil {
+				t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+			}
+
+			if r.Rcode != test.rcode || len(r.Answer) != 0 {
+				t.Errorf(
+					"%s: unexpected response (got %s with %d answers, want %s)",
+					test.desc,
+					dns.RcodeToString[r.Rcode],
+					len(r.Answer),
+					dns.RcodeToString[test.rcode],
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package dohdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// NewReply returns a response to the query req with the given rcode and
+// answers. The ID, opcode and the RD and CD flags are copied from req, the
+// QR flag is set and the question section is copied.
+func NewReply(req *dns.Msg, rcode int, answers ...dns.RR) *dns.Msg {
+	r := new(dns.Msg)
+	r.Id = req.Id
+	r.Response = true
+	r.Opcode = req.Opcode
+	r.RecursionDesired = req.RecursionDesired
+	r.CheckingDisabled = req.CheckingDisabled
+	r.Rcode = rcode
+
+	if len(req.Question) > 0 {
+		r.Question = make([]dns.Question, len(req.Question))
+		copy(r.Question, req.Question)
+	}
+
+	r.Answer = append(r.Answer, answers...)
+
+	return r
+}
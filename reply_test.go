@@ -0,0 +1,99 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+var newReplyTests = []struct {
+	desc    string
+	rcode   int
+	rd      bool
+	cd      bool
+	answers []dns.RR
+}{
+	{
+		desc:  "NXDOMAIN without answers",
+		rcode: dns.RcodeNameError,
+		rd:    true,
+	},
+	{
+		desc:  "REFUSED with CD set",
+		rcode: dns.RcodeRefused,
+		cd:    true,
+	},
+	{
+		desc:  "NOERROR with answer",
+		rcode: dns.RcodeSuccess,
+		rd:    true,
+		answers: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("127.0.0.1"),
+		}},
+	},
+}
+
+func TestNewReply(t *testing.T) {
+	for _, test := range newReplyTests {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.RecursionDesired = test.rd
+		req.CheckingDisabled = test.cd
+
+		r := dohdns.NewReply(req, test.rcode, test.answers...)
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		if r.Id != req.Id || !r.Response || r.Opcode != req.Opcode {
+			t.Errorf(
+				"%s: unexpected header (got %s)",
+				test.desc,
+				r.MsgHdr.String(),
+			)
+		}
+
+		if r.RecursionDesired != test.rd || r.CheckingDisabled != test.cd {
+			t.Errorf(
+				"%s: flags not copied (got RD %t CD %t, want RD %t CD %t)",
+				test.desc,
+				r.RecursionDesired,
+				r.CheckingDisabled,
+				test.rd,
+				test.cd,
+			)
+		}
+
+		if len(r.Question) != 1 || r.Question[0] != req.Question[0] {
+			t.Errorf(
+				"%s: unexpected question (got %v, want %v)",
+				test.desc,
+				r.Question,
+				req.Question,
+			)
+		}
+
+		if len(r.Answer) != len(test.answers) {
+			t.Errorf(
+				"%s: unexpected number of answers (got %d, want %d)",
+				test.desc,
+				len(r.Answer),
+				len(test.answers),
+			)
+		}
+
+		// The question must be a copy.
+		r.Question[0].Name = "other.example.com."
+		if req.Question[0].Name != "www.example.com." {
+			t.Errorf("%s: question section of the query was modified", test.desc)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+
+package dohdns
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortSupported reports whether SO_REUSEPORT can be set.
+const reusePortSupported = false
+
+// reusePortControl is never used on platforms without SO_REUSEPORT.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("Server: ReusePort is not supported on this platform")
+}
@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+
+package dohdns
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// reusePortSupported reports whether SO_REUSEPORT can be set.
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT on the socket of a listener.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
@@ -0,0 +1,193 @@
+package dohdns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net/http"
+	"sort"
+)
+
+// RoutingBackend dispatches queries to different backends based on the
+// query name, e.g. to send internal domains to an internal resolver and
+// everything else to a public one.
+type RoutingBackend struct {
+	routes   map[string]Database
+	fallback Database
+}
+
+// NewRouting returns a new RoutingBackend. The keys of routes are domain
+// suffixes, a query is passed to the backend of the longest suffix
+// matching the query name. Queries not matching any suffix are passed to
+// fallback, or REFUSED if fallback is nil.
+func NewRouting(routes map[string]Database, fallback Database) *RoutingBackend {
+	rb := &RoutingBackend{
+		routes:   map[string]Database{},
+		fallback: fallback,
+	}
+
+	for suffix, database := range routes {
+		rb.routes[dns.CanonicalName(suffix)] = database
+	}
+
+	return rb
+}
+
+// Query passes qdata on to the backend responsible for the query name.
+func (rb *RoutingBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := rb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details from the backend
+// the query is passed to.
+func (rb *RoutingBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil {
+		return &Result{Status: http.StatusBadRequest}, classify(ErrInvalidMessage, err)
+	}
+
+	database := rb.fallback
+	if len(m.Question) > 0 {
+		if d := rb.route(dns.CanonicalName(m.Question[0].Name)); d != nil {
+			database = d
+		}
+	}
+
+	if database == nil {
+		return refusedResult(m)
+	}
+
+	return queryResult(ctx, database, qdata)
+}
+
+// refusedResult returns the result refusing the query m.
+func refusedResult(m *dns.Msg) (*Result, error) {
+	result := &Result{}
+	if len(m.Question) > 0 {
+		q := m.Question[0]
+		result.Question = &q
+	}
+
+	rdata, httpStatus, err := reply(m, dns.RcodeRefused)
+	result.Data, result.Status = rdata, httpStatus
+
+	return result, err
+}
+
+// Qclasses returns the query classes answered by any of the routes or the
+// fallback.
+func (rb *RoutingBackend) Qclasses() []uint16 {
+	databases := []Database{rb.fallback}
+	for _, database := range rb.routes {
+		databases = append(databases, database)
+	}
+
+	return unionQclasses(databases)
+}
+
+// unionQclasses returns the query classes answered by any of databases,
+// ignoring nil databases.
+func unionQclasses(databases []Database) []uint16 {
+	var classes []uint16
+	seen := map[uint16]bool{}
+
+	for _, database := range databases {
+		if database == nil {
+			continue
+		}
+		for _, class := range databaseQclasses(database) {
+			if !seen[class] {
+				seen[class] = true
+				classes = append(classes, class)
+			}
+		}
+	}
+
+	sort.Slice(classes, func(i, j int) bool { return classes[i] < classes[j] })
+
+	return classes
+}
+
+// route returns the backend of the longest suffix matching name, or nil.
+func (rb *RoutingBackend) route(name string) Database {
+	// dns.Split returns the label offsets from the left, so the first
+	// match is the longest suffix.
+	for _, off := range dns.Split(name) {
+		if database, ok := rb.routes[name[off:]]; ok {
+			return database
+		}
+	}
+
+	if database, ok := rb.routes["."]; ok {
+		return database
+	}
+
+	return nil
+}
+
+// QtypeRoutingBackend dispatches queries to different backends based on
+// the query type, e.g. to send PTR queries to a resolver for the reverse
+// zones and everything else to a public one.
+type QtypeRoutingBackend struct {
+	routes   map[uint16]Database
+	fallback Database
+}
+
+// NewQtypeRouting returns a new QtypeRoutingBackend. Queries are passed to
+// the backend of their type in routes, other queries are passed to
+// fallback, or REFUSED if fallback is nil.
+func NewQtypeRouting(routes map[uint16]Database, fallback Database) *QtypeRoutingBackend {
+	qb := &QtypeRoutingBackend{
+		routes:   map[uint16]Database{},
+		fallback: fallback,
+	}
+
+	for qtype, database := range routes {
+		qb.routes[qtype] = database
+	}
+
+	return qb
+}
+
+// Query passes qdata on to the backend responsible for the query type.
+func (qb *QtypeRoutingBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := qb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details from the backend
+// the query is passed to.
+func (qb *QtypeRoutingBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil {
+		return &Result{Status: http.StatusBadRequest}, classify(ErrInvalidMessage, err)
+	}
+
+	database := qb.fallback
+	if len(m.Question) > 0 {
+		if d, ok := qb.routes[m.Question[0].Qtype]; ok {
+			database = d
+		}
+	}
+
+	if database == nil {
+		return refusedResult(m)
+	}
+
+	return queryResult(ctx, database, qdata)
+}
+
+// Qclasses returns the query classes answered by any of the routes or the
+// fallback.
+func (qb *QtypeRoutingBackend) Qclasses() []uint16 {
+	databases := []Database{qb.fallback}
+	for _, database := range qb.routes {
+		databases = append(databases, database)
+	}
+
+	return unionQclasses(databases)
+}
@@ -0,0 +1,279 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// namedDatabase answers every query with an empty reply and records the
+// names of the queries it has seen.
+type namedDatabase struct {
+	names []string
+}
+
+func (d *namedDatabase) Query(qdata []byte) ([]byte, int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(qdata); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	d.names = append(d.names, m.Question[0].Name)
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	rdata, err := r.Pack()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return rdata, http.StatusOK, nil
+}
+
+var routingTests = []struct {
+	desc    string
+	qname   string
+	backend string
+}{
+	{
+		desc:    "Routed suffix apex",
+		qname:   "corp.example.",
+		backend: "corp",
+	},
+	{
+		desc:    "Routed suffix child",
+		qname:   "www.corp.example.",
+		backend: "corp",
+	},
+	{
+		desc:    "Longest suffix wins",
+		qname:   "host.lab.corp.example.",
+		backend: "lab",
+	},
+	{
+		desc:    "Case insensitive match",
+		qname:   "WWW.Corp.Example.",
+		backend: "corp",
+	},
+	{
+		desc:    "Similar but different suffix",
+		qname:   "notcorp.example.",
+		backend: "default",
+	},
+	{
+		desc:    "Everything else",
+		qname:   "www.example.com.",
+		backend: "default",
+	},
+}
+
+func TestRouting(t *testing.T) {
+	for _, test := range routingTests {
+		backends := map[string]*namedDatabase{
+			"corp":    {},
+			"lab":     {},
+			"default": {},
+		}
+
+		database := dohdns.NewRouting(
+			map[string]dohdns.Database{
+				"corp.example":      backends["corp"],
+				"lab.corp.example.": backends["lab"],
+			},
+			backends["default"],
+		)
+
+		if _, _, err := database.Query(packQuery(t, test.qname, dns.TypeA)); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		for name, backend := range backends {
+			want := 0
+			if name == test.backend {
+				want = 1
+			}
+			if len(backend.names) != want {
+				t.Errorf(
+					"%s: unexpected number of queries to %s backend (got %d, want %d)",
+					test.desc,
+					name,
+					len(backend.names),
+					want,
+				)
+			}
+		}
+	}
+}
+
+func TestRoutingWithoutFallback(t *testing.T) {
+	database := dohdns.NewRouting(map[string]dohdns.Database{"corp.example.": &namedDatabase{}}, nil)
+
+	rdata, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("TestRoutingWithoutFallback: unexpected error: %s", err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestRoutingWithoutFallback: unable to parse response: %s", err)
+	}
+
+	if r.Rcode != dns.RcodeRefused {
+		t.Errorf(
+			"TestRoutingWithoutFallback: unexpected rcode (got %s, want %s)",
+			dns.RcodeToString[r.Rcode],
+			dns.RcodeToString[dns.RcodeRefused],
+		)
+	}
+}
+
+func TestRoutingUpstreamOverride(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("TestRoutingUpstreamOverride: unable to parse CIDR: %s", err)
+	}
+
+	exchanger := newAddressExchanger()
+	proxy, err := dohdns.NewProxy([]string{"192.0.2.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestRoutingUpstreamOverride: unable to instantiate NewProxy: %s", err)
+	}
+	proxy.AllowUpstreamOverride = true
+
+	database := dohdns.NewRouting(map[string]dohdns.Database{"example.com.": proxy}, nil)
+
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+	req.RemoteAddr = "192.0.2.10:1234"
+	req.Header.Set("X-DoH-Upstream", "192.0.2.53")
+	w := httptest.NewRecorder()
+
+	handler := dohdns.HandleRequest(database, nil, dohdns.WithUpstreamOverride("X-DoH-Upstream", trusted), dohdns.WithUpstreamServerHeader())
+	handler.ServeHTTP(w, req)
+
+	if exchanger.count("192.0.2.53:53") != 1 || exchanger.count("192.0.2.1:53") != 0 {
+		t.Errorf("TestRoutingUpstreamOverride: query not sent to the override through the router")
+	}
+
+	if upstream := w.Result().Header.Get("X-Upstream-Server"); upstream != "192.0.2.53" {
+		t.Errorf("TestRoutingUpstreamOverride: unexpected upstream reported (got \"%s\", want \"192.0.2.53\")", upstream)
+	}
+}
+
+var qtypeRoutingTests = []struct {
+	desc    string
+	qname   string
+	qtype   uint16
+	backend string
+}{
+	{
+		desc:    "PTR query",
+		qname:   "1.2.0.192.in-addr.arpa.",
+		qtype:   dns.TypePTR,
+		backend: "reverse",
+	},
+	{
+		desc:    "A query",
+		qname:   "www.example.com.",
+		qtype:   dns.TypeA,
+		backend: "forward",
+	},
+	{
+		desc:    "Other query",
+		qname:   "www.example.com.",
+		qtype:   dns.TypeMX,
+		backend: "default",
+	},
+}
+
+func TestQtypeRouting(t *testing.T) {
+	for _, test := range qtypeRoutingTests {
+		backends := map[string]*namedDatabase{
+			"reverse": {},
+			"forward": {},
+			"default": {},
+		}
+
+		database := dohdns.NewQtypeRouting(
+			map[uint16]dohdns.Database{
+				dns.TypePTR: backends["reverse"],
+				dns.TypeA:   backends["forward"],
+			},
+			backends["default"],
+		)
+
+		if _, _, err := database.Query(packQuery(t, test.qname, test.qtype)); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		for name, backend := range backends {
+			want := 0
+			if name == test.backend {
+				want = 1
+			}
+			if len(backend.names) != want {
+				t.Errorf(
+					"%s: unexpected number of queries to %s backend (got %d, want %d)",
+					test.desc,
+					name,
+					len(backend.names),
+					want,
+				)
+			}
+		}
+	}
+}
+
+func TestQtypeRoutingWithoutFallback(t *testing.T) {
+	database := dohdns.NewQtypeRouting(map[uint16]dohdns.Database{dns.TypePTR: &namedDatabase{}}, nil)
+
+	rdata, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("TestQtypeRoutingWithoutFallback: unexpected error: %s", err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("TestQtypeRoutingWithoutFallback: unable to parse response: %s", err)
+	}
+
+	if r.Rcode != dns.RcodeRefused {
+		t.Errorf(
+			"TestQtypeRoutingWithoutFallback: unexpected rcode (got %s, want %s)",
+			dns.RcodeToString[r.Rcode],
+			dns.RcodeToString[dns.RcodeRefused],
+		)
+	}
+}
+
+func TestQtypeRoutingUpstreamOverride(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("TestQtypeRoutingUpstreamOverride: unable to parse CIDR: %s", err)
+	}
+
+	exchanger := newAddressExchanger()
+	proxy, err := dohdns.NewProxy([]string{"192.0.2.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestQtypeRoutingUpstreamOverride: unable to instantiate NewProxy: %s", err)
+	}
+	proxy.AllowUpstreamOverride = true
+
+	database := dohdns.NewQtypeRouting(map[uint16]dohdns.Database{dns.TypeA: proxy}, nil)
+
+	req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+	req.RemoteAddr = "192.0.2.10:1234"
+	req.Header.Set("X-DoH-Upstream", "192.0.2.53")
+	w := httptest.NewRecorder()
+
+	handler := dohdns.HandleRequest(database, nil, dohdns.WithUpstreamOverride("X-DoH-Upstream", trusted), dohdns.WithUpstreamServerHeader())
+	handler.ServeHTTP(w, req)
+
+	if exchanger.count("192.0.2.53:53") != 1 || exchanger.count("192.0.2.1:53") != 0 {
+		t.Errorf("TestQtypeRoutingUpstreamOverride: query not sent to the override through the router")
+	}
+
+	if upstream := w.Result().Header.Get("X-Upstream-Server"); upstream != "192.0.2.53" {
+		t.Errorf("TestQtypeRoutingUpstreamOverride: unexpected upstream reported (got \"%s\", want \"192.0.2.53\")", upstream)
+	}
+}
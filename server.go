@@ -0,0 +1,256 @@
+package dohdns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Server wraps an http.Server and makes the transport used for serving
+// DNS API requests explicit.
+//
+// When TLS is false the server speaks plain HTTP, which is useful when TLS
+// is terminated by a proxy in front of the application. When TLS is true
+// CertFile and KeyFile must point to the certificate and matching key,
+// unless certificates are obtained automatically using Autocert.
+//
+// Network selects the kind of listener created by ListenAndServe, either
+// "tcp" (the default) or "unix". For "unix" Addr is the path of the socket,
+// which is useful when a local TLS terminator forwards requests over a
+// Unix domain socket.
+type Server struct {
+	Network  string
+	Addr     string
+	Handler  http.Handler
+	TLS      bool
+	CertFile string
+	KeyFile  string
+
+	// ReusePort sets SO_REUSEPORT on TCP listeners, allowing several
+	// processes to share a port, e.g. for zero-downtime restarts. It is
+	// only supported on some platforms, ListenAndServe returns an error
+	// elsewhere.
+	ReusePort bool
+
+	// HTTP3 makes ListenAndServe also serve HTTP/3 over QUIC on the UDP
+	// port matching the TCP listener. It requires TLS and building with
+	// the http3 tag, which pulls in github.com/quic-go/quic-go.
+	HTTP3 bool
+
+	// Autocert, if set, obtains certificates from Let's Encrypt for the
+	// allowed hosts instead of loading them from CertFile and KeyFile.
+	// It requires TLS.
+	Autocert *AutocertConfig
+
+	// MinVersion is the minimum TLS version accepted, e.g.
+	// tls.VersionTLS13. The default is TLS 1.2.
+	MinVersion uint16
+
+	// CipherSuites, if set, lists the cipher suites allowed for TLS 1.2
+	// and earlier, see tls.Config.CipherSuites. TLS 1.3 cipher suites are
+	// not configurable.
+	CipherSuites []uint16
+
+	once sync.Once
+	srv  *http.Server
+	h3   http3State
+}
+
+// AutocertConfig configures obtaining certificates automatically using
+// ACME, see golang.org/x/crypto/acme/autocert.
+type AutocertConfig struct {
+	// Hosts lists the host names certificates are requested for, other
+	// names are rejected.
+	Hosts []string
+
+	// CacheDir is the directory certificates are stored in, so they
+	// survive restarts. Without it certificates are only kept in memory.
+	CacheDir string
+
+	// Email is the optional contact address for the ACME account.
+	Email string
+}
+
+// manager returns the autocert.Manager for the configuration.
+func (c *AutocertConfig) manager() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Hosts...),
+		Email:      c.Email,
+	}
+	if c.CacheDir != "" {
+		m.Cache = autocert.DirCache(c.CacheDir)
+	}
+
+	return m
+}
+
+// httpServer returns the underlying http.Server, creating it on first use.
+func (s *Server) httpServer() *http.Server {
+	s.once.Do(func() {
+		s.srv = &http.Server{Addr: s.Addr, Handler: s.altSvcHandler(s.Handler)}
+		if s.TLS {
+			s.srv.TLSConfig = s.tlsConfig()
+		}
+	})
+	return s.srv
+}
+
+// tlsConfig returns the TLS configuration for serving with TLS.
+func (s *Server) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if s.Autocert != nil {
+		config = s.Autocert.manager().TLSConfig()
+	}
+
+	config.MinVersion = s.MinVersion
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	config.CipherSuites = s.CipherSuites
+
+	return config
+}
+
+// TLSConfig returns the TLS configuration of the underlying http.Server.
+// It is nil unless TLS is enabled. Certificates in CertFile and KeyFile are
+// only loaded when serving.
+func (s *Server) TLSConfig() *tls.Config {
+	return s.httpServer().TLSConfig
+}
+
+// ListenAndServe listens on s.Addr and serves requests, using TLS if
+// configured. If s.Addr is empty ":https" or ":http" is used depending on
+// the transport.
+func (s *Server) ListenAndServe() error {
+	l, err := s.Listen()
+	if err != nil {
+		return err
+	}
+
+	if !s.HTTP3 {
+		return s.Serve(l)
+	}
+
+	conn, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	// Both servers keep running until Shutdown, the first error is
+	// returned.
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServeHTTP3(conn) }()
+	go func() { errs <- s.Serve(l) }()
+
+	return <-errs
+}
+
+// Listen creates the listener used by ListenAndServe, which can be passed
+// to Serve.
+func (s *Server) Listen() (net.Listener, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	addr := s.Addr
+	if addr == "" && network != "unix" {
+		if s.TLS {
+			addr = ":https"
+		} else {
+			addr = ":http"
+		}
+	}
+
+	var lc net.ListenConfig
+	if s.ReusePort && network != "unix" {
+		lc.Control = reusePortControl
+	}
+
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// Serve accepts incoming connections on the listener l, using TLS if
+// configured.
+func (s *Server) Serve(l net.Listener) error {
+	if err := s.validate(); err != nil {
+		l.Close()
+		return err
+	}
+
+	srv := s.httpServer()
+
+	if s.TLS && s.Autocert != nil {
+		return srv.ServeTLS(l, "", "")
+	}
+
+	if s.TLS {
+		return srv.ServeTLS(l, s.CertFile, s.KeyFile)
+	}
+
+	return srv.Serve(l)
+}
+
+// Shutdown gracefully shuts down the server, see http.Server.Shutdown. The
+// HTTP/3 server, if any, is closed as well, the errors of both are joined.
+func (s *Server) Shutdown(ctx context.Context) error {
+	h3err := s.closeHTTP3()
+
+	return errors.Join(h3err, s.httpServer().Shutdown(ctx))
+}
+
+// validate makes sure the transport settings are consistent.
+func (s *Server) validate() error {
+	if s.TLS && s.Autocert == nil && (s.CertFile == "" || s.KeyFile == "") {
+		return errors.New("Server: CertFile and KeyFile are required when TLS is enabled")
+	}
+
+	if s.Autocert != nil {
+		if !s.TLS {
+			return errors.New("Server: Autocert requires TLS")
+		}
+		if len(s.Autocert.Hosts) == 0 {
+			return errors.New("Server: Autocert requires at least one host")
+		}
+	}
+
+	switch s.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	case "unix":
+		if s.Addr == "" {
+			return errors.New("Server: Addr is required for unix sockets")
+		}
+	default:
+		return fmt.Errorf("Server: unsupported network %q", s.Network)
+	}
+
+	if s.HTTP3 && !s.TLS {
+		return errors.New("Server: HTTP3 requires TLS")
+	}
+
+	// QUIC needs a UDP port matching the TCP listener.
+	if s.HTTP3 && s.Network == "unix" {
+		return errors.New("Server: HTTP3 is not supported on unix sockets")
+	}
+
+	if s.HTTP3 && !http3Supported {
+		return errHTTP3Unsupported
+	}
+
+	if s.ReusePort && !reusePortSupported {
+		return errors.New("Server: ReusePort is not supported on this platform")
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+//go:build http3
+
+package dohdns
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/quic-go/quic-go/http3"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// http3Supported reports whether the package is built with HTTP/3 support.
+const http3Supported = true
+
+// errHTTP3Unsupported is never returned when built with HTTP/3 support.
+var errHTTP3Unsupported = errors.New("Server: HTTP/3 is not supported")
+
+// http3State holds the HTTP/3 server, created on first use.
+type http3State struct {
+	mu  sync.Mutex
+	srv *http3.Server
+}
+
+// ServeHTTP3 serves HTTP/3 requests on conn using the certificate in
+// CertFile and KeyFile, or obtained using Autocert. It can be used to serve
+// HTTP/3 instead of, or in addition to, HTTP/1.1 and HTTP/2. While it is
+// serving, responses of the HTTP/1.1 and HTTP/2 server carry an Alt-Svc
+// header advertising the port of conn.
+func (s *Server) ServeHTTP3(conn net.PacketConn) error {
+	srv, err := s.http3Server()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	return srv.Serve(conn)
+}
+
+// altSvcHandler returns handler setting the Alt-Svc header advertising
+// the HTTP/3 server while it is serving, so clients of the HTTP/1.1 and
+// HTTP/2 server can discover it.
+func (s *Server) altSvcHandler(handler http.Handler) http.Handler {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.h3.mu.Lock()
+		srv := s.h3.srv
+		s.h3.mu.Unlock()
+
+		if srv != nil {
+			// This fails if no port is being served, there is
+			// nothing to advertise then.
+			srv.SetQUICHeaders(w.Header())
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// http3Server returns the HTTP/3 server, creating it on first use.
+func (s *Server) http3Server() (*http3.Server, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	if !s.TLS {
+		return nil, errors.New("Server: HTTP3 requires TLS")
+	}
+
+	s.h3.mu.Lock()
+	defer s.h3.mu.Unlock()
+
+	if s.h3.srv == nil {
+		config := &tls.Config{}
+		if s.Autocert != nil {
+			// Share the certificates of the TCP server.
+			config.GetCertificate = s.TLSConfig().GetCertificate
+		} else {
+			cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+
+		s.h3.srv = &http3.Server{
+			Handler:   s.Handler,
+			TLSConfig: http3.ConfigureTLSConfig(config),
+		}
+	}
+
+	return s.h3.srv, nil
+}
+
+// closeHTTP3 closes the HTTP/3 server if it has been started.
+func (s *Server) closeHTTP3() error {
+	s.h3.mu.Lock()
+	defer s.h3.mu.Unlock()
+
+	if s.h3.srv == nil {
+		return nil
+	}
+
+	return s.h3.srv.Close()
+}
@@ -0,0 +1,158 @@
+//go:build http3
+
+package dohdns_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/eest/dohdns"
+	"github.com/quic-go/quic-go/http3"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to dir, returning the file names and a pool trusting it.
+func writeCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %s", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	return certFile, keyFile, pool
+}
+
+func TestServerHTTP3(t *testing.T) {
+	certFile, keyFile, pool := writeCertificate(t, t.TempDir())
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestServerHTTP3: unable to listen: %s", err)
+	}
+
+	srv := &dohdns.Server{
+		Handler:  dohdns.HandleRequest(answerDatabase{}, nil),
+		TLS:      true,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	go srv.ServeHTTP3(conn)
+	defer srv.Shutdown(context.Background())
+
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer transport.Close()
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	resp, err := client.Get("https://" + conn.LocalAddr().String() + "/?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB")
+	if err != nil {
+		t.Fatalf("TestServerHTTP3: GET request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf(
+			"TestServerHTTP3: unexpected status code (got %d, want %d)",
+			resp.StatusCode,
+			http.StatusOK,
+		)
+	}
+
+	if resp.ProtoMajor != 3 {
+		t.Errorf(
+			"TestServerHTTP3: unexpected protocol (got \"%s\", want HTTP/3)",
+			resp.Proto,
+		)
+	}
+}
+
+func TestServerHTTP3AltSvc(t *testing.T) {
+	certFile, keyFile, pool := writeCertificate(t, t.TempDir())
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestServerHTTP3AltSvc: unable to listen: %s", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestServerHTTP3AltSvc: unable to listen: %s", err)
+	}
+
+	srv := &dohdns.Server{
+		Handler:  dohdns.HandleRequest(answerDatabase{}, nil),
+		TLS:      true,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	go srv.ServeHTTP3(conn)
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		Timeout:   5 * time.Second,
+	}
+
+	want := fmt.Sprintf("h3=\":%d\"", conn.LocalAddr().(*net.UDPAddr).Port)
+
+	// The HTTP/3 server may not be serving yet right after starting it.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := client.Get("https://" + l.Addr().String() + "/?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB")
+		if err != nil {
+			t.Fatalf("TestServerHTTP3AltSvc: GET request failed: %s", err)
+		}
+		resp.Body.Close()
+
+		altSvc := resp.Header.Get("Alt-Svc")
+		if strings.HasPrefix(altSvc, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestServerHTTP3AltSvc: unexpected Alt-Svc header (got \"%s\", want \"%s\")", altSvc, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
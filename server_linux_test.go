@@ -0,0 +1,28 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"testing"
+)
+
+func TestServerReusePort(t *testing.T) {
+	first := &dohdns.Server{Addr: "127.0.0.1:0", ReusePort: true}
+	l1, err := first.Listen()
+	if err != nil {
+		t.Fatalf("TestServerReusePort: unable to listen: %s", err)
+	}
+	defer l1.Close()
+
+	second := &dohdns.Server{Addr: l1.Addr().String(), ReusePort: true}
+	l2, err := second.Listen()
+	if err != nil {
+		t.Fatalf("TestServerReusePort: unable to listen on the same port: %s", err)
+	}
+	l2.Close()
+
+	third := &dohdns.Server{Addr: l1.Addr().String()}
+	if l3, err := third.Listen(); err == nil {
+		l3.Close()
+		t.Errorf("TestServerReusePort: expected an error listening without ReusePort")
+	}
+}
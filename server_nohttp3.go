@@ -0,0 +1,39 @@
+//go:build !http3
+
+package dohdns
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// http3Supported reports whether the package is built with HTTP/3 support.
+const http3Supported = false
+
+// errHTTP3Unsupported is returned when HTTP/3 is requested without support
+// for it.
+var errHTTP3Unsupported = errors.New("Server: HTTP/3 support requires building with the http3 tag")
+
+// http3State holds the HTTP/3 server, which is not available in this
+// build.
+type http3State struct{}
+
+// ServeHTTP3 serves HTTP/3 requests on conn. This build does not support
+// HTTP/3, build with the http3 tag to enable it.
+func (s *Server) ServeHTTP3(conn net.PacketConn) error {
+	conn.Close()
+	return errHTTP3Unsupported
+}
+
+// altSvcHandler returns handler, there is no HTTP/3 server to advertise in
+// this build.
+func (s *Server) altSvcHandler(handler http.Handler) http.Handler {
+	return handler
+}
+
+// closeHTTP3 closes the HTTP/3 server, there is nothing to do in this
+// build.
+func (s *Server) closeHTTP3() error {
+	return nil
+}
@@ -0,0 +1,259 @@
+package dohdns_test
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answerDatabase answers every A query with 127.0.0.1 without involving
+// the network.
+type answerDatabase struct{}
+
+func (answerDatabase) Query(qdata []byte) ([]byte, int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(qdata); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("127.0.0.1"),
+	})
+
+	rdata, err := r.Pack()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return rdata, http.StatusOK, nil
+}
+
+func TestServerHTTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestServerHTTP: unable to listen: %s", err)
+	}
+
+	srv := &dohdns.Server{
+		Handler: dohdns.HandleRequest(answerDatabase{}, nil),
+		TLS:     false,
+	}
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB")
+	if err != nil {
+		t.Fatalf("TestServerHTTP: GET request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf(
+			"TestServerHTTP: unexpected status code (got %d, want %d)",
+			resp.StatusCode,
+			http.StatusOK,
+		)
+	}
+
+	if resp.Header.Get("Content-Type") != "application/dns-udpwireformat" {
+		t.Errorf(
+			"TestServerHTTP: unexpected Content-Type (got \"%s\", want \"%s\")",
+			resp.Header.Get("Content-Type"),
+			"application/dns-udpwireformat",
+		)
+	}
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	m := new(dns.Msg)
+	if err := m.Unpack(respBody); err != nil {
+		t.Errorf("TestServerHTTP: unable to parse DNS data in response: %s", err)
+	}
+}
+
+func TestServerTLSWithoutCerts(t *testing.T) {
+	srv := &dohdns.Server{
+		Addr:    "127.0.0.1:0",
+		Handler: dohdns.HandleRequest(answerDatabase{}, nil),
+		TLS:     true,
+	}
+
+	if err := srv.ListenAndServe(); err == nil {
+		t.Errorf("TestServerTLSWithoutCerts: expected an error when TLS is enabled without certificates")
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dohdns.sock")
+
+	srv := &dohdns.Server{
+		Network: "unix",
+		Addr:    path,
+		Handler: dohdns.HandleRequest(answerDatabase{}, nil),
+	}
+	go srv.ListenAndServe()
+	defer srv.Shutdown(context.Background())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	// Wait for the listener to show up.
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := client.Get("http://unix/?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB")
+	if err != nil {
+		t.Fatalf("TestServerUnixSocket: GET request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf(
+			"TestServerUnixSocket: unexpected status code (got %d, want %d)",
+			resp.StatusCode,
+			http.StatusOK,
+		)
+	}
+}
+
+func TestServerUnsupportedNetwork(t *testing.T) {
+	srv := &dohdns.Server{
+		Network: "udp",
+		Addr:    "127.0.0.1:0",
+		Handler: dohdns.HandleRequest(answerDatabase{}, nil),
+	}
+
+	if err := srv.ListenAndServe(); err == nil {
+		t.Errorf("TestServerUnsupportedNetwork: expected an error for an unsupported network")
+	}
+}
+
+func TestServerHTTP3WithoutTLS(t *testing.T) {
+	srv := &dohdns.Server{
+		Addr:    "127.0.0.1:0",
+		Handler: dohdns.HandleRequest(answerDatabase{}, nil),
+		HTTP3:   true,
+	}
+
+	if err := srv.ListenAndServe(); err == nil {
+		t.Errorf("TestServerHTTP3WithoutTLS: expected an error when HTTP3 is enabled without TLS")
+	}
+}
+
+func TestServerHTTP3UnixSocket(t *testing.T) {
+	srv := &dohdns.Server{
+		Network:  "unix",
+		Addr:     filepath.Join(t.TempDir(), "dohdns.sock"),
+		Handler:  dohdns.HandleRequest(answerDatabase{}, nil),
+		TLS:      true,
+		CertFile: "cert.pem",
+		KeyFile:  "key.pem",
+		HTTP3:    true,
+	}
+
+	if err := srv.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "unix") {
+		t.Errorf("TestServerHTTP3UnixSocket: expected an error when HTTP3 is enabled on a unix socket (got %v)", err)
+	}
+}
+
+func TestServerAutocert(t *testing.T) {
+	srv := &dohdns.Server{
+		Handler: dohdns.HandleRequest(answerDatabase{}, nil),
+		TLS:     true,
+		Autocert: &dohdns.AutocertConfig{
+			Hosts:    []string{"doh.example.com"},
+			CacheDir: t.TempDir(),
+		},
+	}
+
+	config := srv.TLSConfig()
+	if config == nil || config.GetCertificate == nil {
+		t.Fatalf("TestServerAutocert: GetCertificate is not set in the TLS config")
+	}
+
+	// Hosts not allowed are rejected without contacting the ACME server.
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Errorf("TestServerAutocert: expected an error for a host not allowed")
+	}
+
+	if srv := (&dohdns.Server{}); srv.TLSConfig() != nil {
+		t.Errorf("TestServerAutocert: unexpected TLS config without Autocert")
+	}
+}
+
+var autocertValidateTests = []struct {
+	desc     string
+	tls      bool
+	autocert *dohdns.AutocertConfig
+}{
+	{
+		desc:     "Autocert without TLS",
+		tls:      false,
+		autocert: &dohdns.AutocertConfig{Hosts: []string{"doh.example.com"}},
+	},
+	{
+		desc:     "Autocert without hosts",
+		tls:      true,
+		autocert: &dohdns.AutocertConfig{},
+	},
+}
+
+func TestServerAutocertInvalid(t *testing.T) {
+	for _, test := range autocertValidateTests {
+		srv := &dohdns.Server{
+			Addr:     "127.0.0.1:0",
+			Handler:  dohdns.HandleRequest(answerDatabase{}, nil),
+			TLS:      test.tls,
+			Autocert: test.autocert,
+		}
+
+		if err := srv.ListenAndServe(); err == nil {
+			t.Errorf("%s: expected an error", test.desc)
+		}
+	}
+}
+
+func TestServerTLSVersion(t *testing.T) {
+	srv := &dohdns.Server{TLS: true, CertFile: "cert.pem", KeyFile: "key.pem"}
+	if config := srv.TLSConfig(); config == nil || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("TestServerTLSVersion: TLS 1.2 is not the default minimum version")
+	}
+
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	srv = &dohdns.Server{
+		TLS:          true,
+		CertFile:     "cert.pem",
+		KeyFile:      "key.pem",
+		MinVersion:   tls.VersionTLS13,
+		CipherSuites: suites,
+	}
+
+	config := srv.TLSConfig()
+	if config == nil || config.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("TestServerTLSVersion: unexpected TLS config (got %v, want minimum version TLS 1.3)", config)
+	}
+	if len(config.CipherSuites) != 1 || config.CipherSuites[0] != suites[0] {
+		t.Errorf("TestServerTLSVersion: unexpected cipher suites (got %v, want %v)", config.CipherSuites, suites)
+	}
+}
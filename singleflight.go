@@ -0,0 +1,127 @@
+package dohdns
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/http"
+	"sync"
+)
+
+// flight is a query in progress, shared by all identical queries arriving
+// before it is done.
+type flight struct {
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+// flightKey identifies identical queries. Queries for different upstream
+// servers, see UpstreamOverride, are never shared.
+type flightKey struct {
+	cacheKey
+	upstream string
+}
+
+// SingleFlightBackend wraps another Database and deduplicates identical
+// concurrent queries: while a query is in progress, queries for the same
+// question, ignoring case, with the same EDNS0 and DO bit and for the same
+// upstream override wait for it and share its response instead of being
+// passed on.
+//
+// The shared query keeps the values of the context of the first request
+// but is not cancelled with it, so one client going away does not fail the
+// others. Each request stops waiting when its own context is done.
+type SingleFlightBackend struct {
+	Database Database
+
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// NewSingleFlight returns a new SingleFlightBackend wrapping database.
+func NewSingleFlight(database Database) *SingleFlightBackend {
+	return &SingleFlightBackend{Database: database}
+}
+
+// Query passes qdata to the wrapped database, unless an identical query is
+// already in progress, in which case its response is shared.
+func (sb *SingleFlightBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := sb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details from the wrapped
+// database.
+func (sb *SingleFlightBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil || len(m.Question) != 1 {
+		// Let the wrapped database deal with anything we can not key.
+		return queryResult(ctx, sb.Database, qdata)
+	}
+
+	key := flightKey{cacheKey: questionKey(m), upstream: UpstreamOverride(ctx)}
+
+	sb.mu.Lock()
+	f, ok := sb.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		if sb.flights == nil {
+			sb.flights = map[flightKey]*flight{}
+		}
+		sb.flights[key] = f
+		go sb.run(context.WithoutCancel(ctx), key, f, qdata)
+	}
+	sb.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if !ok {
+			return f.result, f.err
+		}
+		return sharedResult(m, f.result, f.err)
+	case <-ctx.Done():
+		return &Result{Status: http.StatusGatewayTimeout}, fmt.Errorf("SingleFlightBackend: %s", ctx.Err())
+	}
+}
+
+// run passes qdata to the wrapped database for the flight f.
+func (sb *SingleFlightBackend) run(ctx context.Context, key flightKey, f *flight, qdata []byte) {
+	f.result, f.err = queryResult(ctx, sb.Database, qdata)
+
+	sb.mu.Lock()
+	delete(sb.flights, key)
+	sb.mu.Unlock()
+	close(f.done)
+}
+
+// Qclasses returns the query classes answered by the wrapped database.
+func (sb *SingleFlightBackend) Qclasses() []uint16 {
+	return databaseQclasses(sb.Database)
+}
+
+// sharedResult returns a copy of result for the query m, with the message
+// ID and question of the response replaced by those of m.
+func sharedResult(m *dns.Msg, result *Result, err error) (*Result, error) {
+	shared := *result
+	q := m.Question[0]
+	shared.Question = &q
+
+	r := new(dns.Msg)
+	if len(result.Data) > 0 && r.Unpack(result.Data) == nil {
+		r.Id = m.Id
+		r.Question = m.Question
+
+		rdata, perr := r.Pack()
+		if perr != nil {
+			shared.Data = nil
+			shared.Status = http.StatusInternalServerError
+			return &shared, perr
+		}
+		shared.Data = rdata
+	}
+
+	return &shared, err
+}
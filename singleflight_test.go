@@ -0,0 +1,235 @@
+package dohdns_test
+
+import (
+	"context"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSingleFlight(t *testing.T) {
+	// The delay keeps the first query in progress until all queries have
+	// arrived.
+	exchanger := dohdns.NewMockExchanger(answerLocalhost)
+	exchanger.Delay = 200 * time.Millisecond
+
+	proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestSingleFlight: unable to instantiate NewProxy: %s", err)
+	}
+
+	database := dohdns.NewSingleFlight(proxy)
+
+	const queries = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan string, queries)
+
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.com.", dns.TypeA)
+			m.Id = id
+			qdata, err := m.Pack()
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+
+			rdata, status, err := database.Query(qdata)
+			if err != nil || status != http.StatusOK {
+				errs <- "query failed"
+				return
+			}
+
+			r := new(dns.Msg)
+			if err := r.Unpack(rdata); err != nil {
+				errs <- err.Error()
+				return
+			}
+
+			if r.Id != id || len(r.Answer) != 1 {
+				errs <- "unexpected response"
+			}
+		}(uint16(i + 1))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("TestSingleFlight: %s", err)
+	}
+
+	if exchanger.Calls() != 1 {
+		t.Errorf(
+			"TestSingleFlight: unexpected number of upstream queries (got %d, want %d)",
+			exchanger.Calls(),
+			1,
+		)
+	}
+
+	// Once the query is done the next one is passed on again.
+	if _, _, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("TestSingleFlight: unexpected error: %s", err)
+	}
+
+	if exchanger.Calls() != 2 {
+		t.Errorf(
+			"TestSingleFlight: unexpected number of upstream queries (got %d, want %d)",
+			exchanger.Calls(),
+			2,
+		)
+	}
+}
+
+// blockingDatabase answers queries once release is closed, or fails them
+// when their context is done first.
+type blockingDatabase struct {
+	release chan struct{}
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (b *blockingDatabase) Query(qdata []byte) ([]byte, int, error) {
+	result, err := b.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+func (b *blockingDatabase) QueryResult(ctx context.Context, qdata []byte) (*dohdns.Result, error) {
+	b.mu.Lock()
+	b.calls++
+	b.mu.Unlock()
+
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return &dohdns.Result{Status: http.StatusGatewayTimeout}, ctx.Err()
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(qdata); err != nil {
+		return &dohdns.Result{Status: http.StatusBadRequest}, err
+	}
+	r := answerLocalhost(m)
+	rdata, err := r.Pack()
+	if err != nil {
+		return &dohdns.Result{Status: http.StatusInternalServerError}, err
+	}
+	return &dohdns.Result{Data: rdata, Status: http.StatusOK}, nil
+}
+
+func (b *blockingDatabase) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls
+}
+
+func TestSingleFlightCancel(t *testing.T) {
+	backend := &blockingDatabase{release: make(chan struct{})}
+	database := dohdns.NewSingleFlight(backend)
+	qdata := packQuery(t, "www.example.com.", dns.TypeA)
+
+	// The first request starts the shared query and then goes away.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := database.QueryResult(ctx, qdata)
+		first <- err
+	}()
+
+	for backend.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	second := make(chan *dohdns.Result, 1)
+	go func() {
+		result, _ := database.QueryResult(context.Background(), qdata)
+		second <- result
+	}()
+
+	// Give the second request time to join the shared query.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-first:
+		if err == nil {
+			t.Errorf("TestSingleFlightCancel: expected error for cancelled request")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestSingleFlightCancel: cancelled request kept waiting")
+	}
+
+	close(backend.release)
+
+	result := <-second
+	if result.Status != http.StatusOK {
+		t.Errorf(
+			"TestSingleFlightCancel: unexpected status code for waiting request (got %d, want %d)",
+			result.Status,
+			http.StatusOK,
+		)
+	}
+
+	if backend.count() != 1 {
+		t.Errorf(
+			"TestSingleFlightCancel: unexpected number of queries to wrapped database (got %d, want %d)",
+			backend.count(),
+			1,
+		)
+	}
+}
+
+func TestSingleFlightUpstreamOverride(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("TestSingleFlightUpstreamOverride: unable to parse CIDR: %s", err)
+	}
+
+	exchanger := dohdns.NewMockExchanger(answerLocalhost)
+	exchanger.Delay = 200 * time.Millisecond
+
+	proxy, err := dohdns.NewProxy([]string{"192.0.2.1"}, "", "", exchanger)
+	if err != nil {
+		t.Fatalf("TestSingleFlightUpstreamOverride: unable to instantiate NewProxy: %s", err)
+	}
+	proxy.AllowUpstreamOverride = true
+
+	handler := dohdns.HandleRequest(dohdns.NewSingleFlight(proxy), nil, dohdns.WithUpstreamOverride("X-DoH-Upstream", trusted))
+
+	// The same question for the default and an overridden upstream server
+	// must not share a response.
+	var wg sync.WaitGroup
+	for _, upstream := range []string{"", "192.0.2.53"} {
+		wg.Add(1)
+		go func(upstream string) {
+			defer wg.Done()
+
+			req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+			req.RemoteAddr = "192.0.2.10:1234"
+			if upstream != "" {
+				req.Header.Set("X-DoH-Upstream", upstream)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}(upstream)
+	}
+	wg.Wait()
+
+	if exchanger.Calls() != 2 {
+		t.Errorf(
+			"TestSingleFlightUpstreamOverride: unexpected number of upstream queries (got %d, want %d)",
+			exchanger.Calls(),
+			2,
+		)
+	}
+}
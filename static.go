@@ -0,0 +1,163 @@
+package dohdns
+
+import (
+	"github.com/miekg/dns"
+	"net/http"
+)
+
+// StaticBackend answers queries from a fixed set of records without
+// contacting any other server.
+//
+// Owner names starting with a "*" label are treated as wildcards following
+// the semantics of RFC 4592: "*.internal.example.com." answers for any name
+// below internal.example.com that does not otherwise exist.
+type StaticBackend struct {
+	// OmitSOA leaves out the synthesized SOA record from the authority
+	// section of negative responses. This makes the responses smaller but
+	// prevents negative caching (RFC 2308), so the SOA is included by
+	// default.
+	OmitSOA bool
+
+	// SOATemplate, if set, provides the fields of the synthesized SOA
+	// record, e.g. to control how long resolvers cache negative answers.
+	// The owner name is replaced by the queried name, and a zero TTL
+	// defaults to the minimum field.
+	SOATemplate *dns.SOA
+
+	records map[string][]dns.RR
+
+	// names holds the owner names and their ancestors, i.e. the names
+	// that exist including empty non-terminals.
+	names map[string]bool
+}
+
+// NewStatic returns a new StaticBackend answering from records, given in
+// zone file format, e.g. "www.example.com. 60 IN A 127.0.0.1".
+func NewStatic(records []string) (*StaticBackend, error) {
+	sb := &StaticBackend{records: map[string][]dns.RR{}, names: map[string]bool{}}
+
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			continue
+		}
+
+		owner := dns.CanonicalName(rr.Header().Name)
+		sb.records[owner] = append(sb.records[owner], rr)
+		addName(sb.names, owner)
+	}
+
+	return sb, nil
+}
+
+// Query answers the query in qdata from the configured records.
+func (sb *StaticBackend) Query(qdata []byte) ([]byte, int, error) {
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil {
+		return nil, http.StatusBadRequest, classify(ErrInvalidMessage, err)
+	}
+
+	r := NewReply(m, dns.RcodeSuccess)
+	r.Authoritative = true
+
+	if len(m.Question) > 0 {
+		q := m.Question[0]
+		rrs, found := sb.lookup(dns.CanonicalName(q.Name))
+
+		if !found {
+			r.Rcode = dns.RcodeNameError
+		}
+
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				answer := dns.Copy(rr)
+				answer.Header().Name = q.Name
+				r.Answer = append(r.Answer, answer)
+			}
+		}
+
+		if len(r.Answer) == 0 && !sb.OmitSOA {
+			r.Ns = append(r.Ns, syntheticSOA(q.Name, sb.SOATemplate))
+		}
+	}
+
+	rdata, err := r.Pack()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return rdata, http.StatusOK, nil
+}
+
+// lookup returns the records for name, falling back to the source of
+// wildcard synthesis below the closest existing ancestor. The returned bool
+// is false if the name does not exist.
+func (sb *StaticBackend) lookup(name string) ([]dns.RR, bool) {
+	if rrs, ok := sb.records[name]; ok {
+		return rrs, true
+	}
+
+	if sb.exists(name) {
+		// Empty non-terminal, the name exists but has no records.
+		return nil, true
+	}
+
+	offsets := dns.Split(name)
+	for i := 1; i < len(offsets); i++ {
+		ancestor := name[offsets[i]:]
+
+		if rrs, ok := sb.records["*."+ancestor]; ok {
+			return rrs, true
+		}
+
+		// Wildcards are not applied below the closest encloser.
+		if sb.exists(ancestor) {
+			break
+		}
+	}
+
+	return nil, false
+}
+
+// exists reports whether name owns records or has descendants that do.
+func (sb *StaticBackend) exists(name string) bool {
+	return sb.names[name]
+}
+
+// addName adds name and all its ancestors to names.
+func addName(names map[string]bool, name string) {
+	names[name] = true
+	for _, off := range dns.Split(name) {
+		names[name[off:]] = true
+	}
+}
+
+// syntheticSOA returns the SOA record used in synthesized negative
+// responses for name. If template is not nil its fields are used instead
+// of the defaults, with the owner name replaced by name.
+func syntheticSOA(name string, template *dns.SOA) *dns.SOA {
+	if template != nil {
+		soa := dns.Copy(template).(*dns.SOA)
+		soa.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: template.Hdr.Ttl}
+		if soa.Hdr.Ttl == 0 {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+		return soa
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
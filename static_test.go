@@ -0,0 +1,325 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http"
+	"testing"
+)
+
+var staticRecords = []string{
+	"www.example.com. 60 IN A 127.0.0.1",
+	"*.internal.example.com. 60 IN A 127.0.0.2",
+	"host.internal.example.com. 60 IN A 127.0.0.3",
+}
+
+var staticTests = []struct {
+	desc    string
+	qname   string
+	qtype   uint16
+	rcode   int
+	answers []string
+}{
+	{
+		desc:    "Exact match",
+		qname:   "www.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeSuccess,
+		answers: []string{"www.example.com.\t60\tIN\tA\t127.0.0.1"},
+	},
+	{
+		desc:    "Exact match below wildcard",
+		qname:   "host.internal.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeSuccess,
+		answers: []string{"host.internal.example.com.\t60\tIN\tA\t127.0.0.3"},
+	},
+	{
+		desc:    "Wildcard child match",
+		qname:   "other.internal.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeSuccess,
+		answers: []string{"other.internal.example.com.\t60\tIN\tA\t127.0.0.2"},
+	},
+	{
+		desc:    "Wildcard grandchild match",
+		qname:   "a.b.internal.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeSuccess,
+		answers: []string{"a.b.internal.example.com.\t60\tIN\tA\t127.0.0.2"},
+	},
+	{
+		desc:    "Wildcard does not match below existing name",
+		qname:   "sub.host.internal.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeNameError,
+		answers: nil,
+	},
+	{
+		desc:    "Existing name with other type",
+		qname:   "www.example.com.",
+		qtype:   dns.TypeAAAA,
+		rcode:   dns.RcodeSuccess,
+		answers: nil,
+	},
+	{
+		desc:    "Empty non-terminal",
+		qname:   "example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeSuccess,
+		answers: nil,
+	},
+	{
+		desc:    "Non-existing sibling",
+		qname:   "ftp.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeNameError,
+		answers: nil,
+	},
+	{
+		desc:    "Non-matching name",
+		qname:   "www.example.net.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeNameError,
+		answers: nil,
+	},
+}
+
+func TestStatic(t *testing.T) {
+	database, err := dohdns.NewStatic(staticRecords)
+	if err != nil {
+		t.Fatalf("TestStatic: unable to instantiate NewStatic: %s", err)
+	}
+
+	for _, test := range staticTests {
+		rdata, status, err := database.Query(packQuery(t, test.qname, test.qtype))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		if status != http.StatusOK {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				http.StatusOK,
+			)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		var answers []string
+		for _, rr := range r.Answer {
+			answers = append(answers, rr.String())
+		}
+
+		if len(answers) != len(test.answers) {
+			t.Fatalf(
+				"%s: unexpected answers (got %q, want %q)",
+				test.desc,
+				answers,
+				test.answers,
+			)
+		}
+
+		for i := range answers {
+			if answers[i] != test.answers[i] {
+				t.Errorf(
+					"%s: unexpected answer (got %q, want %q)",
+					test.desc,
+					answers[i],
+					test.answers[i],
+				)
+			}
+		}
+	}
+}
+
+func TestStaticInvalidRecord(t *testing.T) {
+	if _, err := dohdns.NewStatic([]string{"www.example.com. IN A not-an-address"}); err == nil {
+		t.Errorf("TestStaticInvalidRecord: expected an error for an invalid record")
+	}
+}
+
+var staticSOATests = []struct {
+	desc    string
+	qname   string
+	omitSOA bool
+	ns      int
+}{
+	{
+		desc:    "NXDOMAIN including SOA",
+		qname:   "www.example.net.",
+		omitSOA: false,
+		ns:      1,
+	},
+	{
+		desc:    "NXDOMAIN without SOA",
+		qname:   "www.example.net.",
+		omitSOA: true,
+		ns:      0,
+	},
+	{
+		desc:    "Positive answer never includes SOA",
+		qname:   "www.example.com.",
+		omitSOA: false,
+		ns:      0,
+	},
+}
+
+func TestStaticSOA(t *testing.T) {
+	for _, test := range staticSOATests {
+		database, err := dohdns.NewStatic(staticRecords)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewStatic: %s", test.desc, err)
+		}
+		database.OmitSOA = test.omitSOA
+
+		rdata, _, err := database.Query(packQuery(t, test.qname, dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if len(r.Ns) != test.ns {
+			t.Fatalf(
+				"%s: unexpected number of authority records (got %d, want %d)",
+				test.desc,
+				len(r.Ns),
+				test.ns,
+			)
+		}
+
+		if test.ns > 0 {
+			if _, ok := r.Ns[0].(*dns.SOA); !ok {
+				t.Errorf(
+					"%s: unexpected authority record (got %s, want SOA)",
+					test.desc,
+					r.Ns[0],
+				)
+			}
+		}
+	}
+}
+
+var staticSOATemplateTests = []struct {
+	desc     string
+	template *dns.SOA
+	want     dns.SOA
+}{
+	{
+		desc:     "Default SOA",
+		template: nil,
+		want: dns.SOA{
+			Hdr:     dns.RR_Header{Name: "www.example.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:      "localhost.",
+			Mbox:    "hostmaster.localhost.",
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		},
+	},
+	{
+		desc: "Template SOA",
+		template: &dns.SOA{
+			Hdr:     dns.RR_Header{Name: "ignored.example.", Ttl: 300},
+			Ns:      "ns.example.com.",
+			Mbox:    "dns.example.com.",
+			Serial:  2024010101,
+			Refresh: 7200,
+			Retry:   900,
+			Expire:  604800,
+			Minttl:  30,
+		},
+		want: dns.SOA{
+			Hdr:     dns.RR_Header{Name: "www.example.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:      "ns.example.com.",
+			Mbox:    "dns.example.com.",
+			Serial:  2024010101,
+			Refresh: 7200,
+			Retry:   900,
+			Expire:  604800,
+			Minttl:  30,
+		},
+	},
+	{
+		desc: "Template SOA without TTL",
+		template: &dns.SOA{
+			Ns:     "ns.example.com.",
+			Mbox:   "dns.example.com.",
+			Serial: 5,
+			Minttl: 120,
+		},
+		want: dns.SOA{
+			Hdr:    dns.RR_Header{Name: "www.example.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 120},
+			Ns:     "ns.example.com.",
+			Mbox:   "dns.example.com.",
+			Serial: 5,
+			Minttl: 120,
+		},
+	},
+}
+
+func TestStaticSOATemplate(t *testing.T) {
+	for _, test := range staticSOATemplateTests {
+		database, err := dohdns.NewStatic(staticRecords)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewStatic: %s", test.desc, err)
+		}
+		database.SOATemplate = test.template
+
+		rdata, _, err := database.Query(packQuery(t, "www.example.net.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+			t.Fatalf(
+				"%s: unexpected response (got %s with %d authority records, want NXDOMAIN with 1)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				len(r.Ns),
+			)
+		}
+
+		soa, ok := r.Ns[0].(*dns.SOA)
+		if !ok {
+			t.Fatalf("%s: unexpected authority record (got %s, want SOA)", test.desc, r.Ns[0])
+		}
+
+		// Ignore the rdlength set when packing.
+		soa.Hdr.Rdlength = 0
+
+		if *soa != test.want {
+			t.Errorf(
+				"%s: unexpected SOA (got %s, want %s)",
+				test.desc,
+				soa,
+				&test.want,
+			)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package dohdns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TimeoutBackend wraps another Database and enforces a hard deadline on
+// each query, regardless of what the HTTP client or the wrapped database
+// does.
+type TimeoutBackend struct {
+	Database Database
+	Timeout  time.Duration
+}
+
+// NewTimeout returns a new TimeoutBackend wrapping database.
+func NewTimeout(database Database, timeout time.Duration) *TimeoutBackend {
+	return &TimeoutBackend{Database: database, Timeout: timeout}
+}
+
+// Query passes qdata to the wrapped database, returning 504 if it does not
+// answer within the timeout.
+func (tb *TimeoutBackend) Query(qdata []byte) ([]byte, int, error) {
+	result, err := tb.QueryResult(context.Background(), qdata)
+	return result.Data, result.Status, err
+}
+
+// QueryResult works like Query but also reports details from the wrapped
+// database. The context passed on to the wrapped database is cancelled
+// when the timeout expires.
+func (tb *TimeoutBackend) QueryResult(ctx context.Context, qdata []byte) (*Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, tb.Timeout)
+	defer cancel()
+
+	type response struct {
+		result *Result
+		err    error
+	}
+
+	// The channel is buffered so the goroutine can always deliver its
+	// response and exit, even if nobody is waiting for it anymore.
+	done := make(chan response, 1)
+	go func() {
+		result, err := queryResult(ctx, tb.Database, qdata)
+		done <- response{result: result, err: err}
+	}()
+
+	select {
+	case resp := <-done:
+		return resp.result, resp.err
+	case <-ctx.Done():
+		return &Result{Status: http.StatusGatewayTimeout}, fmt.Errorf("TimeoutBackend: %s", ctx.Err())
+	}
+}
+
+// Qclasses returns the query classes answered by the wrapped database.
+func (tb *TimeoutBackend) Qclasses() []uint16 {
+	return databaseQclasses(tb.Database)
+}
+
+// TimeoutHandler wraps handler so that requests not answered within
+// timeout get a SERVFAIL response with the HTTP status given in status,
+// e.g. http.StatusGatewayTimeout or http.StatusServiceUnavailable. Like
+// http.TimeoutHandler, the response of handler is buffered and discarded
+// on timeout, and the request context is cancelled. Requests without a
+// query that can be parsed get a plain text error instead. A zero status
+// defaults to http.StatusGatewayTimeout.
+func TimeoutHandler(handler http.Handler, timeout time.Duration, status int) http.Handler {
+	if status == 0 {
+		status = http.StatusGatewayTimeout
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Parse the query before handler consumes the body.
+		m := requestQuery(r)
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{header: http.Header{}}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			handler.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			for name, values := range tw.header {
+				w.Header()[name] = values
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			tw.timedOut = true
+			tw.mu.Unlock()
+
+			if m != nil {
+				if rdata, _, err := reply(m, dns.RcodeServerFailure); err == nil {
+					w.Header().Set("Content-Type", mimeType)
+					w.WriteHeader(status)
+					w.Write(rdata)
+					return
+				}
+			}
+
+			http.Error(w, http.StatusText(status), status)
+		}
+	})
+}
+
+// timeoutWriter buffers the response written by the handler wrapped by
+// TimeoutHandler.
+type timeoutWriter struct {
+	header http.Header
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+
+	return tw.buf.Write(b)
+}
@@ -0,0 +1,143 @@
+package dohdns_test
+
+import (
+	"bytes"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var timeoutTests = []struct {
+	desc   string
+	delay  time.Duration
+	status int
+	err    bool
+}{
+	{
+		desc:   "Fast backend",
+		delay:  0,
+		status: http.StatusOK,
+		err:    false,
+	},
+	{
+		desc:   "Slow backend",
+		delay:  time.Second,
+		status: http.StatusGatewayTimeout,
+		err:    true,
+	},
+}
+
+func TestTimeout(t *testing.T) {
+	for _, test := range timeoutTests {
+		exchanger := dohdns.NewMockExchanger(answerLocalhost)
+		exchanger.Delay = test.delay
+
+		proxy, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+
+		database := dohdns.NewTimeout(proxy, 100*time.Millisecond)
+
+		start := time.Now()
+		_, status, err := database.Query(packQuery(t, "www.example.com.", dns.TypeA))
+		elapsed := time.Since(start)
+
+		if status != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				test.status,
+			)
+		}
+
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.desc, err)
+		}
+
+		if elapsed > 500*time.Millisecond {
+			t.Errorf("%s: query took too long: %s", test.desc, elapsed)
+		}
+	}
+}
+
+var timeoutHandlerTests = []struct {
+	desc   string
+	delay  time.Duration
+	status int
+	rcode  int
+}{
+	{
+		desc:   "Fast handler",
+		delay:  0,
+		status: http.StatusOK,
+		rcode:  dns.RcodeSuccess,
+	},
+	{
+		desc:   "Slow handler",
+		delay:  time.Second,
+		status: http.StatusGatewayTimeout,
+		rcode:  dns.RcodeServerFailure,
+	},
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	for _, test := range timeoutHandlerTests {
+		handler := dohdns.TimeoutHandler(
+			dohdns.HandleRequest(slowDatabase{delay: test.delay}, nil),
+			100*time.Millisecond,
+			http.StatusGatewayTimeout,
+		)
+
+		req := httptest.NewRequest("POST", "https://example.com", bytes.NewReader(packQuery(t, "www.example.com.", dns.TypeA)))
+		req.Header.Set("Content-Type", "application/dns-udpwireformat")
+		w := httptest.NewRecorder()
+
+		start := time.Now()
+		handler.ServeHTTP(w, req)
+		elapsed := time.Since(start)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if resp.Header.Get("Content-Type") != "application/dns-udpwireformat" {
+			t.Errorf(
+				"%s: unexpected Content-Type (got \"%s\", want \"%s\")",
+				test.desc,
+				resp.Header.Get("Content-Type"),
+				"application/dns-udpwireformat",
+			)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode || len(r.Question) != 1 || r.Question[0].Name != "www.example.com." {
+			t.Errorf(
+				"%s: unexpected response (got %s for %v, want %s for www.example.com.)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				r.Question,
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		if elapsed > 500*time.Millisecond {
+			t.Errorf("%s: request took too long: %s", test.desc, elapsed)
+		}
+	}
+}
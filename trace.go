@@ -0,0 +1,91 @@
+package dohdns
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Tracer is notified by HandleRequest at the start and end of each
+// request, e.g. to create tracing spans. It is kept minimal so it can be
+// implemented on top of any tracing library.
+type Tracer interface {
+	// Start is called before the query is handled. The returned context
+	// is used for the rest of the request, including the database query,
+	// and passed to End.
+	Start(ctx context.Context) context.Context
+
+	// End is called once the response has been written.
+	End(ctx context.Context, info TraceInfo)
+}
+
+// TraceInfo describes a handled request.
+type TraceInfo struct {
+	// Duration is the time taken to handle the request.
+	Duration time.Duration
+
+	// Qname and Qtype are the question of the query, empty if the query
+	// could not be parsed by the database.
+	Qname string
+	Qtype uint16
+
+	// Rcode is the RCODE of the DNS response, or -1 if there is none.
+	Rcode int
+
+	// Status is the HTTP status of the response.
+	Status int
+
+	// Upstream is the upstream server that answered the query, if any.
+	Upstream string
+
+	// Err is the error that made the request fail, if any.
+	Err error
+}
+
+// WithTracer makes the handler report requests to tracer.
+func WithTracer(tracer Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = tracer
+	}
+}
+
+// statusWriter records the status written to an http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// traceInfo returns the TraceInfo of a request that took since start.
+func traceInfo(start time.Time, status int, result *Result, err error) TraceInfo {
+	info := TraceInfo{
+		Duration: time.Since(start),
+		Rcode:    -1,
+		Status:   status,
+		Err:      err,
+	}
+
+	if result != nil {
+		if result.Question != nil {
+			info.Qname = result.Question.Name
+			info.Qtype = result.Question.Qtype
+		}
+		info.Rcode = responseRcode(result.Data)
+		info.Upstream = result.Upstream
+	}
+
+	return info
+}
@@ -0,0 +1,117 @@
+package dohdns_test
+
+import (
+	"context"
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeTracer records the requests it is notified about.
+type fakeTracer struct {
+	started int
+	ended   []dohdns.TraceInfo
+}
+
+type fakeSpanKey struct{}
+
+func (tr *fakeTracer) Start(ctx context.Context) context.Context {
+	tr.started++
+	return context.WithValue(ctx, fakeSpanKey{}, tr.started)
+}
+
+func (tr *fakeTracer) End(ctx context.Context, info dohdns.TraceInfo) {
+	if ctx.Value(fakeSpanKey{}) != tr.started {
+		info.Err = context.Canceled
+	}
+	tr.ended = append(tr.ended, info)
+}
+
+var tracerTests = []struct {
+	desc     string
+	url      string
+	qname    string
+	qtype    uint16
+	rcode    int
+	status   int
+	upstream string
+	err      bool
+}{
+	{
+		desc:     "Successful query",
+		url:      "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB",
+		qname:    "www.example.com.",
+		qtype:    dns.TypeA,
+		rcode:    dns.RcodeSuccess,
+		status:   http.StatusOK,
+		upstream: "127.0.0.1",
+	},
+	{
+		desc:   "Failed request",
+		url:    "https://example.com",
+		rcode:  -1,
+		status: http.StatusBadRequest,
+		err:    true,
+	},
+}
+
+func TestTracer(t *testing.T) {
+	database, err := dohdns.NewProxy([]string{"127.0.0.1"}, "", "", dohdns.NewMockExchanger(answerLocalhost))
+	if err != nil {
+		t.Fatalf("TestTracer: unable to instantiate NewProxy: %s", err)
+	}
+
+	for _, test := range tracerTests {
+		tracer := &fakeTracer{}
+		handler := dohdns.HandleRequest(database, nil, dohdns.WithTracer(tracer))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.url, nil))
+
+		if tracer.started != 1 || len(tracer.ended) != 1 {
+			t.Fatalf(
+				"%s: unexpected number of events (got %d/%d, want 1/1)",
+				test.desc,
+				tracer.started,
+				len(tracer.ended),
+			)
+		}
+
+		info := tracer.ended[0]
+
+		if info.Qname != test.qname || info.Qtype != test.qtype {
+			t.Errorf(
+				"%s: unexpected question (got %s %d, want %s %d)",
+				test.desc,
+				info.Qname,
+				info.Qtype,
+				test.qname,
+				test.qtype,
+			)
+		}
+
+		if info.Rcode != test.rcode || info.Status != test.status {
+			t.Errorf(
+				"%s: unexpected rcode and status (got %d/%d, want %d/%d)",
+				test.desc,
+				info.Rcode,
+				info.Status,
+				test.rcode,
+				test.status,
+			)
+		}
+
+		if info.Upstream != test.upstream {
+			t.Errorf(
+				"%s: unexpected upstream (got \"%s\", want \"%s\")",
+				test.desc,
+				info.Upstream,
+				test.upstream,
+			)
+		}
+
+		if (info.Err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.desc, info.Err)
+		}
+	}
+}
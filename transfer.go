@@ -0,0 +1,399 @@
+package dohdns
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// TransferBackend answers queries authoritatively from zones transferred
+// from a primary server, e.g. a hidden master, like ZoneBackend does from
+// zone files.
+//
+// The zones are transferred with AXFR by NewTransfer. Refresh transfers a
+// zone again when the primary has a newer SOA serial, using IXFR (RFC 1995)
+// and falling back to AXFR. Refreshes are triggered periodically by
+// StartRefresh, or by the primary sending a NOTIFY (RFC 1996) handled by
+// ServeDNS.
+type TransferBackend struct {
+	// Primary is the address of the primary server, e.g.
+	// "192.0.2.1:53".
+	Primary string
+
+	// RefreshInterval is how often the background refresh started by
+	// StartRefresh checks the zones for changes.
+	RefreshInterval time.Duration
+
+	// Logger, if set, is used to report failed background refreshes.
+	Logger *log.Logger
+
+	zones   ZoneBackend
+	origins map[string]bool
+
+	// refreshMu serializes refreshes and guards data, the records of
+	// each zone as transferred.
+	refreshMu sync.Mutex
+	data      map[string][]dns.RR
+
+	mu          sync.Mutex
+	refreshStop chan struct{}
+	refreshDone chan struct{}
+}
+
+// NewTransfer returns a new TransferBackend serving zones, which are
+// transferred from primary before it returns.
+func NewTransfer(primary string, zones []string) (*TransferBackend, error) {
+	tb := &TransferBackend{
+		Primary: primary,
+		origins: map[string]bool{},
+		data:    map[string][]dns.RR{},
+	}
+
+	for _, origin := range zones {
+		origin = dns.CanonicalName(origin)
+		tb.origins[origin] = true
+
+		if err := tb.Refresh(origin); err != nil {
+			return nil, err
+		}
+	}
+
+	return tb, nil
+}
+
+// Query answers the query in qdata from the transferred zones.
+func (tb *TransferBackend) Query(qdata []byte) ([]byte, int, error) {
+	return tb.zones.Query(qdata)
+}
+
+// Serial returns the SOA serial of the transferred zone origin. The
+// returned bool is false if the zone is not served.
+func (tb *TransferBackend) Serial(origin string) (uint32, bool) {
+	tb.zones.mu.RLock()
+	defer tb.zones.mu.RUnlock()
+
+	z, ok := tb.zones.zones[dns.CanonicalName(origin)]
+	if !ok {
+		return 0, false
+	}
+
+	return z.soa.Serial, true
+}
+
+// Refresh transfers the zone origin from the primary if it has not been
+// transferred yet, or if the primary has a newer SOA serial.
+func (tb *TransferBackend) Refresh(origin string) error {
+	origin = dns.CanonicalName(origin)
+	if !tb.origins[origin] {
+		return fmt.Errorf("TransferBackend: zone %s is not configured", origin)
+	}
+
+	tb.refreshMu.Lock()
+	defer tb.refreshMu.Unlock()
+
+	if current, ok := tb.data[origin]; ok {
+		soa := zoneSOA(current)
+
+		serial, err := tb.primarySerial(origin)
+		if err != nil {
+			return err
+		}
+		if !serialNewer(serial, soa.Serial) {
+			return nil
+		}
+
+		// Not all primaries support IXFR, try AXFR if it fails.
+		if rrs, err := tb.ixfr(origin, current, soa); err == nil {
+			return tb.load(origin, rrs)
+		}
+	}
+
+	rrs, err := tb.axfr(origin)
+	if err != nil {
+		return err
+	}
+
+	return tb.load(origin, rrs)
+}
+
+// RefreshAll refreshes all zones, returning the first error.
+func (tb *TransferBackend) RefreshAll() error {
+	var first error
+	for origin := range tb.origins {
+		if err := tb.Refresh(origin); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// StartRefresh starts refreshing the zones every RefreshInterval in the
+// background until StopRefresh is called. Calling StartRefresh while the
+// refresh is running has no effect.
+func (tb *TransferBackend) StartRefresh() error {
+	if tb.RefreshInterval <= 0 {
+		return errors.New("TransferBackend: RefreshInterval must be positive")
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.refreshStop != nil {
+		return nil
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	tb.refreshStop = stop
+	tb.refreshDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(tb.RefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := tb.RefreshAll(); err != nil && tb.Logger != nil {
+					tb.Logger.Printf("TransferBackend: refresh failed: %s", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopRefresh stops the background refresh started by StartRefresh and
+// waits for it to finish.
+func (tb *TransferBackend) StopRefresh() {
+	tb.mu.Lock()
+	stop, done := tb.refreshStop, tb.refreshDone
+	tb.refreshStop = nil
+	tb.refreshDone = nil
+	tb.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// ServeDNS handles NOTIFY messages from the primary, refreshing the
+// notified zone in the background. It is meant to be used as the handler
+// of a dns.Server. Other messages, NOTIFY messages for zones not served
+// and NOTIFY messages from other addresses than Primary are REFUSED.
+func (tb *TransferBackend) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if r.Opcode != dns.OpcodeNotify || len(r.Question) != 1 || !tb.fromPrimary(w.RemoteAddr()) {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	origin := dns.CanonicalName(r.Question[0].Name)
+	if !tb.origins[origin] {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	m.Authoritative = true
+	w.WriteMsg(m)
+
+	go func() {
+		if err := tb.Refresh(origin); err != nil && tb.Logger != nil {
+			tb.Logger.Printf("TransferBackend: refresh of %s after NOTIFY failed: %s", origin, err)
+		}
+	}()
+}
+
+// fromPrimary reports whether addr has the IP address of the primary.
+func (tb *TransferBackend) fromPrimary(addr net.Addr) bool {
+	primary, _, err := net.SplitHostPort(tb.Primary)
+	if err != nil {
+		return false
+	}
+	remote, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(primary)
+	return ip != nil && ip.Equal(net.ParseIP(remote))
+}
+
+// primarySerial returns the SOA serial of origin on the primary.
+func (tb *TransferBackend) primarySerial(origin string) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(origin, dns.TypeSOA)
+
+	c := &dns.Client{Net: "tcp"}
+	r, _, err := c.Exchange(m, tb.Primary)
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("TransferBackend: SOA query for %s failed with %s", origin, dns.RcodeToString[r.Rcode])
+	}
+
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+
+	return 0, fmt.Errorf("TransferBackend: no SOA record for %s", origin)
+}
+
+// axfr returns the records of origin transferred with AXFR.
+func (tb *TransferBackend) axfr(origin string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(origin)
+
+	records, err := tb.transfer(m)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SOA record is repeated at the end.
+	if len(records) < 2 {
+		return nil, fmt.Errorf("TransferBackend: incomplete AXFR of %s", origin)
+	}
+
+	return records[:len(records)-1], nil
+}
+
+// ixfr returns the records of origin after applying the changes since
+// soa, the SOA record of the current records, transferred with IXFR.
+func (tb *TransferBackend) ixfr(origin string, current []dns.RR, soa *dns.SOA) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetIxfr(origin, soa.Serial, soa.Ns, soa.Mbox)
+
+	records, err := tb.transfer(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("TransferBackend: empty IXFR of %s", origin)
+	}
+	newSOA, ok := records[0].(*dns.SOA)
+	if !ok {
+		return nil, fmt.Errorf("TransferBackend: IXFR of %s does not start with SOA", origin)
+	}
+
+	// A single SOA record means there are no changes.
+	if len(records) == 1 {
+		return current, nil
+	}
+
+	// The primary may send the full zone like AXFR instead of the
+	// changes, the second record is not an old SOA record then.
+	if second, ok := records[1].(*dns.SOA); !ok || second.Serial == newSOA.Serial {
+		return records[:len(records)-1], nil
+	}
+
+	return applyIXFR(current, records), nil
+}
+
+// transfer sends the AXFR or IXFR query m to the primary and returns all
+// transferred records.
+func (tb *TransferBackend) transfer(m *dns.Msg) ([]dns.RR, error) {
+	t := new(dns.Transfer)
+	envelopes, err := t.In(m, tb.Primary)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			err = e.Error
+			continue
+		}
+		records = append(records, e.RR...)
+	}
+
+	return records, err
+}
+
+// load makes rrs the records of the zone origin.
+func (tb *TransferBackend) load(origin string, rrs []dns.RR) error {
+	z, err := newZone(rrs)
+	if err != nil {
+		return fmt.Errorf("TransferBackend: %s: %s", origin, err)
+	}
+	if z.origin != origin {
+		return fmt.Errorf("TransferBackend: transfer of %s returned zone %s", origin, z.origin)
+	}
+
+	tb.data[origin] = rrs
+	tb.zones.setZone(z)
+
+	return nil
+}
+
+// applyIXFR applies the incremental transfer in records to the records in
+// current. After the new SOA record, records holds a sequence of changes,
+// each consisting of the old SOA record followed by the deleted records,
+// then the new SOA record of the change followed by the added records,
+// terminated by the new SOA record.
+func applyIXFR(current []dns.RR, records []dns.RR) []dns.RR {
+	rrs := append([]dns.RR(nil), current...)
+
+	adding := true
+	for _, rr := range records[1 : len(records)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			adding = !adding
+			continue
+		}
+
+		if adding {
+			rrs = append(rrs, rr)
+			continue
+		}
+
+		for i, old := range rrs {
+			if dns.IsDuplicate(old, rr) {
+				rrs = append(rrs[:i], rrs[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for i, rr := range rrs {
+		if _, ok := rr.(*dns.SOA); ok {
+			rrs[i] = records[0]
+		}
+	}
+
+	return rrs
+}
+
+// zoneSOA returns the SOA record in rrs.
+func zoneSOA(rrs []dns.RR) *dns.SOA {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+
+	return nil
+}
+
+// serialNewer reports whether serial a is newer than b using serial number
+// arithmetic (RFC 1982).
+func serialNewer(a uint32, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
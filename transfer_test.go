@@ -0,0 +1,306 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var transferVersions = map[uint32][]string{
+	1: {
+		"example.org. 3600 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 60",
+		"example.org. 3600 IN NS ns.example.org.",
+		"www.example.org. 60 IN A 192.0.2.1",
+		"old.example.org. 60 IN A 192.0.2.2",
+	},
+	2: {
+		"example.org. 3600 IN SOA ns.example.org. hostmaster.example.org. 2 3600 600 86400 60",
+		"example.org. 3600 IN NS ns.example.org.",
+		"www.example.org. 60 IN A 192.0.2.10",
+		"new.example.org. 60 IN A 192.0.2.3",
+	},
+}
+
+// primaryServer serves example.org from transferVersions over TCP,
+// answering SOA, AXFR and IXFR queries.
+type primaryServer struct {
+	addr string
+
+	mu     sync.Mutex
+	serial uint32
+	noIXFR bool
+	axfrs  int
+	ixfrs  int
+}
+
+func newPrimaryServer(t *testing.T) *primaryServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	ps := &primaryServer{addr: l.Addr().String(), serial: 1}
+
+	server := &dns.Server{Listener: l, Handler: ps}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return ps
+}
+
+func (ps *primaryServer) setSerial(serial uint32) {
+	ps.mu.Lock()
+	ps.serial = serial
+	ps.mu.Unlock()
+}
+
+func (ps *primaryServer) transfers() (axfrs int, ixfrs int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.axfrs, ps.ixfrs
+}
+
+// records parses the records of version serial.
+func (ps *primaryServer) records(serial uint32) []dns.RR {
+	var rrs []dns.RR
+	for _, s := range transferVersions[serial] {
+		rr, _ := dns.NewRR(s)
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func (ps *primaryServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	current := ps.records(ps.serial)
+	soa := current[0]
+
+	switch r.Question[0].Qtype {
+	case dns.TypeSOA:
+		m.Answer = []dns.RR{soa}
+	case dns.TypeAXFR:
+		ps.axfrs++
+		m.Answer = append(append([]dns.RR{}, current...), soa)
+	case dns.TypeIXFR:
+		if ps.noIXFR {
+			m.Rcode = dns.RcodeNotImplemented
+			break
+		}
+		ps.ixfrs++
+
+		serial := r.Ns[0].(*dns.SOA).Serial
+		if serial == ps.serial {
+			m.Answer = []dns.RR{soa}
+			break
+		}
+
+		old := ps.records(serial)
+		m.Answer = []dns.RR{soa, old[0]}
+		m.Answer = append(m.Answer, missing(old[1:], current[1:])...)
+		m.Answer = append(m.Answer, soa)
+		m.Answer = append(m.Answer, missing(current[1:], old[1:])...)
+		m.Answer = append(m.Answer, soa)
+	}
+
+	w.WriteMsg(m)
+}
+
+// missing returns the records in a that are not in b.
+func missing(a []dns.RR, b []dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range a {
+		found := false
+		for _, other := range b {
+			if dns.IsDuplicate(rr, other) {
+				found = true
+			}
+		}
+		if !found {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// transferAnswer returns the RCODE and the addresses of the A records in
+// the response of database to a query for name.
+func transferAnswer(t *testing.T, database dohdns.Database, name string) (int, []string) {
+	rdata, _, err := database.Query(packQuery(t, name, dns.TypeA))
+	if err != nil {
+		t.Fatalf("unexpected error for %s: %s", name, err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(rdata); err != nil {
+		t.Fatalf("unable to parse response for %s: %s", name, err)
+	}
+
+	var addresses []string
+	for _, rr := range r.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			addresses = append(addresses, a.A.String())
+		}
+	}
+
+	return r.Rcode, addresses
+}
+
+var transferAnswerTests = []struct {
+	name      string
+	serial    uint32
+	rcode     int
+	addresses []string
+}{
+	{name: "www.example.org.", serial: 1, rcode: dns.RcodeSuccess, addresses: []string{"192.0.2.1"}},
+	{name: "old.example.org.", serial: 1, rcode: dns.RcodeSuccess, addresses: []string{"192.0.2.2"}},
+	{name: "new.example.org.", serial: 1, rcode: dns.RcodeNameError, addresses: nil},
+	{name: "www.example.org.", serial: 2, rcode: dns.RcodeSuccess, addresses: []string{"192.0.2.10"}},
+	{name: "old.example.org.", serial: 2, rcode: dns.RcodeNameError, addresses: nil},
+	{name: "new.example.org.", serial: 2, rcode: dns.RcodeSuccess, addresses: []string{"192.0.2.3"}},
+}
+
+// checkTransferAnswers verifies the answers of database for version
+// serial.
+func checkTransferAnswers(t *testing.T, desc string, database dohdns.Database, serial uint32) {
+	for _, test := range transferAnswerTests {
+		if test.serial != serial {
+			continue
+		}
+
+		rcode, addresses := transferAnswer(t, database, test.name)
+		if rcode != test.rcode || !equalStrings(addresses, test.addresses) {
+			t.Errorf(
+				"%s: unexpected answer for %s (got %s %v, want %s %v)",
+				desc,
+				test.name,
+				dns.RcodeToString[rcode],
+				addresses,
+				dns.RcodeToString[test.rcode],
+				test.addresses,
+			)
+		}
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTransfer(t *testing.T) {
+	primary := newPrimaryServer(t)
+
+	database, err := dohdns.NewTransfer(primary.addr, []string{"example.org"})
+	if err != nil {
+		t.Fatalf("TestTransfer: unable to instantiate NewTransfer: %s", err)
+	}
+
+	checkTransferAnswers(t, "TestTransfer: initial AXFR", database, 1)
+
+	// Nothing is transferred while the serial is unchanged.
+	if err := database.Refresh("example.org."); err != nil {
+		t.Fatalf("TestTransfer: unable to refresh: %s", err)
+	}
+
+	primary.setSerial(2)
+	if err := database.Refresh("example.org."); err != nil {
+		t.Fatalf("TestTransfer: unable to refresh: %s", err)
+	}
+
+	checkTransferAnswers(t, "TestTransfer: IXFR", database, 2)
+
+	if serial, ok := database.Serial("example.org."); !ok || serial != 2 {
+		t.Errorf("TestTransfer: unexpected serial (got %d, want %d)", serial, 2)
+	}
+
+	if axfrs, ixfrs := primary.transfers(); axfrs != 1 || ixfrs != 1 {
+		t.Errorf("TestTransfer: unexpected transfers (got %d AXFR/%d IXFR, want 1/1)", axfrs, ixfrs)
+	}
+}
+
+func TestTransferIXFRUnsupported(t *testing.T) {
+	primary := newPrimaryServer(t)
+	primary.noIXFR = true
+
+	database, err := dohdns.NewTransfer(primary.addr, []string{"example.org."})
+	if err != nil {
+		t.Fatalf("TestTransferIXFRUnsupported: unable to instantiate NewTransfer: %s", err)
+	}
+
+	primary.setSerial(2)
+	if err := database.Refresh("example.org."); err != nil {
+		t.Fatalf("TestTransferIXFRUnsupported: unable to refresh: %s", err)
+	}
+
+	checkTransferAnswers(t, "TestTransferIXFRUnsupported", database, 2)
+
+	if axfrs, _ := primary.transfers(); axfrs != 2 {
+		t.Errorf("TestTransferIXFRUnsupported: unexpected number of AXFRs (got %d, want %d)", axfrs, 2)
+	}
+}
+
+func TestTransferNotify(t *testing.T) {
+	primary := newPrimaryServer(t)
+
+	database, err := dohdns.NewTransfer(primary.addr, []string{"example.org."})
+	if err != nil {
+		t.Fatalf("TestTransferNotify: unable to instantiate NewTransfer: %s", err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestTransferNotify: unable to listen: %s", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: database}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	notify := func(zone string) int {
+		m := new(dns.Msg)
+		m.SetNotify(zone)
+
+		r, _, err := new(dns.Client).Exchange(m, pc.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("TestTransferNotify: unable to send NOTIFY: %s", err)
+		}
+		return r.Rcode
+	}
+
+	if rcode := notify("example.net."); rcode != dns.RcodeRefused {
+		t.Errorf("TestTransferNotify: unexpected RCODE for unknown zone (got %s, want REFUSED)", dns.RcodeToString[rcode])
+	}
+
+	primary.setSerial(2)
+	if rcode := notify("example.org."); rcode != dns.RcodeSuccess {
+		t.Errorf("TestTransferNotify: unexpected RCODE (got %s, want NOERROR)", dns.RcodeToString[rcode])
+	}
+
+	// The zone is refreshed in the background.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if serial, _ := database.Serial("example.org."); serial == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestTransferNotify: zone not refreshed after NOTIFY")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	checkTransferAnswers(t, "TestTransferNotify", database, 2)
+}
@@ -0,0 +1,112 @@
+package dohdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// upstreamKey is the context key of the upstream override.
+type upstreamKey struct{}
+
+// WithUpstreamOverride lets trusted clients choose the upstream server of
+// a request with the header named header, e.g. "X-DoH-Upstream". The
+// header is only accepted from clients with an address in trusted, other
+// clients get 403 Forbidden. Values that are not an IP address get 400
+// Bad Request. The database must support the override, see
+// ProxyBackend.AllowUpstreamOverride.
+func WithUpstreamOverride(header string, trusted ...*net.IPNet) Option {
+	return func(o *Options) {
+		o.UpstreamHeader = header
+		o.TrustedProxies = append(o.TrustedProxies, trusted...)
+	}
+}
+
+// UpstreamOverride returns the upstream server stored in ctx by the
+// handler, or an empty string if there is none.
+func UpstreamOverride(ctx context.Context) string {
+	upstream, _ := ctx.Value(upstreamKey{}).(string)
+	return upstream
+}
+
+// upstreamOverride returns the upstream server requested by r, or an empty
+// string if there is none. The returned status is the HTTP status to use
+// when the request is rejected.
+func upstreamOverride(r *http.Request, options Options) (string, int, error) {
+	value := r.Header.Get(options.UpstreamHeader)
+	if value == "" {
+		return "", http.StatusOK, nil
+	}
+
+	if !trustedProxy(r.RemoteAddr, options.TrustedProxies) {
+		return "", http.StatusForbidden, fmt.Errorf("HandleRequest: %s header from untrusted client", options.UpstreamHeader)
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", http.StatusBadRequest, fmt.Errorf("HandleRequest: %s header is not an IP address: %q", options.UpstreamHeader, value)
+	}
+
+	return ip.String(), http.StatusOK, nil
+}
+
+// trustedProxy reports whether the IP address in remoteAddr is in trusted.
+func trustedProxy(remoteAddr string, trusted []*net.IPNet) bool {
+	ip := remoteIP(remoteAddr)
+	return ip != nil && inNetworks(ip, trusted)
+}
+
+// clientIP returns the IP address of the client sending r. For requests
+// from a trusted proxy the address is taken from X-Forwarded-For instead:
+// the last address not belonging to a trusted proxy is used. The result is
+// nil if the address can not be parsed.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	ip := remoteIP(r.RemoteAddr)
+	if ip == nil || !inNetworks(ip, trusted) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+
+	// Walk the chain of proxies backwards, each trusted proxy vouches
+	// for the address before it.
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+		if !inNetworks(ip, trusted) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// remoteIP returns the IP address in remoteAddr, which may include a
+// port, or nil.
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// inNetworks reports whether ip is in one of networks.
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,114 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var upstreamOverrideTests = []struct {
+	desc       string
+	remoteAddr string
+	header     string
+	allow      bool
+	status     int
+	address    string
+}{
+	{
+		desc:       "No header",
+		remoteAddr: "192.0.2.10:1234",
+		allow:      true,
+		status:     http.StatusOK,
+		address:    "192.0.2.1:53",
+	},
+	{
+		desc:       "Override from trusted client",
+		remoteAddr: "192.0.2.10:1234",
+		header:     "192.0.2.53",
+		allow:      true,
+		status:     http.StatusOK,
+		address:    "192.0.2.53:53",
+	},
+	{
+		desc:       "IPv6 override from trusted client",
+		remoteAddr: "192.0.2.10:1234",
+		header:     "2001:db8::53",
+		allow:      true,
+		status:     http.StatusOK,
+		address:    "[2001:db8::53]:53",
+	},
+	{
+		desc:       "Override ignored by backend",
+		remoteAddr: "192.0.2.10:1234",
+		header:     "192.0.2.53",
+		allow:      false,
+		status:     http.StatusOK,
+		address:    "192.0.2.1:53",
+	},
+	{
+		desc:       "Override from untrusted client",
+		remoteAddr: "198.51.100.10:1234",
+		header:     "192.0.2.53",
+		allow:      true,
+		status:     http.StatusForbidden,
+	},
+	{
+		desc:       "Malformed override",
+		remoteAddr: "192.0.2.10:1234",
+		header:     "dns.example.com",
+		allow:      true,
+		status:     http.StatusBadRequest,
+	},
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("TestUpstreamOverride: unable to parse CIDR: %s", err)
+	}
+
+	for _, test := range upstreamOverrideTests {
+		exchanger := newAddressExchanger()
+		database, err := dohdns.NewProxy([]string{"192.0.2.1"}, "", "", exchanger)
+		if err != nil {
+			t.Fatalf("%s: unable to instantiate NewProxy: %s", test.desc, err)
+		}
+		database.AllowUpstreamOverride = test.allow
+
+		req := httptest.NewRequest("GET", "https://example.com?dns=AAABAAABAAAAAAAAA3d3dwdleGFtcGxlA2NvbQAAAQAB", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			req.Header.Set("X-DoH-Upstream", test.header)
+		}
+		w := httptest.NewRecorder()
+
+		handler := dohdns.HandleRequest(database, nil, dohdns.WithUpstreamOverride("X-DoH-Upstream", trusted))
+		handler.ServeHTTP(w, req)
+
+		resp := w.Result()
+
+		if resp.StatusCode != test.status {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				resp.StatusCode,
+				test.status,
+			)
+		}
+
+		if test.address != "" && exchanger.count(test.address) != 1 {
+			t.Errorf(
+				"%s: query not sent to %s (got %d exchanges)",
+				test.desc,
+				test.address,
+				exchanger.count(test.address),
+			)
+		}
+
+		if test.status != http.StatusOK && exchanger.count("192.0.2.1:53") != 0 {
+			t.Errorf("%s: rejected request was passed on", test.desc)
+		}
+	}
+}
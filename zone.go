@@ -0,0 +1,219 @@
+package dohdns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// zone holds the records of a single loaded zone.
+type zone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR
+
+	// names holds the owner names and their ancestors, i.e. the names
+	// that exist including empty non-terminals.
+	names map[string]bool
+}
+
+// ZoneBackend answers queries authoritatively from RFC 1035 zone files.
+//
+// Queries for names inside a loaded zone are answered from the zone data,
+// with NXDOMAIN for names that do not exist. Queries for names outside all
+// loaded zones are REFUSED.
+type ZoneBackend struct {
+	mu    sync.RWMutex
+	zones map[string]*zone
+}
+
+// NewZone returns a new ZoneBackend serving the zone files in files. The
+// origin of each zone is taken from its SOA record.
+func NewZone(files []string) (*ZoneBackend, error) {
+	zb := &ZoneBackend{zones: map[string]*zone{}}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		err = zb.LoadZone(f, "", file)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return zb, nil
+}
+
+// LoadZone parses the zone file data in r and adds it to the backend,
+// replacing any previously loaded zone with the same origin. The origin is
+// used for relative names until a $ORIGIN directive is found, filename is
+// only used in error messages.
+func (zb *ZoneBackend) LoadZone(r io.Reader, origin string, filename string) error {
+	var rrs []dns.RR
+
+	zp := dns.NewZoneParser(r, origin, filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+
+	z, err := newZone(rrs)
+	if err != nil {
+		return fmt.Errorf("LoadZone: %s: %s", filename, err)
+	}
+
+	zb.setZone(z)
+
+	return nil
+}
+
+// setZone adds z to the backend, replacing any zone with the same origin.
+func (zb *ZoneBackend) setZone(z *zone) {
+	zb.mu.Lock()
+	defer zb.mu.Unlock()
+
+	if zb.zones == nil {
+		zb.zones = map[string]*zone{}
+	}
+	zb.zones[z.origin] = z
+}
+
+// newZone builds a zone from rrs, which must contain exactly one SOA record
+// marking the apex.
+func newZone(rrs []dns.RR) (*zone, error) {
+	z := &zone{records: map[string][]dns.RR{}, names: map[string]bool{}}
+
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if z.soa != nil {
+				return nil, fmt.Errorf("multiple SOA records")
+			}
+			z.soa = soa
+			z.origin = dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("no SOA record")
+	}
+
+	for _, rr := range rrs {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(z.origin, owner) {
+			return nil, fmt.Errorf("%s is outside of zone %s", owner, z.origin)
+		}
+		z.records[owner] = append(z.records[owner], rr)
+		addName(z.names, owner)
+	}
+
+	return z, nil
+}
+
+// Query answers the query in qdata from the loaded zones.
+func (zb *ZoneBackend) Query(qdata []byte) ([]byte, int, error) {
+	m := new(dns.Msg)
+
+	err := m.Unpack(qdata)
+	if err != nil {
+		return nil, http.StatusBadRequest, classify(ErrInvalidMessage, err)
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+
+	if len(m.Question) > 0 {
+		zb.answer(r, m.Question[0])
+	}
+
+	rdata, err := r.Pack()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return rdata, http.StatusOK, nil
+}
+
+// answer fills in r with the answer to q.
+func (zb *ZoneBackend) answer(r *dns.Msg, q dns.Question) {
+	zb.mu.RLock()
+	defer zb.mu.RUnlock()
+
+	name := dns.CanonicalName(q.Name)
+
+	z := zb.findZone(name)
+	if z == nil {
+		r.Rcode = dns.RcodeRefused
+		return
+	}
+
+	r.Authoritative = true
+
+	// Follow CNAME chains as long as they stay inside the zone.
+	for i := 0; i < 8; i++ {
+		rrs, found := z.lookup(name)
+		if !found {
+			r.Rcode = dns.RcodeNameError
+			r.Ns = append(r.Ns, z.soa)
+			return
+		}
+
+		var cname *dns.CNAME
+		var answers []dns.RR
+		for _, rr := range rrs {
+			switch {
+			case rr.Header().Rrtype == q.Qtype, q.Qtype == dns.TypeANY:
+				answers = append(answers, rr)
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+
+		if len(answers) > 0 {
+			r.Answer = append(r.Answer, answers...)
+			return
+		}
+
+		if cname == nil {
+			// The name exists but has no records of the queried type.
+			r.Ns = append(r.Ns, z.soa)
+			return
+		}
+
+		r.Answer = append(r.Answer, cname)
+		name = dns.CanonicalName(cname.Target)
+		if !dns.IsSubDomain(z.origin, name) {
+			return
+		}
+	}
+}
+
+// findZone returns the most specific zone containing name, or nil.
+func (zb *ZoneBackend) findZone(name string) *zone {
+	offsets := dns.Split(name)
+	for _, off := range offsets {
+		if z, ok := zb.zones[name[off:]]; ok {
+			return z
+		}
+	}
+
+	if z, ok := zb.zones["."]; ok {
+		return z
+	}
+
+	return nil
+}
+
+// lookup returns the records for name. The returned bool is false if the
+// name does not exist in the zone.
+func (z *zone) lookup(name string) ([]dns.RR, bool) {
+	// Empty non-terminals exist even though they own no records.
+	return z.records[name], z.names[name]
+}
@@ -0,0 +1,196 @@
+package dohdns_test
+
+import (
+	"github.com/eest/dohdns"
+	"github.com/miekg/dns"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var zoneTests = []struct {
+	desc    string
+	qname   string
+	qtype   uint16
+	rcode   int
+	answers []uint16
+	ns      []uint16
+}{
+	{
+		desc:    "SOA at apex",
+		qname:   "example.com.",
+		qtype:   dns.TypeSOA,
+		rcode:   dns.RcodeSuccess,
+		answers: []uint16{dns.TypeSOA},
+	},
+	{
+		desc:    "NS at apex",
+		qname:   "example.com.",
+		qtype:   dns.TypeNS,
+		rcode:   dns.RcodeSuccess,
+		answers: []uint16{dns.TypeNS},
+	},
+	{
+		desc:    "MX at apex",
+		qname:   "example.com.",
+		qtype:   dns.TypeMX,
+		rcode:   dns.RcodeSuccess,
+		answers: []uint16{dns.TypeMX},
+	},
+	{
+		desc:    "TXT at apex",
+		qname:   "example.com.",
+		qtype:   dns.TypeTXT,
+		rcode:   dns.RcodeSuccess,
+		answers: []uint16{dns.TypeTXT},
+	},
+	{
+		desc:    "A record",
+		qname:   "www.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeSuccess,
+		answers: []uint16{dns.TypeA},
+	},
+	{
+		desc:    "AAAA record with different case",
+		qname:   "WWW.Example.COM.",
+		qtype:   dns.TypeAAAA,
+		rcode:   dns.RcodeSuccess,
+		answers: []uint16{dns.TypeAAAA},
+	},
+	{
+		desc:    "CNAME followed to A record",
+		qname:   "alias.example.com.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeSuccess,
+		answers: []uint16{dns.TypeCNAME, dns.TypeA},
+	},
+	{
+		desc:    "CNAME queried directly",
+		qname:   "alias.example.com.",
+		qtype:   dns.TypeCNAME,
+		rcode:   dns.RcodeSuccess,
+		answers: []uint16{dns.TypeCNAME},
+	},
+	{
+		desc:  "Existing name without the queried type",
+		qname: "mail.example.com.",
+		qtype: dns.TypeAAAA,
+		rcode: dns.RcodeSuccess,
+		ns:    []uint16{dns.TypeSOA},
+	},
+	{
+		desc:  "Empty non-terminal",
+		qname: "b.example.com.",
+		qtype: dns.TypeA,
+		rcode: dns.RcodeSuccess,
+		ns:    []uint16{dns.TypeSOA},
+	},
+	{
+		desc:  "Missing name in zone",
+		qname: "missing.example.com.",
+		qtype: dns.TypeA,
+		rcode: dns.RcodeNameError,
+		ns:    []uint16{dns.TypeSOA},
+	},
+	{
+		desc:  "Name outside of all zones",
+		qname: "www.example.net.",
+		qtype: dns.TypeA,
+		rcode: dns.RcodeRefused,
+	},
+}
+
+// rrTypes returns the types of the records in rrs.
+func rrTypes(rrs []dns.RR) []uint16 {
+	var types []uint16
+	for _, rr := range rrs {
+		types = append(types, rr.Header().Rrtype)
+	}
+	return types
+}
+
+// equalTypes reports whether the type lists a and b are equal.
+func equalTypes(a []uint16, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestZone(t *testing.T) {
+	database, err := dohdns.NewZone([]string{"testdata/example.com.zone"})
+	if err != nil {
+		t.Fatalf("TestZone: unable to instantiate NewZone: %s", err)
+	}
+
+	for _, test := range zoneTests {
+		rdata, status, err := database.Query(packQuery(t, test.qname, test.qtype))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		if status != http.StatusOK {
+			t.Errorf(
+				"%s: unexpected status code (got %d, want %d)",
+				test.desc,
+				status,
+				http.StatusOK,
+			)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(rdata); err != nil {
+			t.Fatalf("%s: unable to parse response: %s", test.desc, err)
+		}
+
+		if r.Rcode != test.rcode {
+			t.Errorf(
+				"%s: unexpected rcode (got %s, want %s)",
+				test.desc,
+				dns.RcodeToString[r.Rcode],
+				dns.RcodeToString[test.rcode],
+			)
+		}
+
+		if answers := rrTypes(r.Answer); !equalTypes(answers, test.answers) {
+			t.Errorf(
+				"%s: unexpected answer types (got %v, want %v)",
+				test.desc,
+				answers,
+				test.answers,
+			)
+		}
+
+		if ns := rrTypes(r.Ns); !equalTypes(ns, test.ns) {
+			t.Errorf(
+				"%s: unexpected authority types (got %v, want %v)",
+				test.desc,
+				ns,
+				test.ns,
+			)
+		}
+
+		if authoritative := test.rcode != dns.RcodeRefused; r.Authoritative != authoritative {
+			t.Errorf(
+				"%s: unexpected AA flag (got %t, want %t)",
+				test.desc,
+				r.Authoritative,
+				authoritative,
+			)
+		}
+	}
+}
+
+func TestZoneWithoutSOA(t *testing.T) {
+	database := &dohdns.ZoneBackend{}
+	err := database.LoadZone(strings.NewReader("www 3600 IN A 192.0.2.1\n"), "example.org.", "example.org.zone")
+	if err == nil {
+		t.Errorf("TestZoneWithoutSOA: expected an error for a zone without SOA")
+	}
+}